@@ -0,0 +1,70 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matta/gotmuch/internal/gmail"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/sync"
+
+	"github.com/pkg/errors"
+)
+
+func runDrafts(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("drafts", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("drafts: takes no arguments")
+	}
+
+	maxDraftDeletions, err := sync.ParseLimit(*flagMaxDrafts)
+	if err != nil {
+		return err
+	}
+
+	nm, err := notmuch.New()
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize notmuch")
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := openGmail(gmail.ComposeScope)
+	if err != nil {
+		return err
+	}
+
+	rep, err := sync.SyncDrafts(ctx, s, db, nm, sync.Limits{DraftDeletions: maxDraftDeletions}, *flagForce)
+	if rep != nil {
+		fmt.Fprintf(os.Stdout, "%d drafts downloaded, %d uploaded, %d deleted from GMail, %d removed locally.\n",
+			rep.Downloaded, rep.Uploaded, rep.Deleted, rep.Removed)
+		if rep.Conflicts > 0 {
+			fmt.Fprintf(os.Stdout, "%d drafts changed both locally and in GMail kept the GMail version.\n", rep.Conflicts)
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "drafts sync failed")
+	}
+	return nil
+}
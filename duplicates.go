@@ -0,0 +1,62 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/sync"
+)
+
+func runDuplicates(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("duplicates", flag.ExitOnError)
+	labels := fs.String("labels", string(sync.MergeUnion), "how to merge the labels of copies: union or intersection")
+	fs.Parse(args)
+	policy, err := sync.ParseLabelMerge(*labels)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dups, err := sync.Duplicates(ctx, db, policy)
+	if err != nil {
+		return err
+	}
+	printDuplicates(os.Stdout, dups, policy)
+	return nil
+}
+
+// printDuplicates prints each Message-ID shared by several messages,
+// with the merged labels, followed by each copy and its labels.
+func printDuplicates(w io.Writer, dups []sync.Duplicate, policy sync.LabelMerge) {
+	for _, d := range dups {
+		fmt.Fprintf(w, "id:%s has %d copies; %s of labels: %s\n",
+			d.MessageID, len(d.Copies), policy, strings.Join(d.Labels, ","))
+		for _, c := range d.Copies {
+			fmt.Fprintf(w, "  %s: %s\n", c.PermID, strings.Join(c.Labels, ","))
+		}
+	}
+	fmt.Fprintf(w, "%d shared Message-IDs.\n", len(dups))
+}
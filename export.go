@@ -0,0 +1,78 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"time"
+
+	"github.com/matta/gotmuch/internal/export"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/sync"
+
+	"github.com/pkg/errors"
+)
+
+func runExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", export.Mbox, "archive `format`: mbox, maildir or eml-zip")
+	label := fs.String("label", "", "export only messages with the `label`, by name or ID")
+	since := fs.String("since", "", "export only messages received on or after `date`, as YYYY-MM-DD")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New(`export: want "export [flags] <path>"; use - for the standard output`)
+	}
+	f, err := export.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+	var t time.Time
+	if *since != "" {
+		if t, err = time.ParseInLocation(time.DateOnly, *since, time.Local); err != nil {
+			return errors.Wrap(err, "export: invalid -since")
+		}
+	}
+
+	nm, err := notmuch.New()
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize notmuch")
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	a, err := export.Create(f, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	rep, err := sync.Export(ctx, db, nm, a, *label, t)
+	if cerr := a.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "export failed")
+	}
+	slog.InfoContext(ctx, "exported messages", "count", rep.Exported, "format", f, "path", fs.Arg(0))
+	if rep.Partial > 0 {
+		slog.WarnContext(ctx, "left out messages stored only in part; run \"gotmuch fetch\" to store them in full",
+			"count", rep.Partial)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/gmail"
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/settings"
+
+	"github.com/pkg/errors"
+)
+
+const filtersUsage = `filters: want "filters export [file]", "filters diff <file>" or "filters import [-yes] <file>"`
+
+func runFilters(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New(filtersUsage)
+	}
+	switch args[0] {
+	case "export":
+		return runFiltersExport(ctx, args[1:])
+	case "diff":
+		return runFiltersImport(ctx, args[1:], false)
+	case "import":
+		return runFiltersImport(ctx, args[1:], true)
+	}
+	return errors.New(filtersUsage)
+}
+
+func runFiltersExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("filters export", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return errors.New(filtersUsage)
+	}
+
+	s, err := openGmail()
+	if err != nil {
+		return err
+	}
+	doc, _, err := currentSettings(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		return settings.Write(os.Stdout, doc)
+	}
+	f, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := settings.Write(f, doc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runFiltersImport prints the changes that bring the mailbox settings
+// in line with a settings document, then makes them if apply is set
+// and they are confirmed.
+func runFiltersImport(ctx context.Context, args []string, apply bool) error {
+	fs := flag.NewFlagSet("filters diff", flag.ExitOnError)
+	var yes *bool
+	if apply {
+		fs = flag.NewFlagSet("filters import", flag.ExitOnError)
+		yes = fs.Bool("yes", false, "make the changes without asking")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New(filtersUsage)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	want, err := settings.Read(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	scopes := []string{gmail.ReadonlyScope}
+	if apply {
+		scopes = append(scopes, gmail.SettingsBasicScope, gmail.SettingsSharingScope)
+	}
+	s, err := openGmail(scopes...)
+	if err != nil {
+		return err
+	}
+	cur, labels, err := currentSettings(ctx, s)
+	if err != nil {
+		return err
+	}
+	if err := want.NameLabels(labels); err != nil {
+		return err
+	}
+
+	changes := settings.Diff(cur, want)
+	if len(changes) == 0 {
+		fmt.Fprintln(os.Stdout, "Settings are up to date.")
+		return nil
+	}
+	if err := settings.WriteDiff(os.Stdout, changes); err != nil {
+		return err
+	}
+	if !apply {
+		return nil
+	}
+	if !*yes && !confirm(os.Stdin, os.Stdout, fmt.Sprintf("Make %d changes?", len(changes))) {
+		return errors.New("filters import: not confirmed; nothing changed")
+	}
+	n, err := settings.Apply(ctx, s, changes, labels)
+	fmt.Fprintf(os.Stdout, "%d of %d changes made.\n", n, len(changes))
+	return err
+}
+
+// currentSettings returns the mailbox settings, with labels named, and
+// the mailbox labels.
+func currentSettings(ctx context.Context, s *gmail.GmailService) (*settings.Settings, []message.Label, error) {
+	labels, err := s.ListLabels(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := s.GetSettings(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := doc.NameLabels(labels); err != nil {
+		return nil, nil, err
+	}
+	return doc, labels, nil
+}
+
+// confirm asks a yes or no question, reporting whether the answer was
+// yes.
+func confirm(r io.Reader, w io.Writer, question string) bool {
+	fmt.Fprintf(w, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(r).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -17,13 +17,22 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/matta/gotmuch/internal/gmail"
 	"github.com/matta/gotmuch/internal/gmailhttp"
 	"github.com/matta/gotmuch/internal/homedir"
+	"github.com/matta/gotmuch/internal/logging"
+	"github.com/matta/gotmuch/internal/metrics"
 	"github.com/matta/gotmuch/internal/notmuch"
 	"github.com/matta/gotmuch/internal/persist"
 	"github.com/matta/gotmuch/internal/sync"
@@ -35,34 +44,256 @@ import (
 )
 
 var (
-	flagTrace  = flag.Bool("T", false, "request debug tracing")
-	cpuProfile = flag.String("cpuprofile", "", "write a CPU profile to `file`")
+	flagTrace     = flag.Bool("T", false, "trace HTTP requests to the -trace-file")
+	flagTraceFile = flag.String("trace-file", "gotmuch-trace.log", "write HTTP traces to `file`")
+	flagTraceBody = flag.Bool("trace-bodies", false, "include HTTP headers and bodies in traces")
+	flagTraceMax  = flag.Int("trace-max-body", 4096, "truncate traced bodies to `bytes`; 0 for no limit")
+	cpuProfile    = flag.String("cpuprofile", "", "write a CPU profile to `file`")
+	flagVerbose   = flag.Bool("v", false, "verbose logging, including per-message events")
+	flagQuiet     = flag.Bool("q", false, "log only warnings and errors")
+	flagLogFormat = flag.String("log-format", "text", "log output `format`: text or json")
+	flagProgress  = flag.Bool("progress", true, "report download progress on stderr")
+	flagRecord    = flag.String("record", "", "record GMail API exchanges, with credentials redacted, to cassette `file`")
+	flagReplay    = flag.String("replay", "", "serve GMail API requests from cassette `file` instead of the network")
+	flagInterval  = flag.Duration("interval", 0, "if non-zero, keep running and sync every `interval`")
+	flagMetrics   = flag.String("metrics-addr", "", "serve Prometheus metrics over HTTP at `addr`/metrics")
+	flagScope     = flag.String("scope", "all", "sync `scope`: all, query:<GMail search> or labels:<label>,-<label>,...")
+	flagPrune     = flag.Bool("prune", false, "remove local copies of messages that are out of the sync scope")
+	flagNewerThan = flag.Int("newer-than", 0, "if positive, only download messages received in the last `days`")
+	flagEvict     = flag.Bool("evict", false, "remove local copies of messages older than -newer-than")
+	flagMaxSize   = flag.Int64("max-size", 0, "if positive, store only the headers of messages larger than `bytes`")
+	flagOversize  = flag.String("oversize", "stub", "what to store for messages over -max-size: `headers`, or stub (headers and a placeholder body)")
+	flagThreadHdr = flag.Bool("thread-header", false, "add an X-GM-THRID header holding the GMail thread ID to messages stored")
+	flagGmailHdrs = flag.Bool("gmail-headers", false, "add X-Gmail-Message-Id, -Thread-Id, -Labels and -History-Id headers to messages stored")
+	flagDryRun    = flag.Bool("dry-run", false, "print what sync would do, writing nothing")
+	flagPlanFmt   = flag.String("plan-format", "text", "format of the -dry-run plan: text or json")
+	flagMaxDelete = flag.String("max-deletions", "", "abort a sync that would remove more than `limit` local copies, a count or a percentage such as 5%")
+	flagMaxUnlab  = flag.String("max-label-removals", "", "abort a sync in which more than `limit` messages lose labels, a count or a percentage such as 5%")
+	flagMaxDrafts = flag.String("max-draft-deletions", "", "abort a drafts sync that would delete more than `limit` drafts from GMail, a count or a percentage such as 5%")
+	flagForce     = flag.Bool("force", false, "sync even if changes exceed -max-deletions, -max-label-removals or -max-draft-deletions, or all local drafts are missing")
 )
 
-func run() error {
-	nm, err := notmuch.New()
+// A command is a gotmuch subcommand.  The first non-flag command line
+// argument names the command, and the remaining arguments are passed to
+// its run function.
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"sync", "pull new and changed messages from GMail (the default)", runSync},
+		{"stats", "show statistics about recent sync runs", runStats},
+		{"fetch", "download skipped or stubbed messages in full; args are GMail IDs or notmuch queries", runFetch},
+		{"verify", "check stored message files and report orphans; -repair downloads damaged messages again", runVerify},
+		{"duplicates", "list GMail messages notmuch merges because they share a Message-ID", runDuplicates},
+		{"export", "write messages stored in full with their labels to an mbox, maildir or zip of .eml files", runExport},
+		{"import-takeout", "store the messages of a Google Takeout mbox, so the next sync need not download them", runImportTakeout},
+		{"upload", "import messages matching a notmuch query that did not come from GMail into GMail, labeled by their tags", runUpload},
+		{"drafts", "sync GMail drafts both ways with the gotmuch-drafts folder and notmuch messages tagged draft", runDrafts},
+		{"filters", "\"filters export|diff|import\" GMail filters, forwarding, vacation and send-as settings as YAML", runFilters},
+		{"send", "send the message on stdin through GMail, like sendmail; args are extra recipients", runSend},
+		{"threads", "\"threads diff [query]\" lists threads GMail and notmuch group differently", runThreads},
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command [args]]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// setupLogging directs log output to stderr at the level and in the
+// format requested by the command line flags.
+func setupLogging() error {
+	h, err := logging.NewHandler(os.Stderr, *flagVerbose, *flagQuiet, *flagLogFormat)
 	if err != nil {
-		return errors.Wrap(err, "unable to initialize notmuch")
+		return err
 	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
 
-	ctx := context.Background()
+// setupTrace starts tracing HTTP requests as requested by the command
+// line flags.  The returned function closes the trace file.
+func setupTrace() (func() error, error) {
+	if !*flagTrace {
+		return func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(*flagTraceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open trace file")
+	}
+	tracehttp.WrapDefaultTransport(tracehttp.Options{
+		Out:     f,
+		Bodies:  *flagTraceBody,
+		MaxBody: *flagTraceMax,
+	})
+	return f.Close, nil
+}
+
+// setupRecord starts recording HTTP exchanges if requested by the
+// command line flags.  The returned function saves the recording.
+func setupRecord() (func() error, error) {
+	if *flagRecord == "" {
+		return func() error { return nil }, nil
+	}
+	if *flagReplay != "" {
+		return nil, errors.New("-record and -replay are mutually exclusive")
+	}
+	rec := tracehttp.NewRecorder(http.DefaultTransport)
+	http.DefaultTransport = rec
+	return func() error { return rec.Save(*flagRecord) }, nil
+}
+
+func openDB(ctx context.Context) (*persist.DB, error) {
 	db, err := persist.Open(ctx, filepath.Join(homedir.Get(), ".gotmuch.db"))
 	if err != nil {
-		return errors.Wrap(err, "unable to initialize database")
+		return nil, errors.Wrap(err, "unable to initialize database")
 	}
-	defer db.Close()
+	return db, nil
+}
 
-	http, err := gmailhttp.New()
+// openGmail returns a GmailService authorized for scopes, or read only
+// if none are given.
+func openGmail(scopes ...string) (*gmail.GmailService, error) {
+	var client *http.Client
+	if *flagReplay != "" {
+		// Replayed exchanges need no credentials.
+		rep, err := tracehttp.NewReplayer(*flagReplay)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load replay cassette")
+		}
+		client = &http.Client{Transport: rep}
+	} else {
+		var err error
+		client, err = gmailhttp.New(scopes...)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to initialize GMail HTTP client")
+		}
+	}
+
+	s, err := gmail.New(client)
 	if err != nil {
-		return errors.Wrap(err, "unable to initialize GMail HTTP client")
+		return nil, errors.Wrap(err, "unable to initialize GMail")
 	}
+	return s, nil
+}
 
-	s, err := gmail.New(http)
+// serveMetrics starts serving the exported metrics at addr in the
+// background.
+func serveMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		return errors.Wrap(err, "unable to initialize GMail")
+		return errors.Wrap(err, "unable to listen for metrics requests")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	slog.Info("serving metrics", "addr", ln.Addr().String())
+	go func() {
+		err := http.Serve(ln, mux)
+		slog.Error("metrics server stopped", "err", err.Error())
+	}()
+	return nil
+}
+
+func runSync(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	fs.Parse(args)
+
+	scope, err := gmail.ParseScope(*flagScope)
+	if err != nil {
+		return err
+	}
+	oversize, err := sync.ParseOversize(*flagOversize)
+	if err != nil {
+		return err
+	}
+	maxDeletions, err := sync.ParseLimit(*flagMaxDelete)
+	if err != nil {
+		return err
+	}
+	maxLabelRemovals, err := sync.ParseLimit(*flagMaxUnlab)
+	if err != nil {
+		return err
+	}
+	if *flagPlanFmt != "text" && *flagPlanFmt != "json" {
+		return errors.Errorf("unknown plan format %q; want text or json", *flagPlanFmt)
 	}
 
-	err = sync.Sync(ctx, s, db, nm)
+	nm, err := notmuch.New()
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize notmuch")
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := openGmail()
+	if err != nil {
+		return err
+	}
+
+	opts := sync.Options{
+		Scope: scope,
+		Prune: *flagPrune,
+		Policy: sync.Policy{
+			MaxAge:   time.Duration(*flagNewerThan) * 24 * time.Hour,
+			Evict:    *flagEvict,
+			MaxSize:  *flagMaxSize,
+			Oversize: oversize,
+		},
+		ThreadHeader: *flagThreadHdr,
+		GmailHeaders: *flagGmailHdrs,
+		Limits: sync.Limits{
+			Deletions:     maxDeletions,
+			LabelRemovals: maxLabelRemovals,
+		},
+		Force: *flagForce,
+	}
+	if *flagProgress && !*flagQuiet {
+		opts.Progress = os.Stderr
+	}
+	if *flagDryRun {
+		plan, err := sync.DryRun(ctx, s, db, nm, opts)
+		if err != nil {
+			return errors.Wrap(err, "dry run failed")
+		}
+		return printPlan(os.Stdout, plan, *flagPlanFmt)
+	}
+	for {
+		err = sync.Sync(ctx, s, db, nm, opts)
+		if *flagInterval == 0 {
+			break
+		}
+		if ctx.Err() == context.Canceled {
+			// A signal stopped the run; that is how the interval
+			// mode ends.
+			slog.Info("interval sync stopped")
+			return nil
+		}
+		if err != nil {
+			// Keep going; the next run may succeed.
+			slog.Error("sync failed", "err", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			slog.Info("interval sync stopped")
+			return nil
+		case <-time.After(*flagInterval):
+		}
+	}
 	if err != nil {
 		return errors.Wrap(err, "unable to synchronize")
 	}
@@ -74,15 +305,145 @@ func run() error {
 	return nil
 }
 
+func runFetch(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("fetch: no messages given")
+	}
+
+	nm, err := notmuch.New()
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize notmuch")
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := openGmail()
+	if err != nil {
+		return err
+	}
+	return sync.Fetch(ctx, s, db, nm, fs.Args(), sync.Options{
+		ThreadHeader: *flagThreadHdr,
+		GmailHeaders: *flagGmailHdrs,
+	})
+}
+
+func runVerify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "download damaged messages again")
+	fs.Parse(args)
+
+	nm, err := notmuch.New()
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize notmuch")
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Only repairs talk to GMail.
+	var s sync.MessageStorage
+	if *repair {
+		if s, err = openGmail(); err != nil {
+			return err
+		}
+	}
+	report, err := sync.Verify(ctx, s, db, nm, *repair, sync.Options{
+		ThreadHeader: *flagThreadHdr,
+		GmailHeaders: *flagGmailHdrs,
+	})
+	if report != nil {
+		printVerifyReport(os.Stdout, report)
+	}
+	if err != nil {
+		return err
+	}
+	remaining := len(report.Orphans)
+	for _, d := range report.Damaged {
+		if !d.Repaired {
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		return errors.Errorf("verify found %d unresolved problems", remaining)
+	}
+	return nil
+}
+
+func printVerifyReport(w io.Writer, report *sync.VerifyReport) {
+	repaired := 0
+	for _, d := range report.Damaged {
+		status := "damaged"
+		if d.Repaired {
+			status = "repaired"
+			repaired++
+		}
+		fmt.Fprintf(w, "%s %s: %v\n", status, d.PermID, d.Problem)
+	}
+	for _, path := range report.Orphans {
+		fmt.Fprintf(w, "orphan %s\n", path)
+	}
+	fmt.Fprintf(w, "checked %d messages: %d damaged, %d repaired, %d orphan files\n",
+		report.Checked, len(report.Damaged), repaired, len(report.Orphans))
+}
+
+func run(ctx context.Context) error {
+	name, args := "sync", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.name == name {
+			return c.run(ctx, args)
+		}
+	}
+	flag.Usage()
+	return errors.Errorf("unknown command %q", name)
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
-	if *flagTrace {
-		tracehttp.WrapDefaultTransport()
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	closeTrace, err := setupTrace()
+	if err != nil {
+		slog.Error("failed", "err", err.Error())
+		os.Exit(1)
+	}
+	defer closeTrace()
+	saveRecord, err := setupRecord()
+	if err != nil {
+		slog.Error("failed", "err", err.Error())
+		os.Exit(1)
+	}
+	if *flagMetrics != "" {
+		if err := serveMetrics(*flagMetrics); err != nil {
+			slog.Error("failed", "err", err.Error())
+			os.Exit(1)
+		}
 	}
 
-	if err := run(); err != nil {
-		log.Fatalf("Failed: %v\n", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = run(ctx)
+	if serr := saveRecord(); serr != nil {
+		slog.Error("unable to save recording", "err", serr.Error())
+	}
+	if err != nil {
+		slog.Error("failed", "err", err.Error())
+		closeTrace()
+		os.Exit(1)
 	}
-	log.Print("Success!\n")
-	os.Exit(0)
+	slog.Debug("success")
 }
@@ -0,0 +1,325 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package export writes messages to archives other mail programs can
+// read: mbox files, maildir directories and zip files of .eml files.
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/pkg/errors"
+)
+
+// Archive formats.
+const (
+	// An mbox file in the mboxrd variant, as written by Google
+	// Takeout.
+	Mbox = "mbox"
+
+	// A maildir directory, with flags derived from GMail labels.
+	Maildir = "maildir"
+
+	// A zip file holding a .eml file for each message.
+	EMLZip = "eml-zip"
+)
+
+// ParseFormat validates the name of an archive format.
+func ParseFormat(s string) (string, error) {
+	switch s {
+	case Mbox, Maildir, EMLZip:
+		return s, nil
+	}
+	return "", errors.Errorf("unknown export format %q; want %s, %s or %s", s, Mbox, Maildir, EMLZip)
+}
+
+// Message describes a message added to an Archive.
+type Message struct {
+	// The GMail message ID.
+	PermID string
+
+	// When GMail received the message, or zero if unknown.
+	Received time.Time
+
+	// The IDs of the message's GMail labels.
+	LabelIDs []string
+
+	// Fields added at the start of the message's header section,
+	// replacing any fields of the same names.
+	Fields []message.HeaderField
+}
+
+// An Archive is written a message at a time.
+type Archive interface {
+	// Add adds a message, reading its content, in LF form, from r.
+	Add(m *Message, r io.Reader) error
+
+	// Close finishes the archive.
+	Close() error
+}
+
+// Create creates an archive in the given format at path, replacing
+// any file there.  A maildir is added to if it exists.  For formats
+// other than maildir, a path of "-" writes to the standard output.
+func Create(format, path string) (Archive, error) {
+	if format == Maildir {
+		return NewMaildir(path)
+	}
+	var f io.WriteCloser = os.Stdout
+	if path != "-" {
+		var err error
+		if f, err = os.Create(path); err != nil {
+			return nil, err
+		}
+	}
+	switch format {
+	case Mbox:
+		return &closer{NewMbox(f), f}, nil
+	case EMLZip:
+		return &closer{NewEMLZip(f), f}, nil
+	}
+	f.Close()
+	return nil, errors.Errorf("unknown export format %q", format)
+}
+
+// closer is an Archive that closes a file once closed.
+type closer struct {
+	Archive
+	f io.Closer
+}
+
+func (c *closer) Close() error {
+	err := c.Archive.Close()
+	if ferr := c.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// withFields returns the content read from r with fields added at the
+// start of its header section, and fields of the same names dropped.
+func withFields(r io.Reader, fields []message.HeaderField) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	var hdr bytes.Buffer
+	drop := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		fmt.Fprintf(&hdr, "%s: %s\n", f.Name, f.Value)
+		drop[strings.ToLower(f.Name)] = true
+	}
+	dropping := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[0] == '\n' {
+				hdr.Write(line)
+				break
+			}
+			if !dropping || (line[0] != ' ' && line[0] != '\t') {
+				name, _, ok := bytes.Cut(line, []byte(":"))
+				dropping = ok && drop[strings.ToLower(string(bytes.TrimSpace(name)))]
+			}
+			if !dropping {
+				hdr.Write(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return io.MultiReader(&hdr, br), nil
+}
+
+// mbox is an Archive writing an mbox file.
+type mbox struct {
+	w *bufio.Writer
+}
+
+// NewMbox returns an Archive writing an mbox file to w.  Lines of
+// messages that start with "From ", after any number of '>', are
+// quoted with another '>'.
+func NewMbox(w io.Writer) Archive {
+	return &mbox{w: bufio.NewWriter(w)}
+}
+
+func (a *mbox) Add(m *Message, r io.Reader) error {
+	r, err := withFields(r, m.Fields)
+	if err != nil {
+		return err
+	}
+	received := m.Received
+	if received.IsZero() {
+		received = time.Unix(0, 0)
+	}
+	fmt.Fprintf(a.w, "From %s@gotmuch %s\n", m.PermID, received.UTC().Format(time.ANSIC))
+	br := bufio.NewReader(r)
+	start, last := true, byte('\n')
+	for {
+		line, err := br.ReadSlice('\n')
+		if start && isFromLine(line) {
+			a.w.WriteByte('>')
+		}
+		a.w.Write(line)
+		if len(line) > 0 {
+			last = line[len(line)-1]
+		}
+		start = err == nil
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+	if last != '\n' {
+		a.w.WriteByte('\n')
+	}
+	// A blank line separates messages.
+	a.w.WriteByte('\n')
+	return a.w.Flush()
+}
+
+// isFromLine reports whether line starts with "From " after any number
+// of '>'.
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+func (a *mbox) Close() error {
+	return a.w.Flush()
+}
+
+// maildir is an Archive writing a maildir.
+type maildir struct {
+	dir string
+}
+
+// NewMaildir returns an Archive adding messages to the maildir dir,
+// creating it if need be.  Each message is named after its GMail ID,
+// so exporting a message again replaces it.
+func NewMaildir(dir string) (Archive, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &maildir{dir: dir}, nil
+}
+
+func (a *maildir) Add(m *Message, r io.Reader) error {
+	r, err := withFields(r, m.Fields)
+	if err != nil {
+		return err
+	}
+	var secs int64
+	if !m.Received.IsZero() {
+		secs = m.Received.Unix()
+	}
+	name := fmt.Sprintf("%d.%s.gotmuch", secs, m.PermID)
+	tmp := filepath.Join(a.dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Remove copies exported with other flags.
+	old, err := filepath.Glob(filepath.Join(a.dir, "cur", name+":2,*"))
+	if err != nil {
+		return err
+	}
+	for _, o := range old {
+		if err := os.Remove(o); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, filepath.Join(a.dir, "cur", name+":2,"+maildirFlags(m.LabelIDs)))
+}
+
+func (a *maildir) Close() error {
+	return nil
+}
+
+// maildirFlags returns the maildir flags matching GMail labels, in
+// ASCII order.
+func maildirFlags(labelIDs []string) string {
+	has := make(map[string]bool, len(labelIDs))
+	for _, id := range labelIDs {
+		has[id] = true
+	}
+	var flags []byte
+	if has["DRAFT"] {
+		flags = append(flags, 'D')
+	}
+	if has["STARRED"] {
+		flags = append(flags, 'F')
+	}
+	if !has["UNREAD"] {
+		flags = append(flags, 'S')
+	}
+	if has["TRASH"] {
+		flags = append(flags, 'T')
+	}
+	return string(flags)
+}
+
+// emlZip is an Archive writing a zip file of .eml files.
+type emlZip struct {
+	z *zip.Writer
+}
+
+// NewEMLZip returns an Archive writing a zip file to w, holding a file
+// named after its GMail ID with an .eml extension for each message.
+func NewEMLZip(w io.Writer) Archive {
+	return &emlZip{z: zip.NewWriter(w)}
+}
+
+func (a *emlZip) Add(m *Message, r io.Reader) error {
+	r, err := withFields(r, m.Fields)
+	if err != nil {
+		return err
+	}
+	fh := &zip.FileHeader{Name: m.PermID + ".eml", Method: zip.Deflate}
+	if !m.Received.IsZero() {
+		fh.Modified = m.Received
+	}
+	w, err := a.z.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *emlZip) Close() error {
+	return a.z.Close()
+}
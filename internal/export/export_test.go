@@ -0,0 +1,177 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var received = time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+
+func testMessage(id string, labels ...string) *Message {
+	return &Message{
+		PermID:   id,
+		Received: received,
+		LabelIDs: labels,
+		Fields:   []message.HeaderField{{Name: "X-Gmail-Labels", Value: strings.Join(labels, ",")}},
+	}
+}
+
+func TestWithFields(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{
+			name: "added",
+			in:   "Subject: s\n\nbody\n",
+			want: "X-Gmail-Labels: INBOX\nSubject: s\n\nbody\n",
+		},
+		{
+			name: "replaced",
+			in:   "x-gmail-labels: old,\n  folded\nSubject: s\n\nX-Gmail-Labels: body\n",
+			want: "X-Gmail-Labels: INBOX\nSubject: s\n\nX-Gmail-Labels: body\n",
+		},
+		{
+			name: "header only",
+			in:   "Subject: s\n",
+			want: "X-Gmail-Labels: INBOX\nSubject: s\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := withFields(strings.NewReader(tc.in), testMessage("m", "INBOX").Fields)
+			if err != nil {
+				t.Fatalf("withFields() error: %v", err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("reading withFields() error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("withFields() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMbox(t *testing.T) {
+	var buf bytes.Buffer
+	a := NewMbox(&buf)
+	if err := a.Add(testMessage("m1", "INBOX"), strings.NewReader("Subject: 1\n\nFrom here\n>From there\nno newline")); err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+	if err := a.Add(&Message{PermID: "m2"}, strings.NewReader("Subject: 2\n\nbody\n")); err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	want := "From m1@gotmuch Mon Mar  4 05:06:07 2019\n" +
+		"X-Gmail-Labels: INBOX\nSubject: 1\n\n>From here\n>>From there\nno newline\n\n" +
+		"From m2@gotmuch Thu Jan  1 00:00:00 1970\n" +
+		"Subject: 2\n\nbody\n\n"
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("mbox diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestMaildir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	a, err := NewMaildir(dir)
+	if err != nil {
+		t.Fatalf("NewMaildir() error: %v", err)
+	}
+	const content = "Subject: s\n\nbody\n"
+	for _, m := range []*Message{
+		testMessage("m1", "INBOX", "UNREAD"),
+		testMessage("m2", "STARRED", "DRAFT"),
+		// Exported again with other flags.
+		testMessage("m1", "INBOX"),
+	} {
+		if err := a.Add(m, strings.NewReader(content)); err != nil {
+			t.Fatalf("Add() error: %v", err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+
+	var got []string
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			t.Fatalf("ReadDir() error: %v", err)
+		}
+		for _, e := range entries {
+			got = append(got, sub+"/"+e.Name())
+		}
+	}
+	want := []string{
+		"cur/1551675967.m1.gotmuch:2,S",
+		"cur/1551675967.m2.gotmuch:2,DFS",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("maildir files diff (-want +got):\n%s", diff)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, want[0]))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if want := "X-Gmail-Labels: INBOX\n" + content; string(b) != want {
+		t.Errorf("maildir message = %q, want %q", b, want)
+	}
+}
+
+func TestEMLZip(t *testing.T) {
+	var buf bytes.Buffer
+	a := NewEMLZip(&buf)
+	const content = "Subject: s\n\nbody\n"
+	if err := a.Add(testMessage("m1", "INBOX"), strings.NewReader(content)); err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error: %v", err)
+	}
+	if len(z.File) != 1 || z.File[0].Name != "m1.eml" || !z.File[0].Modified.Equal(received) {
+		t.Fatalf("zip files = %v, want m1.eml modified at %v", z.File, received)
+	}
+	r, err := z.File[0].Open()
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error: %v", err)
+	}
+	if want := "X-Gmail-Labels: INBOX\n" + content; string(b) != want {
+		t.Errorf("eml = %q, want %q", b, want)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gmail
+
+// This file implements the Users.drafts calls.
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// draft returns the message.Draft of d.
+func draft(d *gmail.Draft) *message.Draft {
+	md := &message.Draft{DraftID: d.Id}
+	if d.Message != nil {
+		md.ID = message.ID{PermID: d.Message.Id, ThreadID: d.Message.ThreadId}
+	}
+	return md
+}
+
+// ListDrafts returns the drafts in the mailbox.
+func (s *GmailService) ListDrafts(ctx context.Context) ([]message.Draft, error) {
+	if err := s.wait(ctx, quotaUnitsDraftsList); err != nil {
+		return nil, err
+	}
+	var drafts []message.Draft
+	err := gmail.NewUsersDraftsService(s.service).List("me").Pages(ctx, func(page *gmail.ListDraftsResponse) error {
+		apiCalls.Inc("drafts.list", apiStatus(nil))
+		for _, d := range page.Drafts {
+			drafts = append(drafts, *draft(d))
+		}
+		if page.NextPageToken != "" {
+			return s.wait(ctx, quotaUnitsDraftsList)
+		}
+		return nil
+	})
+	if err != nil {
+		apiCalls.Inc("drafts.list", apiStatus(err))
+		return nil, errors.Wrap(err, "listing drafts from gmail")
+	}
+	return drafts, nil
+}
+
+// DownloadDraft writes the current version of a draft, in RFC 2822
+// format, to w and returns the draft.
+func (s *GmailService) DownloadDraft(ctx context.Context, draftID string, w io.Writer) (*message.Draft, error) {
+	for {
+		if err := s.wait(ctx, quotaUnitsDraftsGet); err != nil {
+			return nil, err
+		}
+		d, err := gmail.NewUsersDraftsService(s.service).Get("me", draftID).Format("raw").Context(ctx).Do()
+		apiCalls.Inc("drafts.get", apiStatus(err))
+		if err != nil && s.retryable(ctx, err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(notFound(ctx, err), "getting draft %v from gmail", draftID)
+		}
+		if d.Message == nil {
+			return nil, errors.Errorf("draft %v from gmail has no message", draftID)
+		}
+		dec := base64.NewDecoder(base64.URLEncoding, strings.NewReader(d.Message.Raw))
+		if _, err := io.Copy(w, dec); err != nil {
+			return nil, errors.Wrapf(err, "decoding draft %v from gmail", draftID)
+		}
+		return draft(d), nil
+	}
+}
+
+// CreateDraft adds a draft holding the message, in RFC 2822 format,
+// read from r.  If threadID is not empty the draft is added to that
+// thread.  r is read again from the start if the request is retried.
+func (s *GmailService) CreateDraft(ctx context.Context, r io.ReadSeeker, threadID string) (*message.Draft, error) {
+	for {
+		if err := s.wait(ctx, quotaUnitsDraftsCreate); err != nil {
+			return nil, err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		d, err := gmail.NewUsersDraftsService(s.service).Create("me", &gmail.Draft{Message: &gmail.Message{ThreadId: threadID}}).
+			Media(r, googleapi.ContentType("message/rfc822")).
+			Context(ctx).Do()
+		apiCalls.Inc("drafts.create", apiStatus(err))
+		if err != nil && s.retryable(ctx, err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "creating draft in gmail")
+		}
+		return draft(d), nil
+	}
+}
+
+// UpdateDraft replaces the message of a draft with the one read from
+// r, as CreateDraft does.
+func (s *GmailService) UpdateDraft(ctx context.Context, draftID string, r io.ReadSeeker, threadID string) (*message.Draft, error) {
+	for {
+		if err := s.wait(ctx, quotaUnitsDraftsUpdate); err != nil {
+			return nil, err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		d, err := gmail.NewUsersDraftsService(s.service).Update("me", draftID, &gmail.Draft{Id: draftID, Message: &gmail.Message{ThreadId: threadID}}).
+			Media(r, googleapi.ContentType("message/rfc822")).
+			Context(ctx).Do()
+		apiCalls.Inc("drafts.update", apiStatus(err))
+		if err != nil && s.retryable(ctx, err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(notFound(ctx, err), "updating draft %v in gmail", draftID)
+		}
+		return draft(d), nil
+	}
+}
+
+// DeleteDraft deletes a draft for good.  It does not go to the trash.
+func (s *GmailService) DeleteDraft(ctx context.Context, draftID string) error {
+	for {
+		if err := s.wait(ctx, quotaUnitsDraftsDelete); err != nil {
+			return err
+		}
+		err := gmail.NewUsersDraftsService(s.service).Delete("me", draftID).Context(ctx).Do()
+		apiCalls.Inc("drafts.delete", apiStatus(err))
+		if err != nil && s.retryable(ctx, err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(notFound(ctx, err), "deleting draft %v from gmail", draftID)
+		}
+		return nil
+	}
+}
@@ -16,11 +16,18 @@ package gmail
 
 import (
 	"context"
-	"encoding/base64"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/metrics"
 
 	"github.com/pkg/errors"
 	"golang.org/x/time/rate"
@@ -31,13 +38,34 @@ import (
 
 const (
 	ReadonlyScope = gmail_api.GmailReadonlyScope
+	InsertScope   = gmail_api.GmailInsertScope
+	SendScope     = gmail_api.GmailSendScope
+	ComposeScope  = gmail_api.GmailComposeScope
+
+	SettingsBasicScope   = gmail_api.GmailSettingsBasicScope
+	SettingsSharingScope = gmail_api.GmailSettingsSharingScope
 
 	// See https://developers.google.com/gmail/api/v1/reference/quota
+	quotaUnitsDraftsCreate    = 10
+	quotaUnitsDraftsDelete    = 10
+	quotaUnitsDraftsGet       = 5
+	quotaUnitsDraftsList      = 5
+	quotaUnitsDraftsUpdate    = 15
 	quotaUnitsMessagesGet     = 5
+	quotaUnitsMessagesImport  = 25
+	quotaUnitsMessagesSend    = 100
 	quotaUnitsPerGetProfile   = 2
 	quotaUnitsPerHistoryList  = 2
+	quotaUnitsPerLabelsList   = 1
 	quotaUnitsPerMessagesList = 1
 
+	// Settings calls cost 1 unit to read, 5 to change and 100 to
+	// create forwarding addresses or to create or update send-as
+	// aliases, which may send verification mail.
+	quotaUnitsSettingsGet    = 1
+	quotaUnitsSettingsChange = 5
+	quotaUnitsSettingsVerify = 100
+
 	quotaUnitsPerSecond = 250
 	rateLimitPerSecond  = quotaUnitsPerSecond * 0.8
 	rateLimitBurst      = quotaUnitsPerSecond
@@ -45,22 +73,56 @@ const (
 
 var (
 	ErrMessageNotFound = errors.New("gmail message not found")
+
+	apiCalls = metrics.NewCounter("gotmuch_gmail_api_calls_total",
+		"GMail API calls by method and HTTP status.", "method", "status")
+	quotaUnits = metrics.NewCounter("gotmuch_gmail_quota_units_total",
+		"GMail API quota units consumed, as accounted by the rate limiter.")
 )
 
 // GmailService provides access to messages stored in Google's GMail
 // system.
 type GmailService struct {
+	client  *http.Client
 	service *gmail.Service
 	limiter *rate.Limiter
+
+	// Cumulative counts of retried requests, and of the subset
+	// retried due to HTTP 429 (Too Many Requests) responses.
+	retries   atomic.Int64
+	throttled atomic.Int64
 }
 
 func isChat(msg *gmail.Message) bool {
-	for _, label := range msg.LabelIds {
-		if label == "CHAT" {
-			return true
-		}
+	return slices.Contains(msg.LabelIds, "CHAT")
+}
+
+// isDraft returns true for drafts, which are listed and downloaded
+// through the drafts API instead.
+func isDraft(msg *gmail.Message) bool {
+	return slices.Contains(msg.LabelIds, "DRAFT")
+}
+
+// wait blocks until the rate limiter allows a call costing units of
+// quota.
+func (s *GmailService) wait(ctx context.Context, units int) error {
+	if err := s.limiter.WaitN(ctx, units); err != nil {
+		return err
 	}
-	return false
+	quotaUnits.Add(float64(units))
+	return nil
+}
+
+// apiStatus returns the HTTP status of an API call's result, for use as
+// a metric label.
+func apiStatus(err error) string {
+	if err == nil {
+		return strconv.Itoa(http.StatusOK)
+	}
+	if e, ok := errors.Cause(err).(*googleapi.Error); ok {
+		return strconv.Itoa(e.Code)
+	}
+	return "error"
 }
 
 func New(client *http.Client) (*GmailService, error) {
@@ -69,19 +131,57 @@ func New(client *http.Client) (*GmailService, error) {
 		return nil, err
 	}
 	l := rate.NewLimiter(rateLimitPerSecond, rateLimitBurst)
-	return &GmailService{service: s, limiter: l}, nil
+	return &GmailService{client: client, service: s, limiter: l}, nil
 }
 
-func (s *GmailService) ListAll(ctx context.Context, handler func(message.ID) error) error {
-	if err := s.limiter.WaitN(ctx, quotaUnitsPerMessagesList); err != nil {
+// ListAll calls handler for every message in scope, which must have
+// been resolved, other than chats and drafts.  Messages are selected
+// by the scope's query or included labels only; excluded labels are
+// not known until each message is fetched, so callers must check those
+// themselves.
+func (s *GmailService) ListAll(ctx context.Context, scope Scope, handler func(message.ID) error) error {
+	if scope.Query != "" || len(scope.Include) == 0 {
+		return s.list(ctx, scope, "", handler)
+	}
+	// GMail ANDs label IDs in a list request, but a scope includes
+	// messages with any of its labels, so list each label in turn.
+	seen := make(map[string]bool)
+	for _, label := range scope.Include {
+		err := s.list(ctx, scope, label, func(id message.ID) error {
+			if seen[id.PermID] {
+				return nil
+			}
+			seen[id.PermID] = true
+			return handler(id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list lists the messages matching scope's query, or those with the
+// given label if not empty.
+func (s *GmailService) list(ctx context.Context, scope Scope, label string, handler func(message.ID) error) error {
+	if err := s.wait(ctx, quotaUnitsPerMessagesList); err != nil {
 		return err
 	}
 	msgs := gmail.NewUsersMessagesService(s.service)
-	req := msgs.List("me").Q("-is:chat {in:inbox in:sent}") // XXX "in:all"
+	req := msgs.List("me")
+	if scope.Query != "" {
+		req = req.Q(listQuery(scope.Query))
+	} else {
+		req = req.Q("-is:chat -in:drafts").IncludeSpamTrash(true)
+	}
+	if label != "" {
+		req = req.LabelIds(label)
+	}
 	total := 0
 	err := req.Pages(ctx, func(page *gmail.ListMessagesResponse) (err error) {
+		apiCalls.Inc("messages.list", apiStatus(nil))
 		total += len(page.Messages)
-		log.Printf("listed page of Gmail messages; count %d; total so far %d", len(page.Messages), total)
+		slog.DebugContext(ctx, "listed page of Gmail messages", "count", len(page.Messages), "total", total)
 		for _, msg := range page.Messages {
 			m := message.ID{PermID: msg.Id, ThreadID: msg.ThreadId}
 			if err := handler(m); err != nil {
@@ -89,39 +189,107 @@ func (s *GmailService) ListAll(ctx context.Context, handler func(message.ID) err
 			}
 		}
 		if page.NextPageToken != "" {
-			err = s.limiter.WaitN(ctx, quotaUnitsPerMessagesList)
+			err = s.wait(ctx, quotaUnitsPerMessagesList)
 		}
 		return
 	})
-	log.Printf("done listing Gmail messages; total %d", total)
+	slog.InfoContext(ctx, "done listing Gmail messages", "total", total, "scope", scope.String(), "label", label)
 	if err != nil {
+		apiCalls.Inc("messages.list", apiStatus(err))
 		err = errors.Wrap(err, "unable to retrieve all messages")
 	}
 	return err
 }
 
-func (s *GmailService) ListFrom(ctx context.Context, historyID uint64, handler func(message.ID) error) error {
+// listQuery returns the list query selecting the messages matching q.
+func listQuery(q string) string {
+	return "-is:chat -in:drafts (" + q + ")"
+}
+
+// MatchQuery reports whether the message with the given ID matches the
+// query of scope.  GMail cannot evaluate a query against one message,
+// so the query is listed for the second the message was received in.
+// A message that no longer exists matches nothing.
+func (s *GmailService) MatchQuery(ctx context.Context, scope Scope, id string) (bool, error) {
+	msg, err := s.getMessage(ctx, gmail.NewUsersMessagesService(s.service).Get("me", id).
+		Context(ctx).Format("minimal"))
+	if errors.Cause(err) == ErrMessageNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "getting message %v from gmail", id)
+	}
+	if err := s.wait(ctx, quotaUnitsPerMessagesList); err != nil {
+		return false, err
+	}
+	sec := msg.InternalDate / 1000
+	q := fmt.Sprintf("%s after:%d before:%d", listQuery(scope.Query), sec-1, sec+1)
+	found := false
+	err = gmail.NewUsersMessagesService(s.service).List("me").Q(q).
+		Pages(ctx, func(page *gmail.ListMessagesResponse) (err error) {
+			apiCalls.Inc("messages.list", apiStatus(nil))
+			for _, m := range page.Messages {
+				found = found || m.Id == id
+			}
+			if page.NextPageToken != "" && !found {
+				err = s.wait(ctx, quotaUnitsPerMessagesList)
+			}
+			return
+		})
+	if err != nil {
+		apiCalls.Inc("messages.list", apiStatus(err))
+		return false, errors.Wrapf(err, "matching message %v against the scope query", id)
+	}
+	slog.DebugContext(ctx, "matched message against the scope query", "message_id", id, "match", found)
+	return found, nil
+}
+
+// ListFrom calls handler for every message added or relabeled since
+// historyID whose labels match scope, which must have been resolved,
+// before or after the change, other than chats and drafts.  Messages
+// relabeled out of scope are included so callers can check them again.
+// Scope queries are not evaluated; callers with a query scope should
+// check messages with MatchQuery.
+func (s *GmailService) ListFrom(ctx context.Context, historyID uint64, scope Scope, handler func(message.ID) error) error {
 	wait := func() error {
-		return s.limiter.WaitN(ctx, quotaUnitsPerHistoryList)
+		return s.wait(ctx, quotaUnitsPerHistoryList)
 	}
 	if err := wait(); err != nil {
 		return err
 	}
 
-	// TODO: request labelAdded, labelRemoved, messageDeleted too.
-	req := gmail.NewUsersHistoryService(s.service).List("me").Context(ctx).HistoryTypes("messageAdded").StartHistoryId(historyID)
+	// TODO: request messageDeleted too.
+	req := gmail.NewUsersHistoryService(s.service).List("me").Context(ctx).
+		HistoryTypes("messageAdded", "labelAdded", "labelRemoved").StartHistoryId(historyID)
 	total := 0
+	seen := make(map[string]bool)
+	visit := func(msg *gmail.Message, added, removed []string) error {
+		if msg == nil || seen[msg.Id] || isChat(msg) || isDraft(msg) {
+			return nil
+		}
+		if !scope.Match(msg.LabelIds) && !scope.Match(priorLabels(msg.LabelIds, added, removed)) {
+			return nil
+		}
+		seen[msg.Id] = true
+		return handler(message.ID{PermID: msg.Id, ThreadID: msg.ThreadId})
+	}
 	err := req.Pages(ctx, func(page *gmail.ListHistoryResponse) (err error) {
+		apiCalls.Inc("history.list", apiStatus(nil))
 		total += len(page.History)
-		log.Printf("listed page of Gmail history; count %d; total so far %d", len(page.History), total)
+		slog.DebugContext(ctx, "listed page of Gmail history", "count", len(page.History), "total", total)
 		for _, h := range page.History {
-			// TODO: handle labelAdded, labelRemoved, messageDeleted too.
 			for _, added := range h.MessagesAdded {
-				m := message.ID{
-					PermID:   added.Message.Id,
-					ThreadID: added.Message.ThreadId,
+				if err := visit(added.Message, nil, nil); err != nil {
+					return err
 				}
-				if err := handler(m); err != nil {
+			}
+			for _, added := range h.LabelsAdded {
+				if err := visit(added.Message, added.LabelIds, nil); err != nil {
+					return err
+				}
+			}
+			for _, removed := range h.LabelsRemoved {
+				if err := visit(removed.Message, nil, removed.LabelIds); err != nil {
 					return err
 				}
 			}
@@ -131,90 +299,207 @@ func (s *GmailService) ListFrom(ctx context.Context, historyID uint64, handler f
 		}
 		return
 	})
-	log.Printf("done listing Gmail messages; total %d", total)
+	slog.InfoContext(ctx, "done listing Gmail history", "total", total, "messages", len(seen))
 	if err != nil {
+		apiCalls.Inc("history.list", apiStatus(err))
 		err = errors.Wrap(err, "unable to retrieve all messages")
 	}
 	return err
 }
 
+// priorLabels returns the labels a message had before added were added
+// to it and removed were removed, given the labels it has after.
+func priorLabels(after, added, removed []string) []string {
+	var prior []string
+	for _, l := range after {
+		if !slices.Contains(added, l) {
+			prior = append(prior, l)
+		}
+	}
+	return append(prior, removed...)
+}
+
+// ListLabels returns every label in the mailbox.
+func (s *GmailService) ListLabels(ctx context.Context) ([]message.Label, error) {
+	if err := s.wait(ctx, quotaUnitsPerLabelsList); err != nil {
+		return nil, err
+	}
+	resp, err := gmail.NewUsersLabelsService(s.service).List("me").Context(ctx).Do()
+	apiCalls.Inc("labels.list", apiStatus(err))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list labels")
+	}
+	labels := make([]message.Label, 0, len(resp.Labels))
+	for _, l := range resp.Labels {
+		labels = append(labels, message.Label{ID: l.Id, Name: l.Name, Type: l.Type})
+	}
+	return labels, nil
+}
+
 func (s *GmailService) getMessage(ctx context.Context, call *gmail.UsersMessagesGetCall) (*gmail.Message, error) {
 	for {
-		if err := s.limiter.WaitN(ctx, quotaUnitsMessagesGet); err != nil {
+		if err := s.wait(ctx, quotaUnitsMessagesGet); err != nil {
 			return nil, err
 		}
 		msg, err := call.Do()
+		apiCalls.Inc("messages.get", apiStatus(err))
 		if err == nil && isChat(msg) {
 			err = ErrMessageNotFound
 		}
 		if err == nil {
 			return msg, nil
 		}
+		if s.retryable(ctx, err) {
+			continue
+		}
+		return nil, notFound(ctx, err)
+	}
+}
 
-		switch cause := errors.Cause(err).(type) {
-		case *googleapi.Error:
-			if cause.Code == http.StatusTooManyRequests {
-				continue // retry
-			}
-			if cause.Code == http.StatusNotFound {
-				for _, item := range cause.Errors {
-					if item.Reason == "notFound" {
-						log.Printf("Warning: message not found...")
-						err = ErrMessageNotFound
-					}
-				}
+// retryable reports whether a failed messages call should be
+// retried, counting the retry if so.
+func (s *GmailService) retryable(ctx context.Context, err error) bool {
+	if cause, ok := errors.Cause(err).(*googleapi.Error); ok && cause.Code == http.StatusTooManyRequests {
+		slog.DebugContext(ctx, "rate limited by Gmail; retrying")
+		s.retries.Add(1)
+		s.throttled.Add(1)
+		return true
+	}
+	return false
+}
+
+// notFound returns ErrMessageNotFound if err says the message does not
+// exist, and err otherwise.
+func notFound(ctx context.Context, err error) error {
+	if cause, ok := errors.Cause(err).(*googleapi.Error); ok && cause.Code == http.StatusNotFound {
+		for _, item := range cause.Errors {
+			if item.Reason == "notFound" {
+				slog.DebugContext(ctx, "Gmail message not found")
+				return ErrMessageNotFound
 			}
 		}
-		return nil, err
 	}
+	return err
+}
+
+// RetryCounts returns the number of requests retried so far, and how
+// many of those retries were due to rate limiting by the server.
+func (s *GmailService) RetryCounts() (retries, throttled int64) {
+	return s.retries.Load(), s.throttled.Load()
 }
 
 func (s *GmailService) GetMessageHeader(ctx context.Context, id string) (*message.Header, error) {
-	for {
-		if err := s.limiter.WaitN(ctx, quotaUnitsMessagesGet); err != nil {
-			return nil, err
-		}
-		msg, err := s.getMessage(ctx, gmail.NewUsersMessagesService(s.service).Get("me", id).
-			Context(ctx).Format("minimal"))
-		if err != nil {
-			return nil, errors.Wrapf(err, "getting message %v from gmail", id)
-		}
-		m := &message.Header{ID: message.ID{PermID: msg.Id, ThreadID: msg.ThreadId},
-			LabelIDs:     msg.LabelIds,
-			HistoryID:    msg.HistoryId,
-			SizeEstimate: msg.SizeEstimate}
-		return m, nil
+	msg, err := s.getMessage(ctx, gmail.NewUsersMessagesService(s.service).Get("me", id).
+		Context(ctx).Format("minimal"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting message %v from gmail", id)
 	}
+	return header(msg), nil
 }
 
 func (s *GmailService) GetMessageFull(ctx context.Context, id string) (*message.Body, error) {
-	if err := s.limiter.WaitN(ctx, quotaUnitsMessagesGet); err != nil {
+	var raw strings.Builder
+	hdr, err := s.DownloadMessage(ctx, id, &raw)
+	if err != nil {
 		return nil, err
 	}
+	return &message.Body{Header: *hdr, Raw: raw.String()}, nil
+}
+
+// GetMessageMetadata returns a message with only its header section in
+// Raw, for use when the full message is not wanted.
+func (s *GmailService) GetMessageMetadata(ctx context.Context, id string) (*message.Body, error) {
 	msg, err := s.getMessage(ctx, gmail.NewUsersMessagesService(s.service).Get("me", id).
-		Context(ctx).Format("raw"))
+		Context(ctx).Format("metadata"))
 	if err != nil {
 		return nil, errors.Wrapf(err, "getting message %v from gmail", id)
 	}
-	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
-	if err != nil {
-		return nil, errors.Wrapf(err, "decoding message %v from gmail", id)
+	var raw strings.Builder
+	if msg.Payload != nil {
+		for _, h := range msg.Payload.Headers {
+			raw.WriteString(h.Name)
+			raw.WriteString(": ")
+			raw.WriteString(h.Value)
+			raw.WriteString("\r\n")
+		}
+	}
+	raw.WriteString("\r\n")
+	return &message.Body{Header: *header(msg), Raw: raw.String()}, nil
+}
+
+// ImportMessage adds a message to the mailbox as if it had been
+// received by email, with the given labels, and returns its header.
+// The message, in RFC 2822 format, is read from r, which is read again
+// from the start if the request is retried.  GMail dates the message
+// by its Date header.
+func (s *GmailService) ImportMessage(ctx context.Context, r io.ReadSeeker, labelIDs []string) (*message.Header, error) {
+	for {
+		if err := s.wait(ctx, quotaUnitsMessagesImport); err != nil {
+			return nil, err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		msg, err := gmail.NewUsersMessagesService(s.service).Import("me", &gmail.Message{LabelIds: labelIDs}).
+			Media(r, googleapi.ContentType("message/rfc822")).InternalDateSource("dateHeader").
+			Context(ctx).Do()
+		apiCalls.Inc("messages.import", apiStatus(err))
+		if err != nil && s.retryable(ctx, err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "importing message to gmail")
+		}
+		return header(msg), nil
+	}
+}
+
+// SendMessage sends a message, in RFC 2822 format, to the recipients
+// its To, Cc and Bcc headers name, and returns the header of the copy
+// GMail keeps.  If threadID is not empty the copy is added to that
+// thread.  r is read again from the start if the request is retried.
+func (s *GmailService) SendMessage(ctx context.Context, r io.ReadSeeker, threadID string) (*message.Header, error) {
+	for {
+		if err := s.wait(ctx, quotaUnitsMessagesSend); err != nil {
+			return nil, err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		msg, err := gmail.NewUsersMessagesService(s.service).Send("me", &gmail.Message{ThreadId: threadID}).
+			Media(r, googleapi.ContentType("message/rfc822")).
+			Context(ctx).Do()
+		apiCalls.Inc("messages.send", apiStatus(err))
+		if err != nil && s.retryable(ctx, err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "sending message with gmail")
+		}
+		return header(msg), nil
+	}
+}
+
+// header returns the message.Header of msg.
+func header(msg *gmail.Message) *message.Header {
+	h := &message.Header{
+		ID:           message.ID{PermID: msg.Id, ThreadID: msg.ThreadId},
+		LabelIDs:     msg.LabelIds,
+		HistoryID:    msg.HistoryId,
+		SizeEstimate: msg.SizeEstimate,
+	}
+	if msg.InternalDate > 0 {
+		h.InternalDate = time.UnixMilli(msg.InternalDate)
 	}
-	m := &message.Body{
-		Header: message.Header{
-			ID:           message.ID{PermID: msg.Id, ThreadID: msg.ThreadId},
-			LabelIDs:     msg.LabelIds,
-			HistoryID:    msg.HistoryId,
-			SizeEstimate: msg.SizeEstimate},
-		Raw: string(raw)}
-	return m, nil
+	return h
 }
 
 func (s *GmailService) GetProfile(ctx context.Context) (*message.Profile, error) {
-	if err := s.limiter.WaitN(ctx, quotaUnitsPerGetProfile); err != nil {
+	if err := s.wait(ctx, quotaUnitsPerGetProfile); err != nil {
 		return nil, err
 	}
 	u, err := gmail.NewUsersService(s.service).GetProfile("me").Context(ctx).Do()
+	apiCalls.Inc("users.getProfile", apiStatus(err))
 	if err != nil {
 		return nil, err
 	}
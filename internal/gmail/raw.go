@@ -0,0 +1,201 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gmail
+
+// This file implements streaming message downloads.  The generated API
+// client decodes a whole response, including the base64 encoded
+// message, before returning it, so large messages are read from the
+// HTTP response directly instead.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// DownloadMessage writes the entire email message, in RFC 2822 format,
+// to w and returns its header.  The message is decoded as it is
+// received, never held in memory as a whole.  On error, w may hold
+// part of the message.
+func (s *GmailService) DownloadMessage(ctx context.Context, id string, w io.Writer) (*message.Header, error) {
+	u := s.service.BasePath + "gmail/v1/users/me/messages/" + url.PathEscape(id) + "?" +
+		url.Values{"alt": {"json"}, "format": {"raw"}, "prettyPrint": {"false"}}.Encode()
+	for {
+		if err := s.wait(ctx, quotaUnitsMessagesGet); err != nil {
+			return nil, err
+		}
+		res, err := s.get(ctx, u)
+		apiCalls.Inc("messages.get", apiStatus(err))
+		if err != nil && s.retryable(ctx, err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(notFound(ctx, err), "getting message %v from gmail", id)
+		}
+		msg, err := decodeRaw(res.Body, w)
+		res.Body.Close()
+		if err == nil && isChat(msg) {
+			err = ErrMessageNotFound
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding message %v from gmail", id)
+		}
+		return header(msg), nil
+	}
+}
+
+// get issues a GET request for u, returning an error for any response
+// other than a success.
+func (s *GmailService) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := googleapi.CheckResponse(res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// decodeRaw decodes a messages.get response in the "raw" format from
+// r.  The message in its "raw" field is written to w as it is decoded;
+// the rest of the response, which is small, is returned.
+func decodeRaw(r io.Reader, w io.Writer) (*gmail.Message, error) {
+	br := bufio.NewReader(r)
+	var rest bytes.Buffer
+	found, err := scanToRaw(br, &rest)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		sr := &stringReader{r: br}
+		if _, err := io.Copy(w, base64.NewDecoder(base64.URLEncoding, sr)); err != nil {
+			return nil, err
+		}
+		if !sr.done {
+			return nil, errors.New("malformed raw message")
+		}
+		rest.WriteByte('"')
+	}
+	if _, err := rest.ReadFrom(br); err != nil {
+		return nil, err
+	}
+	var msg gmail.Message
+	if err := json.Unmarshal(rest.Bytes(), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// scanToRaw copies the JSON object read from br to rest up to and
+// including the opening quote of the value of its top level "raw"
+// field, and reports whether it was found.
+func scanToRaw(br *bufio.Reader, rest *bytes.Buffer) (bool, error) {
+	var (
+		depth    int
+		inString bool
+		escaped  bool
+		start    int    // The offset in rest of the current string.
+		last     string // The last complete string.
+		afterRaw bool   // After `"raw":` at the top level.
+	)
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return false, nil // The JSON decoder reports any error.
+		}
+		if err != nil {
+			return false, err
+		}
+		rest.WriteByte(c)
+		switch {
+		case inString && escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case inString && c == '"':
+			inString = false
+			last = string(rest.Bytes()[start : rest.Len()-1])
+		case inString:
+		case afterRaw && c == '"':
+			return true, nil
+		case c == '"':
+			inString = true
+			start = rest.Len()
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		case c == ':':
+			afterRaw = depth == 1 && last == "raw"
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		default:
+			afterRaw = false
+		}
+	}
+}
+
+// stringReader reads the contents of a JSON string from r, up to its
+// closing quote, which is consumed.  Escapes are not expected, since
+// base64 encoded data needs none.
+type stringReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (sr *stringReader) Read(p []byte) (int, error) {
+	if sr.done {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if sr.r.Buffered() == 0 {
+		if _, err := sr.r.Peek(1); err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	buf, _ := sr.r.Peek(min(sr.r.Buffered(), len(p)))
+	skip := 0
+	if i := bytes.IndexAny(buf, `"\`); i >= 0 {
+		if buf[i] == '\\' {
+			return 0, errors.New("unexpected escape in raw message")
+		}
+		buf = buf[:i]
+		sr.done = true
+		skip = 1
+	}
+	n := copy(p, buf)
+	sr.r.Discard(n + skip)
+	return n, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gmail
+
+import (
+	"strings"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/pkg/errors"
+)
+
+// Scope selects the messages to synchronize.  The zero Scope selects
+// every message in the mailbox, including spam and trash.
+type Scope struct {
+	// If Query is not empty, only messages matching the GMail
+	// search query are in scope.  As in the GMail web interface,
+	// spam and trash are excluded unless the query says otherwise
+	// (e.g. with "in:anywhere").
+	Query string
+
+	// If Include is not empty, only messages with at least one of
+	// these labels are in scope.
+	Include []string
+
+	// Messages with any of these labels are not in scope.
+	Exclude []string
+}
+
+// ParseScope parses a scope from its string form, which is one of:
+//
+//	all
+//	query:<GMail search query>
+//	labels:<label>,...
+//
+// In the labels form each label is a label name or ID to include, or
+// if prefixed with "-", to exclude.
+func ParseScope(s string) (Scope, error) {
+	switch {
+	case s == "all":
+		return Scope{}, nil
+	case strings.HasPrefix(s, "query:"):
+		q := strings.TrimSpace(strings.TrimPrefix(s, "query:"))
+		if q == "" {
+			return Scope{}, errors.Errorf("scope %q has an empty query", s)
+		}
+		return Scope{Query: q}, nil
+	case strings.HasPrefix(s, "labels:"):
+		var scope Scope
+		for _, l := range strings.Split(strings.TrimPrefix(s, "labels:"), ",") {
+			l = strings.TrimSpace(l)
+			switch {
+			case l == "" || l == "-":
+				return Scope{}, errors.Errorf("scope %q has an empty label", s)
+			case strings.HasPrefix(l, "-"):
+				scope.Exclude = append(scope.Exclude, l[1:])
+			default:
+				scope.Include = append(scope.Include, l)
+			}
+		}
+		return scope, nil
+	}
+	return Scope{}, errors.Errorf("unknown scope %q; want all, query:... or labels:...", s)
+}
+
+// String returns the scope in the form accepted by ParseScope.
+func (s Scope) String() string {
+	if s.Query != "" {
+		return "query:" + s.Query
+	}
+	if len(s.Include) == 0 && len(s.Exclude) == 0 {
+		return "all"
+	}
+	labels := append([]string(nil), s.Include...)
+	for _, l := range s.Exclude {
+		labels = append(labels, "-"+l)
+	}
+	return "labels:" + strings.Join(labels, ",")
+}
+
+// HasLabels returns true if the scope is decided by labels.
+func (s Scope) HasLabels() bool {
+	return len(s.Include) > 0 || len(s.Exclude) > 0
+}
+
+// Resolve returns the scope with label names replaced by label IDs.
+// Names are matched without regard to case.
+func (s Scope) Resolve(labels []message.Label) (Scope, error) {
+	ids := make(map[string]string, 2*len(labels))
+	for _, l := range labels {
+		ids[strings.ToLower(l.Name)] = l.ID
+	}
+	// IDs take precedence over names.
+	for _, l := range labels {
+		ids[strings.ToLower(l.ID)] = l.ID
+	}
+	resolve := func(names []string) ([]string, error) {
+		var out []string
+		for _, name := range names {
+			id, ok := ids[strings.ToLower(name)]
+			if !ok {
+				return nil, errors.Errorf("scope: no label named %q", name)
+			}
+			out = append(out, id)
+		}
+		return out, nil
+	}
+
+	r := Scope{Query: s.Query}
+	var err error
+	if r.Include, err = resolve(s.Include); err != nil {
+		return Scope{}, err
+	}
+	if r.Exclude, err = resolve(s.Exclude); err != nil {
+		return Scope{}, err
+	}
+	return r, nil
+}
+
+// Match returns true if a message with the given label IDs is in a
+// resolved scope.  Messages always match scopes with a Query, since
+// they can only be evaluated by GMail.
+func (s Scope) Match(labelIDs []string) bool {
+	has := func(ids []string) bool {
+		for _, id := range ids {
+			for _, l := range labelIDs {
+				if l == id {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if len(s.Include) > 0 && !has(s.Include) {
+		return false
+	}
+	return !has(s.Exclude)
+}
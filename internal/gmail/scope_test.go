@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gmail
+
+import (
+	"testing"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseScope(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Scope
+	}{
+		{"all", Scope{}},
+		{"query:in:anywhere -from:me", Scope{Query: "in:anywhere -from:me"}},
+		{"labels:INBOX, SENT,-SPAM", Scope{Include: []string{"INBOX", "SENT"}, Exclude: []string{"SPAM"}}},
+		{"labels:-SPAM,-TRASH", Scope{Exclude: []string{"SPAM", "TRASH"}}},
+	}
+	for _, tc := range cases {
+		got, err := ParseScope(tc.in)
+		if err != nil {
+			t.Errorf("ParseScope(%q) error: %v", tc.in, err)
+			continue
+		}
+		if !cmp.Equal(got, tc.want) {
+			t.Errorf("ParseScope(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+		// String must round trip.
+		if again, err := ParseScope(got.String()); err != nil || !cmp.Equal(again, got) {
+			t.Errorf("ParseScope(%q) = %+v, %v, want %+v", got.String(), again, err, got)
+		}
+	}
+	for _, in := range []string{"", "inbox", "query:", "labels:", "labels:INBOX,,SENT", "labels:-"} {
+		if _, err := ParseScope(in); err == nil {
+			t.Errorf("ParseScope(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestScopeResolveMatch(t *testing.T) {
+	labels := []message.Label{
+		{ID: "INBOX", Name: "INBOX", Type: "system"},
+		{ID: "SPAM", Name: "SPAM", Type: "system"},
+		{ID: "Label_1", Name: "Receipts", Type: "user"},
+	}
+	scope, err := Scope{Include: []string{"inbox", "receipts"}, Exclude: []string{"SPAM"}}.Resolve(labels)
+	if err != nil {
+		t.Fatalf("Resolve() error: %v", err)
+	}
+	want := Scope{Include: []string{"INBOX", "Label_1"}, Exclude: []string{"SPAM"}}
+	if !cmp.Equal(scope, want) {
+		t.Errorf("Resolve() = %+v, want %+v", scope, want)
+	}
+	for _, tc := range []struct {
+		labels []string
+		want   bool
+	}{
+		{[]string{"INBOX"}, true},
+		{[]string{"UNREAD", "Label_1"}, true},
+		{[]string{"Label_1", "SPAM"}, false},
+		{[]string{"SENT"}, false},
+		{nil, false},
+	} {
+		if got := scope.Match(tc.labels); got != tc.want {
+			t.Errorf("Match(%v) = %v, want %v", tc.labels, got, tc.want)
+		}
+	}
+	if !(Scope{}).Match(nil) {
+		t.Errorf("Scope{}.Match(nil) = false, want true")
+	}
+	if _, err := (Scope{Exclude: []string{"nope"}}).Resolve(labels); err == nil {
+		t.Errorf("Resolve() of an unknown label succeeded, want an error")
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gmail
+
+// This file implements the Users.settings calls, converting to and
+// from the settings document types.
+
+import (
+	"context"
+	"time"
+
+	"github.com/matta/gotmuch/internal/settings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+)
+
+// settingsCall makes a settings call, named for metrics, retrying it
+// while rate limited.
+func (s *GmailService) settingsCall(ctx context.Context, units int, name string, call func() error) error {
+	for {
+		if err := s.wait(ctx, units); err != nil {
+			return err
+		}
+		err := call()
+		apiCalls.Inc(name, apiStatus(err))
+		if err != nil && s.retryable(ctx, err) {
+			continue
+		}
+		return errors.Wrapf(err, "gmail %s failed", name)
+	}
+}
+
+// GetSettings returns the settings of the mailbox.  Filters give labels
+// by ID.
+func (s *GmailService) GetSettings(ctx context.Context) (*settings.Settings, error) {
+	svc := gmail.NewUsersSettingsService(s.service)
+	doc := &settings.Settings{}
+
+	var filters *gmail.ListFiltersResponse
+	err := s.settingsCall(ctx, quotaUnitsSettingsGet, "settings.filters.list", func() (err error) {
+		filters, err = svc.Filters.List("me").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range filters.Filter {
+		doc.Filters = append(doc.Filters, filter(f))
+	}
+
+	var fwd *gmail.ListForwardingAddressesResponse
+	err = s.settingsCall(ctx, quotaUnitsSettingsGet, "settings.forwardingAddresses.list", func() (err error) {
+		fwd, err = svc.ForwardingAddresses.List("me").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range fwd.ForwardingAddresses {
+		doc.ForwardingAddresses = append(doc.ForwardingAddresses, a.ForwardingEmail)
+	}
+
+	var v *gmail.VacationSettings
+	err = s.settingsCall(ctx, quotaUnitsSettingsGet, "settings.getVacation", func() (err error) {
+		v, err = svc.GetVacation("me").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc.Vacation = settings.Vacation{
+		Enabled:      v.EnableAutoReply,
+		Subject:      v.ResponseSubject,
+		Body:         v.ResponseBodyPlainText,
+		HTMLBody:     v.ResponseBodyHtml,
+		ContactsOnly: v.RestrictToContacts,
+		DomainOnly:   v.RestrictToDomain,
+		Start:        fromMillis(v.StartTime),
+		End:          fromMillis(v.EndTime),
+	}
+
+	var sendAs *gmail.ListSendAsResponse
+	err = s.settingsCall(ctx, quotaUnitsSettingsGet, "settings.sendAs.list", func() (err error) {
+		sendAs, err = svc.SendAs.List("me").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range sendAs.SendAs {
+		doc.SendAs = append(doc.SendAs, settings.SendAs{
+			Email:        a.SendAsEmail,
+			DisplayName:  a.DisplayName,
+			ReplyTo:      a.ReplyToAddress,
+			Signature:    a.Signature,
+			Default:      a.IsDefault,
+			TreatAsAlias: a.TreatAsAlias,
+			Primary:      a.IsPrimary,
+		})
+	}
+	return doc, nil
+}
+
+// filter returns the settings.Filter of f.
+func filter(f *gmail.Filter) settings.Filter {
+	sf := settings.Filter{ID: f.Id}
+	if c := f.Criteria; c != nil {
+		sf.Criteria = settings.Criteria{
+			From:           c.From,
+			To:             c.To,
+			Subject:        c.Subject,
+			Query:          c.Query,
+			NegatedQuery:   c.NegatedQuery,
+			HasAttachment:  c.HasAttachment,
+			ExcludeChats:   c.ExcludeChats,
+			Size:           c.Size,
+			SizeComparison: c.SizeComparison,
+		}
+	}
+	if a := f.Action; a != nil {
+		sf.Action = settings.Action{
+			AddLabels:    a.AddLabelIds,
+			RemoveLabels: a.RemoveLabelIds,
+			Forward:      a.Forward,
+		}
+	}
+	return sf
+}
+
+// fromMillis returns the time ms milliseconds after the Unix epoch, or
+// the zero time for 0.
+func fromMillis(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms).UTC()
+}
+
+// toMillis reverses fromMillis.
+func toMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// CreateFilter adds a filter.
+func (s *GmailService) CreateFilter(ctx context.Context, f settings.Filter) error {
+	c, a := f.Criteria, f.Action
+	gf := &gmail.Filter{
+		Criteria: &gmail.FilterCriteria{
+			From:           c.From,
+			To:             c.To,
+			Subject:        c.Subject,
+			Query:          c.Query,
+			NegatedQuery:   c.NegatedQuery,
+			HasAttachment:  c.HasAttachment,
+			ExcludeChats:   c.ExcludeChats,
+			Size:           c.Size,
+			SizeComparison: c.SizeComparison,
+		},
+		Action: &gmail.FilterAction{
+			AddLabelIds:    a.AddLabels,
+			RemoveLabelIds: a.RemoveLabels,
+			Forward:        a.Forward,
+		},
+	}
+	return s.settingsCall(ctx, quotaUnitsSettingsChange, "settings.filters.create", func() error {
+		_, err := gmail.NewUsersSettingsFiltersService(s.service).Create("me", gf).Context(ctx).Do()
+		return err
+	})
+}
+
+// DeleteFilter deletes a filter.
+func (s *GmailService) DeleteFilter(ctx context.Context, id string) error {
+	return s.settingsCall(ctx, quotaUnitsSettingsChange, "settings.filters.delete", func() error {
+		return gmail.NewUsersSettingsFiltersService(s.service).Delete("me", id).Context(ctx).Do()
+	})
+}
+
+// CreateForwardingAddress adds a forwarding address.  GMail mails it
+// for verification before it can be used.
+func (s *GmailService) CreateForwardingAddress(ctx context.Context, addr string) error {
+	return s.settingsCall(ctx, quotaUnitsSettingsVerify, "settings.forwardingAddresses.create", func() error {
+		_, err := gmail.NewUsersSettingsForwardingAddressesService(s.service).
+			Create("me", &gmail.ForwardingAddress{ForwardingEmail: addr}).Context(ctx).Do()
+		return err
+	})
+}
+
+// DeleteForwardingAddress deletes a forwarding address.
+func (s *GmailService) DeleteForwardingAddress(ctx context.Context, addr string) error {
+	return s.settingsCall(ctx, quotaUnitsSettingsChange, "settings.forwardingAddresses.delete", func() error {
+		return gmail.NewUsersSettingsForwardingAddressesService(s.service).Delete("me", addr).Context(ctx).Do()
+	})
+}
+
+// UpdateVacation replaces the vacation responder settings.
+func (s *GmailService) UpdateVacation(ctx context.Context, v settings.Vacation) error {
+	gv := &gmail.VacationSettings{
+		EnableAutoReply:       v.Enabled,
+		ResponseSubject:       v.Subject,
+		ResponseBodyPlainText: v.Body,
+		ResponseBodyHtml:      v.HTMLBody,
+		RestrictToContacts:    v.ContactsOnly,
+		RestrictToDomain:      v.DomainOnly,
+		StartTime:             toMillis(v.Start),
+		EndTime:               toMillis(v.End),
+		// Turning the responder off must be said explicitly.
+		ForceSendFields: []string{"EnableAutoReply"},
+	}
+	return s.settingsCall(ctx, quotaUnitsSettingsChange, "settings.updateVacation", func() error {
+		_, err := gmail.NewUsersSettingsService(s.service).UpdateVacation("me", gv).Context(ctx).Do()
+		return err
+	})
+}
+
+// sendAs returns the gmail.SendAs of a.  GMail only allows IsDefault
+// to be set, never cleared, so it is sent only when set.
+func sendAs(a settings.SendAs) *gmail.SendAs {
+	return &gmail.SendAs{
+		SendAsEmail:    a.Email,
+		DisplayName:    a.DisplayName,
+		ReplyToAddress: a.ReplyTo,
+		Signature:      a.Signature,
+		IsDefault:      a.Default,
+		TreatAsAlias:   a.TreatAsAlias,
+	}
+}
+
+// CreateSendAs adds a send-as alias.  GMail mails addresses outside
+// the account for verification before they can be used.
+func (s *GmailService) CreateSendAs(ctx context.Context, a settings.SendAs) error {
+	return s.settingsCall(ctx, quotaUnitsSettingsVerify, "settings.sendAs.create", func() error {
+		_, err := gmail.NewUsersSettingsSendAsService(s.service).Create("me", sendAs(a)).Context(ctx).Do()
+		return err
+	})
+}
+
+// UpdateSendAs replaces the settings of a send-as alias.
+func (s *GmailService) UpdateSendAs(ctx context.Context, a settings.SendAs) error {
+	return s.settingsCall(ctx, quotaUnitsSettingsVerify, "settings.sendAs.update", func() error {
+		_, err := gmail.NewUsersSettingsSendAsService(s.service).Update("me", a.Email, sendAs(a)).Context(ctx).Do()
+		return err
+	})
+}
+
+// DeleteSendAs deletes a send-as alias.
+func (s *GmailService) DeleteSendAs(ctx context.Context, email string) error {
+	return s.settingsCall(ctx, quotaUnitsSettingsChange, "settings.sendAs.delete", func() error {
+		return gmail.NewUsersSettingsSendAsService(s.service).Delete("me", email).Context(ctx).Do()
+	})
+}
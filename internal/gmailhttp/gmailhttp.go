@@ -30,7 +30,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/matta/gotmuch/internal/homedir"
 	"golang.org/x/oauth2"
@@ -83,13 +86,28 @@ func saveToken(path string, token *oauth2.Token) {
 	json.NewEncoder(f).Encode(token)
 }
 
+// tokenFile returns the name of the file storing the token authorizing
+// scopes.  Tokens are kept per set of scopes, so granting more for one
+// command does not affect the others.
+func tokenFile(scopes []string) string {
+	if len(scopes) == 1 && scopes[0] == gmail.GmailReadonlyScope {
+		return "token.json"
+	}
+	names := make([]string, len(scopes))
+	for i, s := range scopes {
+		names[i] = path.Base(s)
+	}
+	sort.Strings(names)
+	return "token-" + strings.Join(names, "+") + ".json"
+}
+
 // Retrieve a token, saves the token, then returns the generated client.
 func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
+	// The token file stores the user's access and refresh tokens, and is
 	// created automatically when the authorization flow completes for the first
 	// time.
 	// TODO: integrate this IO with the persist package.
-	tokFile := "token.json"
+	tokFile := tokenFile(config.Scopes)
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
 		tok = getTokenFromWeb(config)
@@ -98,8 +116,12 @@ func getClient(config *oauth2.Config) *http.Client {
 	return config.Client(context.Background(), tok)
 }
 
-// New returns a new HTTP client capable of using the GMail API.
-func New() (*http.Client, error) {
+// New returns a new HTTP client capable of using the GMail API with the
+// given scopes, or read only if none are given.
+func New(scopes ...string) (*http.Client, error) {
+	if len(scopes) == 0 {
+		scopes = []string{gmail.GmailReadonlyScope}
+	}
 	// TODO: integrate this IO with the persist package.
 	name := filepath.Join(homedir.Get(), "gotmuch-credentials.json")
 	bytes, err := ioutil.ReadFile(name)
@@ -107,8 +129,7 @@ func New() (*http.Client, error) {
 		return nil, err
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(bytes, gmail.GmailReadonlyScope)
+	config, err := google.ConfigFromJSON(bytes, scopes...)
 	if err != nil {
 		log.Fatalf("Unable to parse client secret file to config: %v", err)
 	}
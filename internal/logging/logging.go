@@ -0,0 +1,46 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging sets up the log/slog output of gotmuch.
+package logging
+
+import (
+	"io"
+	"log/slog"
+
+	"github.com/pkg/errors"
+)
+
+// NewHandler returns a handler writing to w at the level called for by
+// verbose and quiet, in the named format: text or json.
+func NewHandler(w io.Writer, verbose, quiet bool, format string) (slog.Handler, error) {
+	if verbose && quiet {
+		return nil, errors.New("-v and -q are mutually exclusive")
+	}
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	switch {
+	case verbose:
+		opts.Level = slog.LevelDebug
+	case quiet:
+		opts.Level = slog.LevelWarn
+	}
+
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, errors.Errorf("unknown -log-format %q", format)
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewHandlerLevels(t *testing.T) {
+	tests := []struct {
+		name           string
+		verbose, quiet bool
+		want           []string
+	}{
+		{name: "default", want: []string{"info", "warn"}},
+		{name: "verbose", verbose: true, want: []string{"debug", "info", "warn"}},
+		{name: "quiet", quiet: true, want: []string{"warn"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			h, err := NewHandler(&buf, tc.verbose, tc.quiet, "text")
+			if err != nil {
+				t.Fatalf("NewHandler() error: %v", err)
+			}
+			log := slog.New(h)
+			log.Debug("debug")
+			log.Info("info")
+			log.Warn("warn")
+
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				_, msg, _ := strings.Cut(line, " msg=")
+				got = append(got, msg)
+			}
+			if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+				t.Errorf("logged %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewHandlerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, false, false, "json")
+	if err != nil {
+		t.Fatalf("NewHandler() error: %v", err)
+	}
+	slog.New(h).Info("inserting message", "message_id", "m1")
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("log output %q is not JSON: %v", buf.String(), err)
+	}
+	if got["level"] != "INFO" || got["msg"] != "inserting message" || got["message_id"] != "m1" {
+		t.Errorf("logged %v, want an INFO record of message m1", got)
+	}
+}
+
+func TestNewHandlerErrors(t *testing.T) {
+	if _, err := NewHandler(&bytes.Buffer{}, true, true, "text"); err == nil {
+		t.Errorf("NewHandler() with -v and -q succeeded, want an error")
+	}
+	if _, err := NewHandler(&bytes.Buffer{}, false, false, "xml"); err == nil {
+		t.Errorf("NewHandler() with format xml succeeded, want an error")
+	}
+}
@@ -17,6 +17,13 @@ package message
 // This file provides the common data objects used by the rest of the
 // program.
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
 // ID defines the properties that uniquely identify a message.
 type ID struct {
 	// The permanent and unique ID of a message in a storage
@@ -42,6 +49,10 @@ type Header struct {
 	// An estimated size of the message (bytes).
 	SizeEstimate int64
 
+	// The time the message was received by the storage system.
+	// Zero if unknown.
+	InternalDate time.Time
+
 	// An opque identifier naming the snapshot in time at which
 	// this record was taken.  Values need not be monotonic.
 	HistoryID uint64
@@ -62,3 +73,68 @@ type Profile struct {
 	// The ID of the mailbox's current history record.
 	HistoryID uint64
 }
+
+// Label defines a label that may be applied to messages.
+type Label struct {
+	// The permanent and unique ID of the label.
+	ID string
+
+	// The user visible name of the label.
+	Name string
+
+	// Either "system" for labels created by the storage system,
+	// or "user" for labels created by the user.
+	Type string
+}
+
+// Draft identifies a draft and the message holding its current
+// version.
+type Draft struct {
+	// The permanent and unique ID of the draft, which stays the
+	// same as the draft is updated.
+	DraftID string
+
+	// The IDs of the message holding the current version, which
+	// changes on every update.
+	ID
+}
+
+// HeaderField is a single field in a message's header section.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// PrependHeaders returns a copy of b with fields added at the start of
+// its header section.
+func (b *Body) PrependHeaders(fields ...HeaderField) *Body {
+	if len(fields) == 0 {
+		return b
+	}
+	var sb strings.Builder
+	for _, f := range fields {
+		sb.WriteString(f.Name)
+		sb.WriteString(": ")
+		sb.WriteString(f.Value)
+		sb.WriteString("\r\n")
+	}
+	sb.WriteString(b.Raw)
+	c := *b
+	c.Raw = sb.String()
+	return &c
+}
+
+// Digest identifies the content of a stored message.
+type Digest struct {
+	// The SHA-256 of the content, in lower case hex.
+	SHA256 string
+
+	// The length of the content in bytes.
+	Size int64
+}
+
+// DigestOf returns the Digest of content.
+func DigestOf(content []byte) Digest {
+	sum := sha256.Sum256(content)
+	return Digest{SHA256: hex.EncodeToString(sum[:]), Size: int64(len(content))}
+}
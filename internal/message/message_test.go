@@ -0,0 +1,46 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import "testing"
+
+func TestPrependHeaders(t *testing.T) {
+	b := &Body{Header: Header{ID: ID{PermID: "m1"}}, Raw: "Subject: hi\r\n\r\nbody\r\n"}
+	got := b.PrependHeaders(HeaderField{"X-A", "1"}, HeaderField{"X-B", "two words"})
+	want := "X-A: 1\r\nX-B: two words\r\nSubject: hi\r\n\r\nbody\r\n"
+	if got.Raw != want {
+		t.Errorf("PrependHeaders() = %q, want %q", got.Raw, want)
+	}
+	if got.PermID != "m1" {
+		t.Errorf("PrependHeaders() lost the header: %+v", got.Header)
+	}
+	if b.Raw != "Subject: hi\r\n\r\nbody\r\n" {
+		t.Errorf("PrependHeaders() modified its receiver: %q", b.Raw)
+	}
+	if b.PrependHeaders() != b {
+		t.Errorf("PrependHeaders() with no fields returned a copy")
+	}
+}
+
+func TestDigestOf(t *testing.T) {
+	got := DigestOf([]byte("abc"))
+	want := Digest{
+		SHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		Size:   3,
+	}
+	if got != want {
+		t.Errorf("DigestOf() = %+v, want %+v", got, want)
+	}
+}
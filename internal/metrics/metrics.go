@@ -0,0 +1,298 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package metrics implements counters, gauges and histograms exported in
+the Prometheus text exposition format.
+
+Metrics are normally declared as package level variables, which
+registers them with the Default registry:
+
+	var calls = metrics.NewCounter("myprog_calls_total", "Calls made.", "method")
+
+	calls.Inc("get")
+
+Each metric takes a fixed list of label names when declared, and a
+value for each label when updated.
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram bucket upper bounds suitable for
+// latencies measured in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Default is the registry used by NewCounter, NewGauge and
+// NewHistogram.
+var Default = NewRegistry()
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// metric is the state shared by all kinds of metric.
+type metric struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64 // for histograms only
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series holds the values for one combination of label values.
+type series struct {
+	labelValues []string
+	value       float64  // counters and gauges; the sum for histograms
+	counts      []uint64 // per bucket, histograms only
+	count       uint64   // histograms only
+}
+
+func (r *Registry) register(m *metric) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, o := range r.metrics {
+		if o.name == m.name {
+			panic(fmt.Sprintf("metrics: %q registered twice", m.name))
+		}
+	}
+	m.series = make(map[string]*series)
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (m *metric) with(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %q takes %d label values, got %d",
+			m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == histogramKind {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Counter is a metric whose value only increases.
+type Counter struct{ m *metric }
+
+// NewCounter returns a Counter registered with r.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(&metric{name: name, help: help, kind: counterKind, labels: labels})}
+}
+
+// NewCounter returns a Counter registered with the Default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.m.mu.Lock()
+	c.m.with(labelValues).value += v
+	c.m.mu.Unlock()
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is a metric whose value may go up and down.
+type Gauge struct{ m *metric }
+
+// NewGauge returns a Gauge registered with r.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&metric{name: name, help: help, kind: gaugeKind, labels: labels})}
+}
+
+// NewGauge returns a Gauge registered with the Default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	g.m.with(labelValues).value = v
+	g.m.mu.Unlock()
+}
+
+// Histogram is a metric counting observations in buckets.
+type Histogram struct{ m *metric }
+
+// NewHistogram returns a Histogram registered with r.  The buckets are
+// the inclusive upper bounds of each bucket, in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: %q buckets are not sorted", name))
+	}
+	return &Histogram{r.register(&metric{name: name, help: help, kind: histogramKind,
+		labels: labels, buckets: buckets})}
+}
+
+// NewHistogram returns a Histogram registered with the Default
+// registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// Observe adds an observation of v to the histogram.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.with(labelValues)
+	s.value += v
+	s.count++
+	for i, le := range h.m.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+}
+
+// WriteTo writes every metric in r to w in the Prometheus text
+// exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	var sb strings.Builder
+	for _, m := range metrics {
+		m.write(&sb)
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (m *metric) write(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(sb, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(sb, "# TYPE %s %s\n", m.name, m.kind)
+	leNames := append(append([]string(nil), m.labels...), "le")
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		labels := formatLabels(m.labels, s.labelValues)
+		if m.kind != histogramKind {
+			fmt.Fprintf(sb, "%s%s %s\n", m.name, labels, formatValue(s.value))
+			continue
+		}
+		leValues := append(append([]string(nil), s.labelValues...), "")
+		for i, le := range m.buckets {
+			leValues[len(leValues)-1] = formatValue(le)
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", m.name,
+				formatLabels(leNames, leValues), s.counts[i])
+		}
+		leValues[len(leValues)-1] = "+Inf"
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", m.name,
+			formatLabels(leNames, leValues), s.count)
+		fmt.Fprintf(sb, "%s_sum%s %s\n", m.name, labels, formatValue(s.value))
+		fmt.Fprintf(sb, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(values[i]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// Handler returns an http.Handler serving the metrics in r.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// Handler returns an http.Handler serving the metrics in the Default
+// registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
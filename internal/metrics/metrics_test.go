@@ -0,0 +1,86 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_calls_total", "Calls made.", "method", "status")
+	g := r.NewGauge("test_last_time", "Last time.\nIn seconds.")
+	h := r.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+
+	c.Inc("get", "200")
+	c.Add(2, "get", "200")
+	c.Inc("list", `a "quoted" value`)
+	g.Set(1.5e9)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatalf("WriteTo() error: %v", err)
+	}
+	want := `# HELP test_calls_total Calls made.
+# TYPE test_calls_total counter
+test_calls_total{method="get",status="200"} 3
+test_calls_total{method="list",status="a \"quoted\" value"} 1
+# HELP test_last_time Last time.\nIn seconds.
+# TYPE test_last_time gauge
+test_last_time 1.5e+09
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+`
+	if got := sb.String(); got != want {
+		t.Errorf("WriteTo() diff (-got +want):\n%s", cmp.Diff(got, want))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", got)
+	}
+	if got := rec.Body.String(); !strings.Contains(got, "test_total 1\n") {
+		t.Errorf("body = %q, want it to contain test_total 1", got)
+	}
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test.", "method")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Inc() with too few label values did not panic")
+		}
+	}()
+	c.Inc()
+}
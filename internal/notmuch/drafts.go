@@ -0,0 +1,105 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notmuch
+
+// This file keeps the local copies of GMail drafts.  They live in a
+// maildir folder apart from the messages, one file per draft named by
+// its draft ID, which GMail keeps across updates.
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/message"
+)
+
+// DraftsFolder is the maildir folder holding drafts, relative to the
+// notmuch database path, so the query "folder:gotmuch-drafts" finds
+// them.
+const DraftsFolder = "gotmuch-drafts"
+
+// The maildir info of draft files.  The D flag has notmuch tag them
+// "draft", and S keeps them from being "unread", as long as
+// maildir.synchronize_flags is set, as it is by default.
+const draftInfo = ":2,DS"
+
+// draftPath returns the path of the file holding a draft.
+func (s *Service) draftPath(draftID string) string {
+	return filepath.Join(s.drafts, "cur", escape(draftID)+draftInfo)
+}
+
+// DraftID returns the ID of the draft in a file written by this
+// Service, and false for any other file.
+func (s *Service) DraftID(path string) (string, bool) {
+	if filepath.Dir(path) != filepath.Join(s.drafts, "cur") {
+		return "", false
+	}
+	name, ok := strings.CutSuffix(filepath.Base(path), draftInfo)
+	if !ok {
+		return "", false
+	}
+	return unescape(name)
+}
+
+// CreateDraft returns a Writer for the file holding a draft, as Create
+// does for messages.  Drafts are written as they are, but for line
+// endings, since they are uploaded again when edited.
+func (s *Service) CreateDraft(draftID string) (*Writer, error) {
+	if draftID == "" {
+		return nil, errors.New("draft has no ID")
+	}
+	return newWriter(draftID, s.draftPath(draftID), nil)
+}
+
+// OpenDraft opens the file holding a draft for reading.
+func (s *Service) OpenDraft(draftID string) (*os.File, error) {
+	return os.Open(s.draftPath(draftID))
+}
+
+// DraftDigest returns the Digest of the file holding a draft.
+func (s *Service) DraftDigest(draftID string) (message.Digest, error) {
+	b, err := os.ReadFile(s.draftPath(draftID))
+	if err != nil {
+		return message.Digest{}, err
+	}
+	return message.DigestOf(b), nil
+}
+
+// RemoveDraft deletes the file holding a draft, if any.
+func (s *Service) RemoveDraft(ctx context.Context, draftID string) error {
+	path := s.draftPath(draftID)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	slog.DebugContext(ctx, "removed draft file", "draft_id", draftID, "path", path)
+	return nil
+}
+
+// mkmaildir creates a maildir folder, if it does not exist.
+func mkmaildir(path string) error {
+	if err := mkdir(path); err != nil {
+		return err
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := mkdir(filepath.Join(path, sub)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
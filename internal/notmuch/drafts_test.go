@@ -0,0 +1,85 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notmuch
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/message"
+)
+
+func TestDrafts(t *testing.T) {
+	tmp := tmpdir(t)
+	defer cleanup(t, tmp)
+	ctx := context.Background()
+	s := &Service{path: filepath.Join(tmp, "gotmuch"), drafts: filepath.Join(tmp, DraftsFolder)}
+	if err := mkmaildir(s.drafts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Draft IDs are escaped, and drafts are not normalized.
+	const id = "r-123"
+	w, err := s.CreateDraft(id)
+	if err != nil {
+		t.Fatalf("CreateDraft() error: %v", err)
+	}
+	io.WriteString(w, "From mbox-like\r\nSubject: draft\r\n\r\nbody")
+	digest, err := w.Commit(ctx)
+	if err != nil {
+		t.Fatalf("Commit() error: %v", err)
+	}
+	const want = "From mbox-like\nSubject: draft\n\nbody\n"
+	if d := message.DigestOf([]byte(want)); digest != d {
+		t.Errorf("Commit() = %+v, want %+v", digest, d)
+	}
+
+	path := filepath.Join(s.drafts, "cur", "r=2D123:2,DS")
+	b, err := os.ReadFile(path)
+	if err != nil || string(b) != want {
+		t.Errorf("ReadFile(%q) = %q, %v, want %q", path, b, err, want)
+	}
+	if got, ok := s.DraftID(path); !ok || got != id {
+		t.Errorf("DraftID(%q) = %q, %v, want %q, true", path, got, ok, id)
+	}
+	if !s.Owns(path) || !s.Owns(s.makePath("m1").Join()) {
+		t.Errorf("Owns() = false for a draft or message file")
+	}
+	for _, other := range []string{
+		filepath.Join(s.drafts, "new", "r=2D123:2,DS"),
+		filepath.Join(tmp, "drafts", "cur", "r=2D123:2,DS"),
+		filepath.Join(s.drafts, "cur", "r1:2,S"),
+	} {
+		if _, ok := s.DraftID(other); ok || s.Owns(other) {
+			t.Errorf("DraftID(%q) or Owns() = true, want false", other)
+		}
+	}
+	if got, err := s.DraftDigest(id); err != nil || got != digest {
+		t.Errorf("DraftDigest() = %+v, %v, want %+v", got, err, digest)
+	}
+
+	if err := s.RemoveDraft(ctx, id); err != nil {
+		t.Fatalf("RemoveDraft() error: %v", err)
+	}
+	if _, err := s.OpenDraft(id); !os.IsNotExist(err) {
+		t.Errorf("OpenDraft() after RemoveDraft() error = %v, want not exist", err)
+	}
+	if err := s.RemoveDraft(ctx, id); err != nil {
+		t.Errorf("RemoveDraft() of a missing draft error: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notmuch
+
+// This file implements the normalization of messages as they are
+// written, fixing problems that trip up notmuch.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/metrics"
+)
+
+var normalizations = metrics.NewCounter("gotmuch_normalizations_total",
+	"Changes made to messages as they are written, by check.", "check")
+
+// A Check inspects the header section of a message and fixes what it
+// finds wrong.
+type Check struct {
+	// Name identifies the check in logs and metrics.
+	Name string
+
+	// Fix returns the header section of the message with the given
+	// ID, changed if need be, and reports whether it changed.  The
+	// header section is in LF form, and holds whole lines without
+	// the blank line that ends it.  Fix may modify it in place.
+	Fix func(id string, header []byte) ([]byte, bool)
+}
+
+// DefaultChecks are the checks applied by the Service returned by New,
+// in order.
+var DefaultChecks = []Check{
+	{"mbox-from", stripMboxFrom},
+	{"header-folding", fixFolding},
+	{"message-id", addMessageID},
+}
+
+// The name under which messages given a trailing newline are logged
+// and counted.  This is not a Check since it applies to the body.
+const trailingNewline = "trailing-newline"
+
+// Header sections are buffered to be checked, up to this size.  Larger
+// ones are written unchecked.
+const maxHeaderSize = 1 << 20
+
+// normalizer is an io.WriteCloser that applies checks to the header
+// section of the LF form message written to it, and ends the message
+// with a newline, before writing it to w.
+type normalizer struct {
+	id     string
+	checks []Check
+	w      io.Writer
+
+	buf   []byte // The start of the message, until done.
+	done  bool   // Set once the header section is checked.
+	last  byte   // The last byte written to w.
+	fixed []string
+}
+
+func (n *normalizer) Write(p []byte) (int, error) {
+	if n.done {
+		return len(p), n.write(p)
+	}
+	n.buf = append(n.buf, p...)
+	switch i := headerEnd(n.buf); {
+	case i > maxHeaderSize || i < 0 && len(n.buf) > maxHeaderSize:
+		return len(p), n.flush(-1)
+	case i >= 0:
+		return len(p), n.flush(i)
+	}
+	return len(p), nil
+}
+
+// Close writes what remains of the message, ending it with a newline.
+// It does not close w.
+func (n *normalizer) Close() error {
+	if !n.done && len(n.buf) > 0 {
+		// The message is all header section.
+		if n.buf[len(n.buf)-1] != '\n' {
+			n.buf = append(n.buf, '\n')
+			n.fixed = append(n.fixed, trailingNewline)
+		}
+		if err := n.flush(len(n.buf)); err != nil {
+			return err
+		}
+	}
+	if n.last != 0 && n.last != '\n' {
+		n.fixed = append(n.fixed, trailingNewline)
+		return n.write([]byte{'\n'})
+	}
+	return nil
+}
+
+// headerEnd returns the length of the header section at the start of
+// buf, excluding the blank line that ends it, or -1 if buf does not
+// hold all of it.
+func headerEnd(buf []byte) int {
+	if len(buf) > 0 && buf[0] == '\n' {
+		return 0
+	}
+	if i := bytes.Index(buf, []byte("\n\n")); i >= 0 {
+		return i + 1
+	}
+	return -1
+}
+
+// flush writes the buffered start of the message, applying the checks
+// to its first hlen bytes unless hlen is negative.
+func (n *normalizer) flush(hlen int) error {
+	buf := n.buf
+	n.buf, n.done = nil, true
+	if hlen >= 0 {
+		header := buf[:hlen:hlen]
+		for _, c := range n.checks {
+			if fixed, ok := c.Fix(n.id, header); ok {
+				header = fixed
+				n.fixed = append(n.fixed, c.Name)
+			}
+		}
+		if err := n.write(header); err != nil {
+			return err
+		}
+		buf = buf[hlen:]
+	}
+	return n.write(buf)
+}
+
+func (n *normalizer) write(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	n.last = p[len(p)-1]
+	_, err := n.w.Write(p)
+	return err
+}
+
+// report logs and counts the changes made.
+func (n *normalizer) report(ctx context.Context) {
+	for _, name := range n.fixed {
+		normalizations.Inc(name)
+		slog.InfoContext(ctx, "normalized message", "message_id", n.id, "check", name)
+	}
+}
+
+// lines returns the lines of header, each with its newline.
+func lines(header []byte) [][]byte {
+	l := bytes.SplitAfter(header, []byte("\n"))
+	if len(l[len(l)-1]) == 0 {
+		l = l[:len(l)-1]
+	}
+	return l
+}
+
+// fieldName returns the name of the header field starting on line, or
+// nil if line does not start one.
+func fieldName(line []byte) []byte {
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 {
+		return nil
+	}
+	for _, c := range line[:i] {
+		if c < 33 || c > 126 {
+			return nil
+		}
+	}
+	return line[:i]
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// stripMboxFrom removes the "From " line that starts messages taken
+// from mbox files.
+func stripMboxFrom(id string, header []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(header, []byte("From ")) {
+		return header, false
+	}
+	return header[bytes.IndexByte(header, '\n')+1:], true
+}
+
+// fixFolding turns lines that neither start a field nor continue one,
+// usually long lines broken by a sender, into continuation lines.
+func fixFolding(id string, header []byte) ([]byte, bool) {
+	var out bytes.Buffer
+	changed := false
+	for i, line := range lines(header) {
+		if i > 0 && !isSpace(line[0]) && fieldName(line) == nil {
+			out.WriteByte(' ')
+			changed = true
+		}
+		out.Write(line)
+	}
+	if !changed {
+		return header, false
+	}
+	return out.Bytes(), true
+}
+
+// syntheticMessageID returns the Message-ID given to the message with
+// the given ID if it has none.  It is stable, so the message keeps its
+// notmuch ID when stored again, and unique, so notmuch does not take
+// unrelated messages for copies of one another.
+func syntheticMessageID(id string) string {
+	return fmt.Sprintf("gmail-%s@gotmuch.invalid", id)
+}
+
+// addMessageID gives messages without a usable Message-ID field a
+// synthetic one, replacing any empty fields.
+func addMessageID(id string, header []byte) ([]byte, bool) {
+	if messageID(strings.NewReader(string(header)+"\n")) != "" {
+		return header, false
+	}
+	var out bytes.Buffer
+	dropping := false
+	for _, line := range lines(header) {
+		if dropping && isSpace(line[0]) {
+			continue
+		}
+		name := fieldName(line)
+		dropping = name != nil && bytes.EqualFold(name, []byte("Message-ID"))
+		if !dropping {
+			out.Write(line)
+		}
+	}
+	fmt.Fprintf(&out, "Message-ID: <%s>\n", syntheticMessageID(id))
+	return out.Bytes(), true
+}
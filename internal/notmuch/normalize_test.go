@@ -0,0 +1,113 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notmuch
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	const mid = "Message-ID: <a@b>\n"
+	cases := []struct {
+		name, in, want string
+		fixed          []string
+	}{
+		{
+			name: "clean",
+			in:   mid + "Subject: hi\n\nbody\n",
+			want: mid + "Subject: hi\n\nbody\n",
+		},
+		{
+			name:  "no trailing newline",
+			in:    mid + "\nbody",
+			want:  mid + "\nbody\n",
+			fixed: []string{trailingNewline},
+		},
+		{
+			name:  "header only",
+			in:    mid + "Subject: hi",
+			want:  mid + "Subject: hi\n",
+			fixed: []string{trailingNewline},
+		},
+		{
+			name:  "mbox",
+			in:    "From alice@example.com Mon Jan  1 00:00:00 2019\n" + mid + "\nbody\n",
+			want:  mid + "\nbody\n",
+			fixed: []string{"mbox-from"},
+		},
+		{
+			name:  "folding",
+			in:    mid + "Subject: a long\nsubject broken\n\tcontinued\nTo: bob\n\nbody\nnot: a header\n",
+			want:  mid + "Subject: a long\n subject broken\n\tcontinued\nTo: bob\n\nbody\nnot: a header\n",
+			fixed: []string{"header-folding"},
+		},
+		{
+			name:  "no message id",
+			in:    "Subject: hi\n\nbody\n",
+			want:  "Subject: hi\nMessage-ID: <gmail-m1@gotmuch.invalid>\n\nbody\n",
+			fixed: []string{"message-id"},
+		},
+		{
+			name:  "empty message id",
+			in:    "Message-Id:\n  \nSubject: hi\n\nbody\n",
+			want:  "Subject: hi\nMessage-ID: <gmail-m1@gotmuch.invalid>\n\nbody\n",
+			fixed: []string{"message-id"},
+		},
+		{
+			name:  "no header section",
+			in:    "\nbody",
+			want:  "Message-ID: <gmail-m1@gotmuch.invalid>\n\nbody\n",
+			fixed: []string{"message-id", trailingNewline},
+		},
+	}
+	for _, tc := range cases {
+		// Write a byte at a time, so the header section arrives
+		// in pieces.
+		var out bytes.Buffer
+		n := &normalizer{id: "m1", checks: DefaultChecks, w: &out}
+		for i := 0; i < len(tc.in); i++ {
+			if _, err := n.Write([]byte{tc.in[i]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := n.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tc.want {
+			t.Errorf("%s: wrote %q, want %q", tc.name, out.String(), tc.want)
+		}
+		if !reflect.DeepEqual(n.fixed, tc.fixed) {
+			t.Errorf("%s: fixed %q, want %q", tc.name, n.fixed, tc.fixed)
+		}
+	}
+}
+
+func TestNormalizeLongHeader(t *testing.T) {
+	in := "X-Long: " + strings.Repeat("x", maxHeaderSize) + "\n\nbody\n"
+	var out bytes.Buffer
+	n := &normalizer{id: "m1", checks: DefaultChecks, w: &out}
+	if _, err := n.Write([]byte(in)); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != in || len(n.fixed) != 0 {
+		t.Errorf("a long header section was changed: %q", n.fixed)
+	}
+}
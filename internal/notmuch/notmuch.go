@@ -15,13 +15,21 @@
 package notmuch
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"hash/fnv"
-	"io/ioutil"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/mail"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/matta/gotmuch/internal/message"
@@ -39,6 +47,13 @@ type Service struct {
 	// notmuch database.  Equivalent to; `notmuch config get
 	// database.path` and appending the subdir.
 	path string
+
+	// Path to the maildir folder holding the local copies of GMail
+	// drafts.
+	drafts string
+
+	// The checks applied to messages as they are written.
+	checks []Check
 }
 
 type path struct {
@@ -61,15 +76,21 @@ func New() (*Service, error) {
 	if err != nil {
 		return nil, err
 	}
-	s := &Service{}
+	s := &Service{checks: DefaultChecks}
 	// TODO: make "gotmuch" configurable.
 	// TODO: include the scope (login) in the base path here.
-	s.path = filepath.Join(strings.TrimSpace(string(out)), "gotmuch")
+	root := strings.TrimSpace(string(out))
+	s.path = filepath.Join(root, "gotmuch")
+	s.drafts = filepath.Join(root, DraftsFolder)
 
 	err = mkdirfarm(s.path, 2)
 	if err != nil {
 		return nil, err
 	}
+	if err := mkmaildir(s.drafts); err != nil {
+		return nil, err
+	}
+	slog.Debug("using notmuch message directory", "path", s.path)
 	return s, nil
 }
 
@@ -78,27 +99,381 @@ func (s *Service) HaveMessage(id string) bool {
 	return err == nil
 }
 
-func (s *Service) Insert(ctx context.Context, msg *message.Body) error {
-	if msg.PermID == "" {
-		return errors.New("message has no ID")
-	}
+// Insert writes msg to its file, replacing any existing copy, and
+// returns the Digest of what was written.
+func (s *Service) Insert(ctx context.Context, msg *message.Body) (message.Digest, error) {
 	if msg.Raw == "" {
-		return errors.New("message has no content")
+		return message.Digest{}, errors.New("message has no content")
 	}
-	path := s.makePath(msg.PermID)
+	w, err := s.Create(msg.PermID)
+	if err != nil {
+		return message.Digest{}, err
+	}
+	if _, err := io.WriteString(w, msg.Raw); err != nil {
+		w.Abort()
+		return message.Digest{}, err
+	}
+	return w.Commit(ctx)
+}
 
-	// Replace all \r\n with \n.  The GMail API delivers messages
-	// in this form because it is mandated by RFC 822 and
-	// successors.
-	//
-	// TODO: sanitize further?  Look for expected headers.  Ensure
-	// trailing newline.
-	//
-	// TODO: this can be optimized.
-	// E.g. https://godoc.org/golang.org/x/text/transform#SpanningTransformer
-	// or the equivalent hand rolled.
-	raw := strings.ReplaceAll(msg.Raw, "\r\n", "\n")
-	return ioutil.WriteFile(path.Join(), []byte(raw), messageFileMode)
+// Remove deletes the file holding a message, if any.  The message
+// leaves the notmuch index at the next "notmuch new".
+func (s *Service) Remove(ctx context.Context, id string) error {
+	path := s.makePath(id).Join()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	slog.DebugContext(ctx, "removed message file", "message_id", id, "path", path)
+	return nil
+}
+
+// Problems found by Check.
+var (
+	ErrMissing = errors.New("message file is missing")
+	ErrEmpty   = errors.New("message file is empty")
+)
+
+// Check returns an error describing what is wrong with the file holding
+// a message, or nil if it looks intact.  The file must exist, be
+// non-empty, and have a header section that parses as RFC 5322 and
+// ends with a blank line, as all messages from GMail do.
+func (s *Service) Check(id string) error {
+	b, err := os.ReadFile(s.makePath(id).Join())
+	if os.IsNotExist(err) {
+		return ErrMissing
+	}
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return ErrEmpty
+	}
+	if _, err := mail.ReadMessage(bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("message file does not parse: %w", err)
+	}
+	if !bytes.HasPrefix(b, []byte("\n")) && !bytes.Contains(b, []byte("\n\n")) {
+		return errors.New("message file has no end of header section; truncated?")
+	}
+	return nil
+}
+
+// Digest returns the Digest of the file holding a message.
+func (s *Service) Digest(id string) (message.Digest, error) {
+	b, err := os.ReadFile(s.makePath(id).Join())
+	if err != nil {
+		return message.Digest{}, err
+	}
+	return message.DigestOf(b), nil
+}
+
+// Open opens the file holding a message for reading.
+func (s *Service) Open(id string) (*os.File, error) {
+	return os.Open(s.makePath(id).Join())
+}
+
+// MessageID returns the Message-ID of the message in the file holding
+// a message, without angle brackets, or "" if it has none.  notmuch
+// merges messages with the same Message-ID.
+func (s *Service) MessageID(id string) (string, error) {
+	f, err := os.Open(s.makePath(id).Join())
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	m, err := mail.ReadMessage(bufio.NewReader(f))
+	if err != nil {
+		return "", nil
+	}
+	return trimMessageID(m.Header.Get("Message-ID")), nil
+}
+
+// Walk calls fn for every file in the directory farm written to by this
+// Service.  For files not named by this Service, id is "".
+func (s *Service) Walk(fn func(id, path string) error) error {
+	return filepath.WalkDir(s.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		id, _ := s.permID(path)
+		return fn(id, path)
+	})
+}
+
+// Update writes msg like Insert, replacing any existing copy, and
+// updates the notmuch index to match.  A replaced message keeps its
+// tags.
+func (s *Service) Update(ctx context.Context, msg *message.Body) (message.Digest, error) {
+	existed := s.HaveMessage(msg.PermID)
+	digest, err := s.Insert(ctx, msg)
+	if err != nil {
+		return digest, err
+	}
+	return digest, s.Index(ctx, msg.PermID, existed)
+}
+
+// Index updates the notmuch index to match the file just written for a
+// message, by Insert or a Writer.  If existed is set, the file replaced
+// an earlier copy, whose tags are kept.
+func (s *Service) Index(ctx context.Context, id string, existed bool) error {
+	mid, err := s.MessageID(id)
+	if err != nil {
+		return err
+	}
+	if !existed || mid == "" {
+		// Without a Message-ID the notmuch ID is derived from the
+		// file content, so a replaced copy is indexed as new.
+		return s.run(ctx, "new", "--no-hooks")
+	}
+	return s.run(ctx, "reindex", "id:"+quote(mid))
+}
+
+// Search returns the IDs of the messages written by this Service that
+// match a notmuch query.
+func (s *Service) Search(ctx context.Context, query string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "notmuch", "search", "--output=files", query).Output()
+	if err != nil {
+		return nil, fmt.Errorf("notmuch search %q: %w", query, err)
+	}
+	var ids []string
+	for _, path := range strings.Split(string(out), "\n") {
+		if id, ok := s.permID(path); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// permID returns the ID of the message in a file written by this
+// Service, and false for any other file.
+func (s *Service) permID(path string) (string, bool) {
+	if !strings.HasPrefix(path, s.path+string(filepath.Separator)) {
+		return "", false
+	}
+	b, ok := decode(filepath.Base(path))
+	return b.permID, ok
+}
+
+// Thread describes a notmuch thread.
+type Thread struct {
+	// The Message-ID of the first message in the thread, so
+	// "thread:{id:MessageID}" finds the thread.
+	MessageID string
+
+	// The IDs of the thread's messages written by this Service.
+	PermIDs []string
+}
+
+// Threads returns the notmuch threads of the messages written by this
+// Service that match a notmuch query, or all of them if query is
+// empty.
+func (s *Service) Threads(ctx context.Context, query string) ([]Thread, error) {
+	q := "path:" + filepath.Base(s.path) + "/**"
+	if query != "" {
+		q = "(" + q + ") and (" + query + ")"
+	}
+	out, err := exec.CommandContext(ctx, "notmuch", "show", "--format=json",
+		"--body=false", "--entire-thread=false", q).Output()
+	if err != nil {
+		return nil, fmt.Errorf("notmuch show %q: %w", q, err)
+	}
+	return s.parseThreads(out)
+}
+
+// showMessage holds the fields used from a message in the output of
+// "notmuch show --format=json".
+type showMessage struct {
+	ID string `json:"id"`
+
+	// A string in older versions of notmuch, and a list of strings
+	// in newer ones.
+	Filename json.RawMessage `json:"filename"`
+
+	Tags []string `json:"tags"`
+}
+
+func (m *showMessage) filenames() []string {
+	var names []string
+	if json.Unmarshal(m.Filename, &names) == nil {
+		return names
+	}
+	var name string
+	if json.Unmarshal(m.Filename, &name) == nil {
+		return []string{name}
+	}
+	return nil
+}
+
+// parseThreads parses the output of "notmuch show --format=json" into
+// Threads.
+func (s *Service) parseThreads(out []byte) ([]Thread, error) {
+	var result []Thread
+	t, last := Thread{}, -1
+	err := walkShow(out, func(thread int, msg *showMessage) {
+		if thread != last {
+			if len(t.PermIDs) > 0 {
+				result = append(result, t)
+			}
+			t, last = Thread{}, thread
+		}
+		if t.MessageID == "" {
+			t.MessageID = msg.ID
+		}
+		for _, name := range msg.filenames() {
+			if id, ok := s.permID(name); ok {
+				t.PermIDs = append(t.PermIDs, id)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(t.PermIDs) > 0 {
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// walkShow calls fn for each message in the output of "notmuch show
+// --format=json", with the index of its thread.  The output is a list
+// of threads, each a list of nodes, each node a pair of a message (null
+// if it did not match) and a list of reply nodes.
+func walkShow(out []byte, fn func(thread int, msg *showMessage)) error {
+	var threads [][]json.RawMessage
+	if err := json.Unmarshal(out, &threads); err != nil {
+		return fmt.Errorf("parsing notmuch show output: %w", err)
+	}
+	for i, nodes := range threads {
+		var walk func(nodes []json.RawMessage) error
+		walk = func(nodes []json.RawMessage) error {
+			for _, node := range nodes {
+				var pair []json.RawMessage
+				if err := json.Unmarshal(node, &pair); err != nil || len(pair) != 2 {
+					return fmt.Errorf("parsing notmuch show output: bad thread node %s", node)
+				}
+				var msg *showMessage
+				if err := json.Unmarshal(pair[0], &msg); err != nil {
+					return fmt.Errorf("parsing notmuch show output: %w", err)
+				}
+				if msg != nil {
+					fn(i, msg)
+				}
+				var replies []json.RawMessage
+				if err := json.Unmarshal(pair[1], &replies); err != nil {
+					return fmt.Errorf("parsing notmuch show output: %w", err)
+				}
+				if err := walk(replies); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := walk(nodes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LocalMessage describes a message notmuch indexes only from files not
+// written by this Service, such as mail that did not come from GMail.
+type LocalMessage struct {
+	// The Message-ID, as notmuch knows it.
+	MessageID string
+
+	// The file holding the message, the first if there are several.
+	Path string
+
+	Tags []string
+}
+
+// LocalMessages returns the messages matching a notmuch query that
+// have no file written by this Service, including draft files.
+func (s *Service) LocalMessages(ctx context.Context, query string) ([]LocalMessage, error) {
+	out, err := exec.CommandContext(ctx, "notmuch", "show", "--format=json",
+		"--body=false", "--entire-thread=false", query).Output()
+	if err != nil {
+		return nil, fmt.Errorf("notmuch show %q: %w", query, err)
+	}
+	return s.parseLocal(out)
+}
+
+// parseLocal parses the output of "notmuch show --format=json" into
+// LocalMessages.
+func (s *Service) parseLocal(out []byte) ([]LocalMessage, error) {
+	var result []LocalMessage
+	err := walkShow(out, func(_ int, msg *showMessage) {
+		names := msg.filenames()
+		for _, name := range names {
+			if s.Owns(name) {
+				return
+			}
+		}
+		if len(names) > 0 {
+			result = append(result, LocalMessage{MessageID: msg.ID, Path: names[0], Tags: msg.Tags})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Files returns the paths of the files of the messages matching a
+// notmuch query.
+func (s *Service) Files(ctx context.Context, query string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "notmuch", "search", "--output=files", query).Output()
+	if err != nil {
+		return nil, fmt.Errorf("notmuch search %q: %w", query, err)
+	}
+	var paths []string
+	for _, path := range strings.Split(string(out), "\n") {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// Owns reports whether the file at path was written by this Service,
+// as a message or a draft.
+func (s *Service) Owns(path string) bool {
+	if _, ok := s.permID(path); ok {
+		return true
+	}
+	_, ok := s.DraftID(path)
+	return ok
+}
+
+// run runs a notmuch command.
+func (s *Service) run(ctx context.Context, args ...string) error {
+	slog.DebugContext(ctx, "running notmuch", "args", args)
+	out, err := exec.CommandContext(ctx, "notmuch", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("notmuch %s: %w: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// messageID returns the Message-ID of the message read from r, without
+// angle brackets, or "" if it has none.
+func messageID(r io.Reader) string {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return ""
+	}
+	return trimMessageID(m.Header.Get("Message-ID"))
+}
+
+// trimMessageID returns the value of a Message-ID field without angle
+// brackets.
+func trimMessageID(v string) string {
+	id := strings.TrimSpace(v)
+	return strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+}
+
+// quote returns s quoted as a notmuch query term.
+func quote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
 }
 
 // basename holds the fields encoded into the basename portion of the
@@ -186,6 +561,49 @@ func (b basename) encode() string {
 	return sb.String()
 }
 
+// decode returns the basename encoded in a file name, and false if the
+// file name was not produced by encode.
+func decode(name string) (basename, bool) {
+	const prefix = "gotmuch-1-"
+	if !strings.HasPrefix(name, prefix) {
+		return basename{}, false
+	}
+	parts := strings.Split(strings.TrimPrefix(name, prefix), "-")
+	if len(parts) != 2 {
+		return basename{}, false
+	}
+	scope, ok1 := unescape(parts[0])
+	permID, ok2 := unescape(parts[1])
+	if !ok1 || !ok2 {
+		return basename{}, false
+	}
+	return basename{scope: scope, permID: permID}, true
+}
+
+// unescape reverses escape.
+func unescape(s string) (string, bool) {
+	if !strings.Contains(s, "=") {
+		return s, true
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", false
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		sb.WriteByte(byte(b))
+		i += 2
+	}
+	return sb.String(), true
+}
+
 func mkdir(dir string) error {
 	if err := os.Mkdir(dir, dirFileMode); err != nil && !os.IsExist(err) {
 		return err
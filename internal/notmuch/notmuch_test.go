@@ -15,11 +15,16 @@
 package notmuch
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/matta/gotmuch/internal/message"
 )
 
 func tmpdir(t *testing.T) string {
@@ -65,6 +70,43 @@ func TestBasenameEncode(t *testing.T) {
 		if got := tc.name.encode(); got != tc.want {
 			t.Errorf("%#v.encode() = %#v, want %#v", tc.name, got, tc.want)
 		}
+		if got, ok := decode(tc.want); !ok || got != tc.name {
+			t.Errorf("decode(%#v) = %#v, %v, want %#v, true", tc.want, got, ok, tc.name)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, name := range []string{
+		"1554400000.M1P2.host:2,S",
+		"gotmuch-2-scope-permId",
+		"gotmuch-1-scope",
+		"gotmuch-1-a-b-c",
+		"gotmuch-1-scope-=0",
+		"gotmuch-1-scope-=ZZ",
+	} {
+		if got, ok := decode(name); ok {
+			t.Errorf("decode(%#v) = %#v, true, want false", name, got)
+		}
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	cases := []struct {
+		raw, want string
+	}{
+		{"Message-ID: <a@b>\r\nSubject: x\r\n\r\nbody\r\n", "a@b"},
+		{"Message-Id:  <a@b> \n\n", "a@b"},
+		{"Subject: x\r\n\r\n", ""},
+		{"not a message", ""},
+	}
+	for _, tc := range cases {
+		if got := messageID(strings.NewReader(tc.raw)); got != tc.want {
+			t.Errorf("messageID(%q) = %q, want %q", tc.raw, got, tc.want)
+		}
+	}
+	if got, want := quote(`a"b@c`), `"a""b@c"`; got != want {
+		t.Errorf("quote() = %s, want %s", got, want)
 	}
 }
 
@@ -89,3 +131,151 @@ func TestMkDirFarm(t *testing.T) {
 		}
 	}
 }
+
+func TestInsertRemove(t *testing.T) {
+	tmp := tmpdir(t)
+	defer cleanup(t, tmp)
+	if err := mkdirfarm(tmp, 2); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	s := &Service{path: tmp}
+	msg := &message.Body{
+		Header: message.Header{ID: message.ID{PermID: "m1"}},
+		Raw:    "Subject: hi\r\n\r\nbody\r\n",
+	}
+	digest, err := s.Insert(ctx, msg)
+	if err != nil {
+		t.Fatalf("Insert() error: %v", err)
+	}
+	if want := message.DigestOf([]byte("Subject: hi\n\nbody\n")); digest != want {
+		t.Errorf("Insert() = %+v, want the digest of the normalized message %+v", digest, want)
+	}
+	if !s.HaveMessage("m1") {
+		t.Errorf("HaveMessage() = false after Insert()")
+	}
+	if got, err := s.Digest("m1"); err != nil || got != digest {
+		t.Errorf("Digest() = %+v, %v, want %+v, nil", got, err, digest)
+	}
+	if got, err := s.MessageID("m1"); err != nil || got != "" {
+		t.Errorf("MessageID() = %q, %v, want \"\", nil", got, err)
+	}
+	if _, err := s.Insert(ctx, &message.Body{
+		Header: message.Header{ID: message.ID{PermID: "m1"}},
+		Raw:    "Message-ID: <a@b>\r\n\r\nbody\r\n",
+	}); err != nil {
+		t.Fatalf("Insert() error: %v", err)
+	}
+	if got, err := s.MessageID("m1"); err != nil || got != "a@b" {
+		t.Errorf("MessageID() = %q, %v, want \"a@b\", nil", got, err)
+	}
+	for i := 0; i < 2; i++ { // Removing a missing message is not an error.
+		if err := s.Remove(ctx, "m1"); err != nil {
+			t.Fatalf("Remove() error: %v", err)
+		}
+	}
+	if s.HaveMessage("m1") {
+		t.Errorf("HaveMessage() = true after Remove()")
+	}
+}
+
+func TestParseThreads(t *testing.T) {
+	s := &Service{path: "/mail/gotmuch"}
+	file := func(id string) string {
+		return s.makePath(id).Join()
+	}
+	// Two threads: the first with a reply and a non-matching
+	// message, the second holding a message not written by gotmuch.
+	out := fmt.Sprintf(`[
+ [[{"id": "a@x", "filename": [%q]},
+   [[null, [[{"id": "b@x", "filename": [%q, "/mail/other/cur/b"]}, []]]]]]],
+ [[{"id": "c@x", "filename": "/mail/other/cur/c"}, []],
+  [{"id": "d@x", "filename": %q}, []]],
+ [[{"id": "e@x", "filename": "/mail/other/cur/e"}, []]]
+]`, file("m1"), file("m2"), file("m4"))
+	got, err := s.parseThreads([]byte(out))
+	if err != nil {
+		t.Fatalf("parseThreads() error: %v", err)
+	}
+	want := []Thread{
+		{MessageID: "a@x", PermIDs: []string{"m1", "m2"}},
+		{MessageID: "c@x", PermIDs: []string{"m4"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseThreads() = %+v, want %+v", got, want)
+	}
+	if _, err := s.parseThreads([]byte(`[[["not a pair"]]]`)); err == nil {
+		t.Errorf("parseThreads() of bad input succeeded, want an error")
+	}
+}
+
+func TestCheckWalk(t *testing.T) {
+	tmp := tmpdir(t)
+	defer cleanup(t, tmp)
+	if err := mkdirfarm(tmp, 2); err != nil {
+		t.Fatal(err)
+	}
+	s := &Service{path: tmp}
+	for id, content := range map[string]string{
+		"ok":        "Subject: hi\n\nbody\n",
+		"empty":     "",
+		"truncated": "Subject: hi\nFrom: a",
+		"garbage":   "\x00\x01 not a header\n\n",
+	} {
+		if err := ioutil.WriteFile(s.makePath(id).Join(), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stray := filepath.Join(tmp, "a", "b", "stray")
+	if err := ioutil.WriteFile(stray, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]error{"ok": nil, "empty": ErrEmpty, "missing": ErrMissing} {
+		if got := s.Check(id); got != want {
+			t.Errorf("Check(%q) = %v, want %v", id, got, want)
+		}
+	}
+	for _, id := range []string{"truncated", "garbage"} {
+		if err := s.Check(id); err == nil || err == ErrEmpty || err == ErrMissing {
+			t.Errorf("Check(%q) = %v, want a parse error", id, err)
+		}
+	}
+
+	got := map[string]string{}
+	err := s.Walk(func(id, path string) error {
+		got[path] = id
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() error: %v", err)
+	}
+	want := map[string]string{stray: ""}
+	for _, id := range []string{"ok", "empty", "truncated", "garbage"} {
+		want[s.makePath(id).Join()] = id
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk() = %v, want %v", got, want)
+	}
+}
+
+func TestParseLocal(t *testing.T) {
+	s := &Service{path: "/mail/gotmuch", drafts: "/mail/gotmuch-drafts"}
+	out := fmt.Sprintf(`[
+ [[{"id": "a@x", "filename": [%q, "/mail/other/cur/a"], "tags": ["inbox"]},
+   [[{"id": "b@x", "filename": ["/mail/other/cur/b", "/mail/other/cur/b2"], "tags": ["inbox", "unread"]}, []]]]],
+ [[{"id": "c@x", "filename": "/mail/other/cur/c", "tags": []}, []]],
+ [[{"id": "d@x", "filename": [%q], "tags": ["draft"]}, []]]
+]`, s.makePath("m1").Join(), s.draftPath("r1"))
+	got, err := s.parseLocal([]byte(out))
+	if err != nil {
+		t.Fatalf("parseLocal() error: %v", err)
+	}
+	want := []LocalMessage{
+		{MessageID: "b@x", Path: "/mail/other/cur/b", Tags: []string{"inbox", "unread"}},
+		{MessageID: "c@x", Path: "/mail/other/cur/c", Tags: []string{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLocal() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notmuch
+
+// This file implements writing message files as a stream, so messages
+// need not be held in memory.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"golang.org/x/text/transform"
+)
+
+// The prefix of temporary files.  decode rejects it, so leftovers are
+// not mistaken for messages.
+const tempPrefix = ".gotmuch-tmp-"
+
+// lf is a transform.Transformer that replaces each CRLF with LF.  The
+// GMail API delivers messages in CRLF form because it is mandated by
+// RFC 822 and successors.
+type lf struct{ transform.NopResetter }
+
+func (lf) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		i := bytes.IndexByte(src[nSrc:], '\r')
+		if i < 0 {
+			i = len(src) - nSrc
+		}
+		n := copy(dst[nDst:], src[nSrc:nSrc+i])
+		nDst += n
+		nSrc += n
+		if n < i {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		if nSrc == len(src) {
+			break
+		}
+		// src[nSrc] is '\r'.
+		if nSrc+1 == len(src) && !atEOF {
+			return nDst, nSrc, transform.ErrShortSrc
+		}
+		if nSrc+1 < len(src) && src[nSrc+1] == '\n' {
+			nSrc++ // Drop the '\r'.
+			continue
+		}
+		if nDst == len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		dst[nDst] = '\r'
+		nDst++
+		nSrc++
+	}
+	return nDst, nSrc, nil
+}
+
+// A Writer writes a message file.  The file replaces any existing copy
+// of the message only when Commit is called; until then the content is
+// held in a temporary file.
+type Writer struct {
+	id   string
+	path string
+	tmp  *os.File
+	w    io.WriteCloser
+	norm *normalizer
+	hash hash.Hash
+	size int64
+}
+
+// Create returns a Writer for the file holding a message.  Content
+// written to it has each CRLF replaced with LF, and is normalized by
+// the Service's checks.  The caller must call Commit or Abort.
+func (s *Service) Create(id string) (*Writer, error) {
+	if id == "" {
+		return nil, errors.New("message has no ID")
+	}
+	return newWriter(id, s.makePath(id).Join(), s.checks)
+}
+
+// newWriter returns a Writer for the file at path, holding the message
+// with the given ID, normalized by checks.
+func newWriter(id, path string, checks []Check) (*Writer, error) {
+	w := &Writer{id: id, path: path, hash: sha256.New()}
+	var err error
+	if w.tmp, err = w.temp(); err != nil {
+		return nil, err
+	}
+	w.norm = &normalizer{
+		id:     id,
+		checks: checks,
+		w:      io.MultiWriter(w.tmp, w.hash, (*counter)(&w.size)),
+	}
+	w.w = transform.NewWriter(w.norm, lf{})
+	return w, nil
+}
+
+// temp creates a temporary file next to the message file, so it can be
+// renamed into place.
+func (w *Writer) temp() (*os.File, error) {
+	f, err := os.CreateTemp(filepath.Dir(w.path), tempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(messageFileMode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Commit puts the message file in place, with fields added at the
+// start of its header section, and returns the Digest of what was
+// written.
+func (w *Writer) Commit(ctx context.Context, fields ...message.HeaderField) (message.Digest, error) {
+	err := w.w.Close()
+	if err == nil {
+		err = w.norm.Close()
+	}
+	if err == nil && len(fields) > 0 {
+		err = w.prepend(fields)
+	}
+	if err == nil {
+		err = w.tmp.Close()
+	}
+	if err != nil {
+		w.Abort()
+		return message.Digest{}, err
+	}
+	if err := os.Rename(w.tmp.Name(), w.path); err != nil {
+		os.Remove(w.tmp.Name())
+		return message.Digest{}, err
+	}
+	w.norm.report(ctx)
+	slog.DebugContext(ctx, "wrote message file", "message_id", w.id, "path", w.path, "bytes", w.size)
+	return message.Digest{SHA256: hex.EncodeToString(w.hash.Sum(nil)), Size: w.size}, nil
+}
+
+// prepend replaces the temporary file with a copy that starts with
+// fields.
+func (w *Writer) prepend(fields []message.HeaderField) error {
+	old := w.tmp
+	defer os.Remove(old.Name())
+	defer old.Close()
+	if _, err := old.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tmp, err := w.temp()
+	if err != nil {
+		return err
+	}
+	w.tmp = tmp
+	w.hash.Reset()
+	w.size = 0
+	out := io.MultiWriter(tmp, w.hash, (*counter)(&w.size))
+	for _, f := range fields {
+		if _, err := io.WriteString(out, f.Name+": "+f.Value+"\n"); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(out, old)
+	return err
+}
+
+// Abort discards the content written, leaving any existing copy of the
+// message in place.
+func (w *Writer) Abort() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+// counter is an io.Writer that counts the bytes written to it.
+type counter int64
+
+func (c *counter) Write(p []byte) (int, error) {
+	*c += counter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notmuch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"golang.org/x/text/transform"
+)
+
+func TestLF(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"a\r\nb\r\n",
+		"\r\n\r\n",
+		"lone\rcr\r",
+		"\r\r\n\n",
+		strings.Repeat("x\r\n", 5000),
+	} {
+		want := strings.ReplaceAll(in, "\r\n", "\n")
+		if got, _, err := transform.String(lf{}, in); err != nil || got != want {
+			t.Errorf("transform.String(lf, %.20q) = %.20q, %v, want %.20q", in, got, err, want)
+		}
+		// Writing a byte at a time splits every CRLF.
+		var buf bytes.Buffer
+		w := transform.NewWriter(&buf, lf{})
+		for i := 0; i < len(in); i++ {
+			if _, err := w.Write([]byte{in[i]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil || buf.String() != want {
+			t.Errorf("bytewise lf(%.20q) = %.20q, %v, want %.20q", in, buf.String(), err, want)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	tmp := tmpdir(t)
+	defer cleanup(t, tmp)
+	if err := mkdirfarm(tmp, 2); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	s := &Service{path: tmp}
+	read := func() string {
+		b, err := ioutil.ReadFile(s.makePath("m1").Join())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	w, err := s.Create("m1")
+	if err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	io.WriteString(w, "Subject: hi\r")
+	io.WriteString(w, "\n\r\nbody\r\n")
+	digest, err := w.Commit(ctx, message.HeaderField{Name: "X-A", Value: "1"})
+	if err != nil {
+		t.Fatalf("Commit() error: %v", err)
+	}
+	const want = "X-A: 1\nSubject: hi\n\nbody\n"
+	if got := read(); got != want {
+		t.Errorf("Commit() wrote %q, want %q", got, want)
+	}
+	if digest != message.DigestOf([]byte(want)) {
+		t.Errorf("Commit() = %+v, want the digest of %q", digest, want)
+	}
+
+	// An aborted write leaves the committed copy alone.
+	w, err = s.Create("m1")
+	if err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	io.WriteString(w, "partial")
+	w.Abort()
+	if got := read(); got != want {
+		t.Errorf("after Abort() the file holds %q, want %q", got, want)
+	}
+	err = s.Walk(func(id, path string) error {
+		if id != "m1" {
+			t.Errorf("Walk() found stray file %s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkLF(b *testing.B) {
+	for _, size := range []int{1 << 10, 1 << 20, 32 << 20} {
+		line := "0123456789abcdefghijklmnopqrstuvwxyz0123456789abcdefghijklmnopqrstuvwxyz\r\n"
+		in := strings.Repeat(line, size/len(line)+1)[:size]
+		b.Run(fmt.Sprintf("transform/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := transform.NewWriter(io.Discard, lf{})
+				// Hide strings.Reader's WriteTo, which copies
+				// the whole input, to read in chunks as from
+				// the network.
+				r := struct{ io.Reader }{strings.NewReader(in)}
+				if _, err := io.Copy(w, r); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		// The previous approach, for comparison.
+		b.Run(fmt.Sprintf("replace/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				io.WriteString(io.Discard, strings.ReplaceAll(in, "\r\n", "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persist
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/pkg/errors"
+)
+
+// SetDigest records the digest of the file last written for a message.
+// The zero Digest records that no file is stored.
+func (tx *Tx) SetDigest(ctx context.Context, account, permID string, d message.Digest) error {
+	const q = `UPDATE messages SET (content_sha256, content_size) = ($1, $2) WHERE account = $3 AND message_id = $4`
+	var sha, size interface{}
+	if d != (message.Digest{}) {
+		sha, size = d.SHA256, d.Size
+	}
+	return tx.exec(ctx, q, sha, size, account, permID)
+}
+
+// Digest returns the digest of the file last written for a message, or
+// nil if none is recorded.
+func (tx *Tx) Digest(ctx context.Context, account, permID string) (*message.Digest, error) {
+	const q = `
+SELECT content_sha256, content_size FROM messages
+WHERE account == $1 AND message_id == $2 AND content_sha256 IS NOT NULL
+`
+	var d message.Digest
+	err := tx.tx.QueryRowContext(ctx, q, account, permID).Scan(&d.SHA256, &d.Size)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "db scan failed in Digest")
+	}
+	return &d, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persist
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/message"
+)
+
+func testDigest(t *testing.T, mode fixtureMode) {
+	ctx := context.Background()
+	fixture := createDBFixture(ctx, mode, t)
+	defer fixture.CloseOrFatal()
+
+	tx := fixture.BeginOrFatal(ctx)
+	defer tx.Rollback()
+	d := message.DigestOf([]byte("Subject: hi\n\nbody\n"))
+	for _, account := range []string{"a1", "a2"} {
+		for _, id := range []string{"m1", "m2"} {
+			if err := tx.InsertMessageID(ctx, account, message.ID{PermID: id, ThreadID: "t"}); err != nil {
+				t.Fatalf("tx.InsertMessageID() error: %+v", err)
+			}
+		}
+		if err := tx.SetDigest(ctx, account, "m1", d); err != nil {
+			t.Fatalf("tx.SetDigest() error: %+v", err)
+		}
+	}
+
+	if got, err := tx.Digest(ctx, "a1", "m1"); err != nil || got == nil || *got != d {
+		t.Errorf("tx.Digest(m1) = %+v, %v, want %+v", got, err, d)
+	}
+	if got, err := tx.Digest(ctx, "a1", "m2"); err != nil || got != nil {
+		t.Errorf("tx.Digest(m2) = %+v, %v, want nil, nil", got, err)
+	}
+
+	// The zero Digest forgets the file.
+	if err := tx.SetDigest(ctx, "a1", "m1", message.Digest{}); err != nil {
+		t.Fatalf("tx.SetDigest() error: %+v", err)
+	}
+	if got, err := tx.Digest(ctx, "a1", "m1"); err != nil || got != nil {
+		t.Errorf("tx.Digest(m1) after clearing = %+v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	runEachMode(t, testDigest)
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persist
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/pkg/errors"
+)
+
+// Draft is the recorded state of a GMail draft.
+type Draft struct {
+	// The GMail draft ID, which stays the same across updates.
+	DraftID string
+
+	// The GMail message ID of the version last synchronized.
+	MessageID string
+
+	// The Message-ID of the draft, without angle brackets, or "" if
+	// it has none.
+	HeaderMessageID string
+
+	// The Digest of the local file of the version last
+	// synchronized.
+	Digest message.Digest
+}
+
+// Drafts returns the drafts recorded for an account, ordered by draft
+// ID.
+func (tx *Tx) Drafts(ctx context.Context, account string) ([]Draft, error) {
+	const q = `
+SELECT draft_id, message_id, header_message_id, content_sha256, content_size
+FROM drafts
+WHERE account == $1
+ORDER BY draft_id
+`
+	rows, err := tx.query(ctx, q, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var drafts []Draft
+	for rows.Next() {
+		var d Draft
+		var mid sql.NullString
+		if err := rows.Scan(&d.DraftID, &d.MessageID, &mid, &d.Digest.SHA256, &d.Digest.Size); err != nil {
+			return nil, errors.Wrap(err, "db scan failed in Drafts")
+		}
+		d.HeaderMessageID = mid.String
+		drafts = append(drafts, d)
+	}
+	return drafts, errors.Wrap(rows.Err(), "db iteration failed in Drafts")
+}
+
+// PutDraft records the state of a draft, replacing any recorded for the
+// same draft ID.
+func (tx *Tx) PutDraft(ctx context.Context, account string, d Draft) error {
+	const q = `
+INSERT OR REPLACE INTO drafts
+(account, draft_id, message_id, header_message_id, content_sha256, content_size)
+VALUES ($1, $2, $3, $4, $5, $6)
+`
+	var mid interface{}
+	if d.HeaderMessageID != "" {
+		mid = d.HeaderMessageID
+	}
+	return tx.exec(ctx, q, account, d.DraftID, d.MessageID, mid, d.Digest.SHA256, d.Digest.Size)
+}
+
+// DeleteDraft forgets a draft.
+func (tx *Tx) DeleteDraft(ctx context.Context, account, draftID string) error {
+	const q = `DELETE FROM drafts WHERE account = $1 AND draft_id = $2`
+	return tx.exec(ctx, q, account, draftID)
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persist
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func testDrafts(t *testing.T, mode fixtureMode) {
+	ctx := context.Background()
+	fixture := createDBFixture(ctx, mode, t)
+	defer fixture.CloseOrFatal()
+
+	tx := fixture.BeginOrFatal(ctx)
+	defer tx.Rollback()
+	d1 := Draft{DraftID: "r1", MessageID: "m1", HeaderMessageID: "one@example.com",
+		Digest: message.DigestOf([]byte("Subject: one\n\n"))}
+	d2 := Draft{DraftID: "r2", MessageID: "m2", Digest: message.DigestOf([]byte("Subject: two\n\n"))}
+	for _, d := range []Draft{d2, d1} {
+		if err := tx.PutDraft(ctx, "a1", d); err != nil {
+			t.Fatalf("tx.PutDraft() error: %+v", err)
+		}
+	}
+	if err := tx.PutDraft(ctx, "a2", d1); err != nil {
+		t.Fatalf("tx.PutDraft() error: %+v", err)
+	}
+	// An update replaces the message behind the draft.
+	d1.MessageID = "m3"
+	d1.Digest = message.DigestOf([]byte("Subject: one, edited\n\n"))
+	if err := tx.PutDraft(ctx, "a1", d1); err != nil {
+		t.Fatalf("tx.PutDraft() error: %+v", err)
+	}
+
+	got, err := tx.Drafts(ctx, "a1")
+	if err != nil {
+		t.Fatalf("tx.Drafts() error: %+v", err)
+	}
+	if diff := cmp.Diff([]Draft{d1, d2}, got); diff != "" {
+		t.Errorf("tx.Drafts() mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := tx.DeleteDraft(ctx, "a1", "r1"); err != nil {
+		t.Fatalf("tx.DeleteDraft() error: %+v", err)
+	}
+	if got, err := tx.Drafts(ctx, "a1"); err != nil || !cmp.Equal(got, []Draft{d2}) {
+		t.Errorf("tx.Drafts() after delete = %+v, %v, want %+v", got, err, []Draft{d2})
+	}
+	if got, err := tx.Drafts(ctx, "a2"); err != nil || len(got) != 1 || got[0].MessageID != "m1" {
+		t.Errorf("tx.Drafts(a2) = %+v, %v, want the draft as first put", got, err)
+	}
+}
+
+func TestDrafts(t *testing.T) {
+	runEachMode(t, testDrafts)
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persist
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// SetHeaderMessageID records the Message-ID of the file last written
+// for a message.  The empty string records that no file is stored.
+func (tx *Tx) SetHeaderMessageID(ctx context.Context, account, permID, mid string) error {
+	const q = `UPDATE messages SET header_message_id = $1 WHERE account = $2 AND message_id = $3`
+	var v interface{}
+	if mid != "" {
+		v = mid
+	}
+	return tx.exec(ctx, q, v, account, permID)
+}
+
+// LookupThread returns the ID of the thread of a message whose stored
+// file has the given Message-ID, or "" if there is none.
+func (tx *Tx) LookupThread(ctx context.Context, account, mid string) (string, error) {
+	const q = `
+SELECT thread_id
+FROM messages
+WHERE account == $1 AND header_message_id == $2
+ORDER BY message_id
+LIMIT 1
+`
+	var thread string
+	err := tx.tx.QueryRowContext(ctx, q, account, mid).Scan(&thread)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return thread, errors.Wrap(err, "db scan failed in LookupThread")
+}
+
+// ListUnidentified calls handler for every message that should be
+// stored locally but has no recorded Message-ID, such as those stored
+// before Message-IDs were recorded.
+func (tx *Tx) ListUnidentified(ctx context.Context, account string, handler func(permID string) error) error {
+	const q = `
+SELECT message_id
+FROM messages
+WHERE account == ?1 AND header_message_id IS NULL
+AND COALESCE(fetch_state, 'full') != 'skipped'
+AND history_id IS NOT NULL AND history_id != ?2
+ORDER BY message_id
+`
+	// A history ID of zero marks messages no longer in GMail.
+	rows, err := tx.query(ctx, q, account, orderedToSigned(0))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return errors.Wrap(err, "db scan failed in ListUnidentified")
+		}
+		if err := handler(id); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(rows.Err(), "db iteration failed in ListUnidentified")
+}
+
+// ListDuplicates calls handler for every Message-ID shared by the
+// stored files of several messages, with the IDs of those messages in
+// order.
+func (tx *Tx) ListDuplicates(ctx context.Context, account string, handler func(mid string, permIDs []string) error) error {
+	const q = `
+SELECT header_message_id, message_id
+FROM messages
+WHERE account == $1 AND header_message_id IN (
+  SELECT header_message_id FROM messages
+  WHERE account == $1 AND header_message_id IS NOT NULL
+  GROUP BY header_message_id HAVING COUNT(*) > 1
+)
+ORDER BY header_message_id, message_id
+`
+	rows, err := tx.query(ctx, q, account)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var mid string
+	var ids []string
+	for rows.Next() {
+		var m, id string
+		if err := rows.Scan(&m, &id); err != nil {
+			return errors.Wrap(err, "db scan failed in ListDuplicates")
+		}
+		if m != mid && ids != nil {
+			if err := handler(mid, ids); err != nil {
+				return err
+			}
+			ids = nil
+		}
+		mid = m
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "db iteration failed in ListDuplicates")
+	}
+	if ids != nil {
+		return handler(mid, ids)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persist
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func testDuplicates(t *testing.T, mode fixtureMode) {
+	ctx := context.Background()
+	fixture := createDBFixture(ctx, mode, t)
+	defer fixture.CloseOrFatal()
+
+	tx := fixture.BeginOrFatal(ctx)
+	defer tx.Rollback()
+	for _, m := range []struct {
+		account, id, mid string
+	}{
+		{"a1", "m1", "x@example.com"},
+		{"a1", "m2", "y@example.com"},
+		{"a1", "m3", "x@example.com"},
+		{"a1", "m4", "z@example.com"},
+		{"a1", "m5", "z@example.com"},
+		{"a1", "m6", ""},
+		{"a1", "m7", ""},
+		// Copies in other accounts are not merged.
+		{"a2", "m8", "y@example.com"},
+	} {
+		if err := tx.InsertMessageID(ctx, m.account, message.ID{PermID: m.id, ThreadID: "t-" + m.id}); err != nil {
+			t.Fatalf("tx.InsertMessageID() error: %+v", err)
+		}
+		if err := tx.SetHeaderMessageID(ctx, m.account, m.id, m.mid); err != nil {
+			t.Fatalf("tx.SetHeaderMessageID() error: %+v", err)
+		}
+	}
+
+	// m6 is stored; m7 is no longer in GMail.
+	for id, history := range map[string]uint64{"m1": 1, "m6": 1, "m7": 0} {
+		hdr := message.Header{ID: message.ID{PermID: id, ThreadID: "t"}, HistoryID: history}
+		if err := tx.UpdateHeader(ctx, "a1", &hdr); err != nil {
+			t.Fatalf("tx.UpdateHeader() error: %+v", err)
+		}
+	}
+	for _, tc := range []struct {
+		account, mid, want string
+	}{
+		{"a1", "x@example.com", "t-m1"},
+		{"a1", "y@example.com", "t-m2"},
+		{"a2", "y@example.com", "t-m8"},
+		{"a2", "x@example.com", ""},
+	} {
+		if got, err := tx.LookupThread(ctx, tc.account, tc.mid); err != nil || got != tc.want {
+			t.Errorf("tx.LookupThread(%q, %q) = %q, %v, want %q, nil", tc.account, tc.mid, got, err, tc.want)
+		}
+	}
+
+	var unidentified []string
+	err := tx.ListUnidentified(ctx, "a1", func(id string) error {
+		unidentified = append(unidentified, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("tx.ListUnidentified() error: %+v", err)
+	}
+	if diff := cmp.Diff([]string{"m6"}, unidentified); diff != "" {
+		t.Errorf("tx.ListUnidentified() mismatch (-want +got):\n%s", diff)
+	}
+
+	got := map[string][]string{}
+	err = tx.ListDuplicates(ctx, "a1", func(mid string, ids []string) error {
+		got[mid] = ids
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("tx.ListDuplicates() error: %+v", err)
+	}
+	want := map[string][]string{
+		"x@example.com": {"m1", "m3"},
+		"z@example.com": {"m4", "m5"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tx.ListDuplicates() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	runEachMode(t, testDuplicates)
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persist
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/pkg/errors"
+)
+
+// Valid fetch states, recording how much of a message is stored
+// locally.  The empty string means the state is unknown, in which case
+// a stored message is stored in full.
+const (
+	FetchFull    = "full"
+	FetchHeaders = "headers"
+	FetchStub    = "stub"
+	FetchSkipped = "skipped"
+)
+
+// SetFetchState records how much of a message is stored locally.
+func (tx *Tx) SetFetchState(ctx context.Context, account, permID, state string) error {
+	const q = `UPDATE messages SET fetch_state = $1 WHERE account = $2 AND message_id = $3`
+	return tx.exec(ctx, q, state, account, permID)
+}
+
+// FetchState returns how much of a message is stored locally, or "" if
+// unknown.
+func (tx *Tx) FetchState(ctx context.Context, account, permID string) (string, error) {
+	const q = `SELECT COALESCE(fetch_state, '') FROM messages WHERE account == $1 AND message_id == $2`
+	var state string
+	err := tx.tx.QueryRowContext(ctx, q, account, permID).Scan(&state)
+	if err == sql.ErrNoRows {
+		err = nil // a non-error
+	}
+	return state, errors.Wrap(err, "db scan failed in FetchState")
+}
+
+// RequeueFetchStates queues every message in one of the given fetch
+// states for a header refresh, so the sync policy is evaluated again,
+// and returns the number of messages queued.
+func (tx *Tx) RequeueFetchStates(ctx context.Context, account string, states ...string) (int64, error) {
+	if len(states) == 0 {
+		return 0, nil
+	}
+	q := `UPDATE messages SET history_id = NULL WHERE account = ? AND fetch_state IN (?` +
+		strings.Repeat(", ?", len(states)-1) + `)`
+	args := []interface{}{account}
+	for _, s := range states {
+		args = append(args, s)
+	}
+	res, err := tx.tx.ExecContext(ctx, q, args...)
+	if err != nil {
+		return 0, errors.Wrap(err, "db error in RequeueFetchStates")
+	}
+	n, err := res.RowsAffected()
+	return n, errors.Wrap(err, "db error in RequeueFetchStates")
+}
+
+// ListStoredBefore calls handler for every message stored locally, in
+// full or in part, that GMail received before t.  Messages whose
+// receipt time is unknown are not listed.
+func (tx *Tx) ListStoredBefore(ctx context.Context, account string, t time.Time, handler func(message.ID) error) error {
+	const q = `
+SELECT message_id, thread_id
+FROM messages
+WHERE account == $1 AND internal_date < $2
+AND COALESCE(fetch_state, 'full') != 'skipped'
+ORDER BY message_id
+`
+	rows, err := tx.query(ctx, q, account, t.UnixMilli())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id message.ID
+		if err := rows.Scan(&id.PermID, &id.ThreadID); err != nil {
+			return errors.Wrap(err, "db scan failed in ListStoredBefore")
+		}
+		if err := handler(id); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(rows.Err(), "db iteration failed in ListStoredBefore")
+}
+
+// ListStored calls handler for every known message with how much of
+// it should be stored locally: one of FetchFull, FetchHeaders or
+// FetchStub, or "" if nothing should be.  Messages stored before fetch
+// states were recorded are assumed to be stored in full.
+func (tx *Tx) ListStored(ctx context.Context, account string, handler func(id message.ID, state string) error) error {
+	const q = `
+SELECT message_id, thread_id,
+CASE
+  WHEN fetch_state == 'skipped' THEN ''
+  WHEN fetch_state IS NOT NULL THEN fetch_state
+  WHEN history_id IS NOT NULL AND history_id != ?2 THEN 'full'
+  ELSE ''
+END
+FROM messages
+WHERE account == ?1
+ORDER BY message_id
+`
+	// A history ID of zero marks messages no longer in GMail.
+	rows, err := tx.query(ctx, q, account, orderedToSigned(0))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id message.ID
+		var state string
+		if err := rows.Scan(&id.PermID, &id.ThreadID, &state); err != nil {
+			return errors.Wrap(err, "db scan failed in ListStored")
+		}
+		if err := handler(id, state); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(rows.Err(), "db iteration failed in ListStored")
+}
+
+// ListReceivedSince calls handler for every known message GMail
+// received at or after t, in order of receipt, with its receipt time.
+// If t is zero every message is listed, those whose receipt time is
+// unknown first, with a zero time.
+func (tx *Tx) ListReceivedSince(ctx context.Context, account string, t time.Time, handler func(id message.ID, received time.Time) error) error {
+	const q = `
+SELECT message_id, thread_id, internal_date
+FROM messages
+WHERE account == ?1 AND COALESCE(internal_date, 0) >= ?2
+ORDER BY internal_date, message_id
+`
+	since := int64(math.MinInt64)
+	if !t.IsZero() {
+		since = t.UnixMilli()
+	}
+	rows, err := tx.query(ctx, q, account, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id message.ID
+		var date sql.NullInt64
+		if err := rows.Scan(&id.PermID, &id.ThreadID, &date); err != nil {
+			return errors.Wrap(err, "db scan failed in ListReceivedSince")
+		}
+		var received time.Time
+		if date.Valid {
+			received = time.UnixMilli(date.Int64)
+		}
+		if err := handler(id, received); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(rows.Err(), "db iteration failed in ListReceivedSince")
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persist
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func testFetchState(t *testing.T, mode fixtureMode) {
+	ctx := context.Background()
+	fixture := createDBFixture(ctx, mode, t)
+	defer fixture.CloseOrFatal()
+
+	const account = "account"
+	day := func(d int) time.Time {
+		return time.Date(2019, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	tx := fixture.BeginOrFatal(ctx)
+	defer tx.Rollback()
+	for _, m := range []struct {
+		id    string
+		date  time.Time
+		state string
+	}{
+		{"m1", day(1), FetchFull},
+		{"m2", day(2), FetchStub},
+		{"m3", day(3), FetchSkipped},
+		{"m4", day(4), FetchFull},
+		{"m5", day(1), ""},
+	} {
+		id := message.ID{PermID: m.id, ThreadID: "t"}
+		if err := tx.InsertMessageID(ctx, account, id); err != nil {
+			t.Fatalf("tx.InsertMessageID() error: %+v", err)
+		}
+		hdr := message.Header{ID: id, HistoryID: 1, InternalDate: m.date}
+		if err := tx.UpdateHeader(ctx, account, &hdr); err != nil {
+			t.Fatalf("tx.UpdateHeader() error: %+v", err)
+		}
+		if m.state != "" {
+			if err := tx.SetFetchState(ctx, account, m.id, m.state); err != nil {
+				t.Fatalf("tx.SetFetchState() error: %+v", err)
+			}
+		}
+	}
+	// A header without a date must not erase the known one.
+	hdr := message.Header{ID: message.ID{PermID: "m1"}, HistoryID: 2}
+	if err := tx.UpdateHeader(ctx, account, &hdr); err != nil {
+		t.Fatalf("tx.UpdateHeader() error: %+v", err)
+	}
+	CommitOrFatal(t, tx)
+
+	tx = fixture.BeginOrFatal(ctx)
+	defer tx.Rollback()
+	for id, want := range map[string]string{"m2": FetchStub, "m5": "", "missing": ""} {
+		if got, err := tx.FetchState(ctx, account, id); err != nil || got != want {
+			t.Errorf("tx.FetchState(%q) = %q, %v, want %q, nil", id, got, err, want)
+		}
+	}
+
+	var got []string
+	err := tx.ListStoredBefore(ctx, account, day(4), func(id message.ID) error {
+		got = append(got, id.PermID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("tx.ListStoredBefore() error: %+v", err)
+	}
+	if want := []string{"m1", "m2", "m5"}; !cmp.Equal(got, want) {
+		t.Errorf("tx.ListStoredBefore() = %v, want %v", got, want)
+	}
+
+	// Add a message not yet fetched, and one no longer in GMail.
+	for _, id := range []string{"m6", "m7"} {
+		if err := tx.InsertMessageID(ctx, account, message.ID{PermID: id, ThreadID: "t"}); err != nil {
+			t.Fatalf("tx.InsertMessageID() error: %+v", err)
+		}
+	}
+	gone := message.Header{ID: message.ID{PermID: "m7", ThreadID: "t"}, HistoryID: 0}
+	if err := tx.UpdateHeader(ctx, account, &gone); err != nil {
+		t.Fatalf("tx.UpdateHeader() error: %+v", err)
+	}
+	stored := map[string]string{}
+	err = tx.ListStored(ctx, account, func(id message.ID, state string) error {
+		stored[id.PermID] = state
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("tx.ListStored() error: %+v", err)
+	}
+	wantStored := map[string]string{
+		"m1": FetchFull, "m2": FetchStub, "m3": "", "m4": FetchFull,
+		"m5": FetchFull, "m6": "", "m7": "",
+	}
+	if !cmp.Equal(stored, wantStored) {
+		t.Errorf("tx.ListStored() diff (-got +want):\n%s", cmp.Diff(stored, wantStored))
+	}
+
+	for _, tc := range []struct {
+		since time.Time
+		want  []string
+	}{
+		{time.Time{}, []string{"m6", "m7", "m1", "m5", "m2", "m3", "m4"}},
+		{day(2), []string{"m2", "m3", "m4"}},
+	} {
+		var got []string
+		err := tx.ListReceivedSince(ctx, account, tc.since, func(id message.ID, received time.Time) error {
+			if id.PermID == "m2" && !received.Equal(day(2)) {
+				t.Errorf("tx.ListReceivedSince() received m2 at %v, want %v", received, day(2))
+			}
+			got = append(got, id.PermID)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("tx.ListReceivedSince() error: %+v", err)
+		}
+		if !cmp.Equal(got, tc.want) {
+			t.Errorf("tx.ListReceivedSince(%v) = %v, want %v", tc.since, got, tc.want)
+		}
+	}
+
+	n, err := tx.RequeueFetchStates(ctx, account, FetchStub, FetchSkipped)
+	if err != nil || n != 2 {
+		t.Errorf("tx.RequeueFetchStates() = %d, %v, want 2, nil", n, err)
+	}
+	CommitOrFatal(t, tx)
+
+	updated := fixture.ListUpdated(ctx, account)
+	if len(updated) != 3 || updated["m2"].PermID == "" || updated["m3"].PermID == "" || updated["m6"].PermID == "" {
+		t.Errorf("ListUpdated() = %v, want m2, m3 and m6", updated)
+	}
+}
+
+func TestFetchState(t *testing.T) {
+	runEachMode(t, testFetchState)
+}
+
+func TestAddedColumns(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db")
+
+	// The messages table as first released.
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.ExecContext(ctx, `
+CREATE TABLE messages (
+account TEXT NOT NULL,
+message_id TEXT NOT NULL,
+thread_id TEXT NOT NULL,
+history_id INTEGER,
+size_estimate INTEGER,
+PRIMARY KEY (account, message_id)
+);`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ { // Opening again must not add the columns twice.
+		db, err := Open(ctx, path)
+		if err != nil {
+			t.Fatalf("Open() error: %+v", err)
+		}
+		for _, c := range addedColumns {
+			if have, err := hasColumn(ctx, db.db, c.table, c.column); err != nil || !have {
+				t.Errorf("hasColumn(%q, %q) = %v, %v, want true, nil", c.table, c.column, have, err)
+			}
+		}
+		db.Close()
+	}
+}
@@ -18,12 +18,14 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
 	"math"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/metrics"
 
 	"github.com/pkg/errors"
 )
@@ -91,6 +93,44 @@ var (
 		//   This field is never set NULL.  Once fetched it is
 		//   considered valid for the message_id for the life
 		//   of the database.
+		//
+		// Field: internal_date
+		//
+		//   GMail API: Users.messages resource "internalDate"
+		//   field, in milliseconds since the Unix epoch.
+		//
+		//   Notes:
+		//
+		//   As with size_estimate, NULL until the first
+		//   successful Users.messages.get and never set NULL
+		//   afterwards.
+		//
+		// Field: fetch_state
+		//
+		//   How much of the message is stored locally, as
+		//   decided by the sync policy: 'full', 'headers'
+		//   (the header section only), 'stub' (the header
+		//   section and a placeholder body) or 'skipped'
+		//   (nothing).  NULL if not yet decided, or if the
+		//   message was stored before sync policies existed,
+		//   in which case it is stored in full.
+		//
+		// Field: content_sha256, content_size
+		//
+		//   The SHA-256, in lower case hex, and length in
+		//   bytes of the file last written for the message,
+		//   after line ending normalization.  NULL if no file
+		//   is stored, or if it was written before digests
+		//   were recorded.
+		//
+		// Field: header_message_id
+		//
+		//   The RFC 5322 Message-ID of the file last written
+		//   for the message, without angle brackets.  NULL
+		//   under the same conditions as content_sha256.
+		//   GMail may hold several messages with the same
+		//   Message-ID, such as the sent and received copies
+		//   of a message, which notmuch merges into one.
 		`
 CREATE TABLE IF NOT EXISTS messages (
 account TEXT NOT NULL,
@@ -98,6 +138,11 @@ message_id TEXT NOT NULL,
 thread_id TEXT NOT NULL,
 history_id INTEGER,
 size_estimate INTEGER,
+internal_date INTEGER,
+fetch_state TEXT CHECK (fetch_state IN ('full', 'headers', 'stub', 'skipped')),
+content_sha256 TEXT,
+content_size INTEGER,
+header_message_id TEXT,
 PRIMARY KEY (account, message_id)
 );`,
 
@@ -172,16 +217,159 @@ CREATE TABLE IF NOT EXISTS gmail_history_id (
 account TEXT NOT NULL,
 history_id INTEGER NOT NULL,
 PRIMARY KEY (account, history_id)
+);`,
+
+		// The settings table holds per-account values that must
+		// persist between runs, such as the sync scope the
+		// messages table was last populated with.
+		//
+		// Field: account
+		//
+		//   A GMail account name.
+		//
+		// Field: name
+		//
+		//   The name of the setting.
+		//
+		// Field: value
+		//
+		//   The value of the setting.
+		`
+CREATE TABLE IF NOT EXISTS settings (
+account TEXT NOT NULL,
+name TEXT NOT NULL,
+value TEXT NOT NULL,
+PRIMARY KEY (account, name)
+);`,
+
+		// The sync_runs table records statistics about each
+		// run of the synchronization engine.
+		//
+		// Field: run_id
+		//
+		//   A unique, increasing identifier for the run.
+		//
+		// Field: account
+		//
+		//   A GMail account name.
+		//
+		// Field: start_time, end_time
+		//
+		//   Wall clock time the run started and finished, in
+		//   milliseconds since the Unix epoch.  end_time is
+		//   NULL while the run is in progress, or if the
+		//   program exited before the run finished.
+		//
+		// Field: status
+		//
+		//   One of 'running', 'ok' or 'failed'.
+		//
+		// Field: error
+		//
+		//   The error that caused a 'failed' run, if any.
+		//
+		// Field: listed ... throttled
+		//
+		//   Counters describing the work performed by the run.
+		//   See the SyncRun type for details.
+		//
+		// Field: list_ms, download_ms
+		//
+		//   The duration of each synchronization phase, in
+		//   milliseconds.
+		`
+CREATE TABLE IF NOT EXISTS sync_runs (
+run_id INTEGER PRIMARY KEY AUTOINCREMENT,
+account TEXT NOT NULL,
+start_time INTEGER NOT NULL,
+end_time INTEGER,
+status TEXT NOT NULL CHECK (status IN ('running', 'ok', 'failed')),
+error TEXT,
+listed INTEGER NOT NULL DEFAULT 0,
+fetched INTEGER NOT NULL DEFAULT 0,
+bytes_downloaded INTEGER NOT NULL DEFAULT 0,
+labels_changed INTEGER NOT NULL DEFAULT 0,
+deleted INTEGER NOT NULL DEFAULT 0,
+retries INTEGER NOT NULL DEFAULT 0,
+throttled INTEGER NOT NULL DEFAULT 0,
+list_ms INTEGER NOT NULL DEFAULT 0,
+download_ms INTEGER NOT NULL DEFAULT 0
+);`,
+
+		// The drafts table holds state for each GMail draft
+		// synchronized with the local drafts folder.  Drafts are
+		// kept apart from messages because the message behind a
+		// draft is replaced by every update.
+		//
+		// Field: account
+		//
+		//   A GMail account name.
+		//
+		// Field: draft_id
+		//
+		//   GMail API: Users.drafts resource "id" field, which
+		//   stays the same across updates.
+		//
+		// Field: message_id
+		//
+		//   GMail API: Users.drafts resource "message.id"
+		//   field, for the version last synchronized.  It
+		//   changes on every update.
+		//
+		// Field: header_message_id
+		//
+		//   The RFC 5322 Message-ID of the draft, without angle
+		//   brackets, which stays the same across local saves.
+		//   NULL if the draft has none.
+		//
+		// Field: content_sha256, content_size
+		//
+		//   As in messages, for the local file of the version
+		//   last synchronized, so local edits can be told
+		//   apart.
+		`
+CREATE TABLE IF NOT EXISTS drafts (
+account TEXT NOT NULL,
+draft_id TEXT NOT NULL,
+message_id TEXT NOT NULL,
+header_message_id TEXT,
+content_sha256 TEXT NOT NULL,
+content_size INTEGER NOT NULL,
+PRIMARY KEY (account, draft_id)
 );`,
 	}
 )
 
+// addedColumns lists the columns added to tables after they were first
+// created.  initSchema adds those missing from older databases.
+var addedColumns = []struct {
+	table, column, decl string
+}{
+	{"messages", "internal_date", "INTEGER"},
+	{"messages", "fetch_state", "TEXT CHECK (fetch_state IN ('full', 'headers', 'stub', 'skipped'))"},
+	{"messages", "content_sha256", "TEXT"},
+	{"messages", "content_size", "INTEGER"},
+	{"messages", "header_message_id", "TEXT"},
+}
+
+// createIndexSql creates indexes, possibly on added columns, so it runs
+// after they are added.
+var createIndexSql = []string{
+	// Finds messages notmuch merges into one.
+	`CREATE INDEX IF NOT EXISTS messages_by_header_message_id ON messages (account, header_message_id);`,
+}
+
+var txLatency = metrics.NewHistogram("gotmuch_db_transaction_seconds",
+	"Database transaction latency, from begin to commit or rollback.",
+	metrics.DefaultBuckets, "outcome")
+
 type DB struct {
 	db *sql.DB
 }
 
 type Tx struct {
-	tx *sql.Tx
+	tx    *sql.Tx
+	start time.Time
 }
 
 func dsnFromPath(path string, addValues url.Values) (string, error) {
@@ -234,6 +422,7 @@ func Open(ctx context.Context, path string) (*DB, error) {
 				"database schema", path)
 	}
 
+	slog.DebugContext(ctx, "opened database", "path", path)
 	return &DB{db}, nil
 }
 
@@ -246,15 +435,29 @@ func (db *DB) Begin(ctx context.Context) (*Tx, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "begin transaction failed")
 	}
-	return &Tx{tx}, nil
+	return &Tx{tx, time.Now()}, nil
+}
+
+// observe records the latency of a transaction that has just ended.
+func (tx *Tx) observe(outcome string, err error) {
+	if err == sql.ErrTxDone {
+		// Not the call that ended the transaction.  Most likely
+		// a deferred Rollback after a Commit.
+		return
+	}
+	txLatency.Observe(time.Since(tx.start).Seconds(), outcome)
 }
 
 func (tx *Tx) Commit() error {
-	return tx.tx.Commit()
+	err := tx.tx.Commit()
+	tx.observe("commit", err)
+	return err
 }
 
 func (tx *Tx) Rollback() error {
-	return tx.tx.Rollback()
+	err := tx.tx.Rollback()
+	tx.observe("rollback", err)
+	return err
 }
 
 func initSchema(ctx context.Context, db *sql.DB) error {
@@ -264,11 +467,48 @@ func initSchema(ctx context.Context, db *sql.DB) error {
 		}
 	}
 
+	for _, c := range addedColumns {
+		have, err := hasColumn(ctx, db, c.table, c.column)
+		if err != nil {
+			return err
+		}
+		if have {
+			continue
+		}
+		sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.decl)
+		if _, err := db.ExecContext(ctx, sql); err != nil {
+			return errors.Wrapf(err, "while executing %q", sql)
+		}
+	}
+
+	for _, sql := range createIndexSql {
+		if _, err := db.ExecContext(ctx, sql); err != nil {
+			return errors.Wrapf(err, "while executing %q", sql)
+		}
+	}
 	return nil
 }
 
+func hasColumn(ctx context.Context, db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_info($1)", table)
+	if err != nil {
+		return false, errors.Wrapf(err, "reading the schema of %s", table)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, errors.Wrapf(err, "reading the schema of %s", table)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, errors.Wrapf(rows.Err(), "reading the schema of %s", table)
+}
+
 func (tx *Tx) exec(ctx context.Context, query string, args ...interface{}) error {
-	// fmt.Printf("XXX exec(%q) using %#v\n", query, args)
+	slog.DebugContext(ctx, "db exec", "query", query, "args", args)
 	_, err := tx.tx.ExecContext(ctx, query, args...)
 	if err != nil {
 		return errors.Wrapf(err, "db error executing %q with %#v", query, args)
@@ -277,11 +517,14 @@ func (tx *Tx) exec(ctx context.Context, query string, args ...interface{}) error
 }
 
 func (tx *Tx) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
-	// fmt.Printf("XXX query(%q) using %#v\n", query, args)
+	slog.DebugContext(ctx, "db query", "query", query, "args", args)
 	rows, err := tx.tx.QueryContext(ctx, query, args...)
 	return rows, errors.Wrapf(err, "db error executing %q with %#v", query, args)
 }
 
+// InsertMessageID queues a message for download or a header refresh.
+// The labels recorded for a known message are kept until its header is
+// updated, so the changes to them can be found.
 func (tx *Tx) InsertMessageID(ctx context.Context, account string, msg message.ID) error {
 	query := `
 INSERT OR REPLACE INTO messages
@@ -289,24 +532,18 @@ INSERT OR REPLACE INTO messages
 ON CONFLICT (account, message_id)
 DO UPDATE SET (thread_id, history_id) = ($3, NULL)
 `
-	if err := tx.exec(ctx, query, account, msg.PermID, msg.ThreadID); err != nil {
-		return err
-	}
-
-	query = `
-DELETE FROM message_labels WHERE account = $1 AND message_id = $2
-`
-	if err := tx.exec(ctx, query, account, msg.PermID); err != nil {
-		return err
-	}
-
-	return nil
+	return tx.exec(ctx, query, account, msg.PermID, msg.ThreadID)
 }
 
 func (tx *Tx) UpdateHeader(ctx context.Context, account string, hdr *message.Header) error {
-	sql := `UPDATE messages SET (history_id, size_estimate) = ($1, $2) ` +
-		`WHERE account = $3 AND message_id = $4;`
-	if err := tx.exec(ctx, sql, orderedToSigned(hdr.HistoryID), hdr.SizeEstimate, account, hdr.ID.PermID); err != nil {
+	var internalDate interface{}
+	if !hdr.InternalDate.IsZero() {
+		internalDate = hdr.InternalDate.UnixMilli()
+	}
+	sql := `UPDATE messages SET (history_id, size_estimate, internal_date) = ` +
+		`($1, $2, COALESCE($3, internal_date)) ` +
+		`WHERE account = $4 AND message_id = $5;`
+	if err := tx.exec(ctx, sql, orderedToSigned(hdr.HistoryID), hdr.SizeEstimate, internalDate, account, hdr.ID.PermID); err != nil {
 		return err
 	}
 
@@ -329,6 +566,185 @@ func (tx *Tx) UpdateHeader(ctx context.Context, account string, hdr *message.Hea
 	return nil
 }
 
+// InsertNewMessageID inserts msg if it is not already known, and
+// returns true if it was inserted.  Unlike InsertMessageID, the state
+// of known messages is left unchanged.
+func (tx *Tx) InsertNewMessageID(ctx context.Context, account string, msg message.ID) (bool, error) {
+	const q = `
+INSERT OR IGNORE INTO messages
+(account, message_id, thread_id) values ($1, $2, $3)
+`
+	slog.DebugContext(ctx, "db exec", "query", q, "args", []interface{}{account, msg.PermID, msg.ThreadID})
+	res, err := tx.tx.ExecContext(ctx, q, account, msg.PermID, msg.ThreadID)
+	if err != nil {
+		return false, errors.Wrapf(err, "db error inserting message %v", msg.PermID)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, errors.Wrap(err, "db error in InsertNewMessageID")
+}
+
+// MarkUpdated queues a known message for a header refresh, and returns
+// true if the message is known.
+func (tx *Tx) MarkUpdated(ctx context.Context, account string, permID string) (bool, error) {
+	const q = `UPDATE messages SET history_id = NULL WHERE account = $1 AND message_id = $2`
+	slog.DebugContext(ctx, "db exec", "query", q, "args", []interface{}{account, permID})
+	res, err := tx.tx.ExecContext(ctx, q, account, permID)
+	if err != nil {
+		return false, errors.Wrapf(err, "db error updating message %v", permID)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, errors.Wrap(err, "db error in MarkUpdated")
+}
+
+// DeleteMessage forgets a message and its labels.
+func (tx *Tx) DeleteMessage(ctx context.Context, account string, permID string) error {
+	query := `DELETE FROM message_labels WHERE account = $1 AND message_id = $2`
+	if err := tx.exec(ctx, query, account, permID); err != nil {
+		return err
+	}
+	query = `DELETE FROM messages WHERE account = $1 AND message_id = $2`
+	return tx.exec(ctx, query, account, permID)
+}
+
+// LookupMessage returns the ID of a known message, or nil if the
+// message is not known.
+func (tx *Tx) LookupMessage(ctx context.Context, account string, permID string) (*message.ID, error) {
+	const q = `SELECT message_id, thread_id FROM messages WHERE account == $1 AND message_id == $2`
+	var id message.ID
+	err := tx.tx.QueryRowContext(ctx, q, account, permID).Scan(&id.PermID, &id.ThreadID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "db scan failed in LookupMessage")
+	}
+	return &id, nil
+}
+
+// ListMessageIDs calls handler for every known message.
+func (tx *Tx) ListMessageIDs(ctx context.Context, account string, handler func(message.ID) error) error {
+	const sql = `
+SELECT message_id, thread_id
+FROM messages
+WHERE account == $1
+ORDER BY message_id
+`
+	rows, err := tx.query(ctx, sql, account)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id message.ID
+		if err := rows.Scan(&id.PermID, &id.ThreadID); err != nil {
+			return errors.Wrap(err, "db scan failed in ListMessageIDs")
+		}
+		if err := handler(id); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(rows.Err(), "db iteration failed in ListMessageIDs")
+}
+
+// UpdateLabel records the display name and type of a label.
+func (tx *Tx) UpdateLabel(ctx context.Context, account string, label message.Label) error {
+	const sql = `
+INSERT INTO labels (account, label_id, display_name, type) values ($1, $2, $3, $4)
+ON CONFLICT (account, label_id)
+DO UPDATE SET (display_name, type) = ($3, $4)
+`
+	var typ interface{}
+	if label.Type != "" {
+		typ = label.Type
+	}
+	return tx.exec(ctx, sql, account, label.ID, label.Name, typ)
+}
+
+// Labels returns the labels known for an account, ordered by ID.
+// Labels seen on messages but not yet described by UpdateLabel have
+// an empty Name and Type.
+func (tx *Tx) Labels(ctx context.Context, account string) ([]message.Label, error) {
+	const sql = `
+SELECT label_id, COALESCE(display_name, ''), COALESCE(type, '')
+FROM labels
+WHERE account == $1
+ORDER BY label_id
+`
+	rows, err := tx.query(ctx, sql, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var labels []message.Label
+	for rows.Next() {
+		var l message.Label
+		if err := rows.Scan(&l.ID, &l.Name, &l.Type); err != nil {
+			return nil, errors.Wrap(err, "db scan failed in Labels")
+		}
+		labels = append(labels, l)
+	}
+	return labels, errors.Wrap(rows.Err(), "db iteration failed in Labels")
+}
+
+// Setting returns the value of a setting, or "" if it is not set.
+func (tx *Tx) Setting(ctx context.Context, account, name string) (string, error) {
+	const q = `SELECT value FROM settings WHERE account == $1 AND name == $2`
+	var value string
+	err := tx.tx.QueryRowContext(ctx, q, account, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		err = nil // a non-error
+	}
+	return value, errors.Wrap(err, "db scan failed in Setting")
+}
+
+// SetSetting sets the value of a setting.
+func (tx *Tx) SetSetting(ctx context.Context, account, name, value string) error {
+	const q = `INSERT OR REPLACE INTO settings (account, name, value) values ($1, $2, $3)`
+	return tx.exec(ctx, q, account, name, value)
+}
+
+// MessageLabels returns the label IDs currently recorded for a
+// message, in no particular order.
+func (tx *Tx) MessageLabels(ctx context.Context, account string, permID string) ([]string, error) {
+	const sql = `
+SELECT label_id
+FROM message_labels
+WHERE account == $1 AND message_id == $2
+`
+	rows, err := tx.query(ctx, sql, account, permID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var labels []string
+	for rows.Next() {
+		var label string
+		if err := rows.Scan(&label); err != nil {
+			return nil, errors.Wrap(err, "db scan failed in MessageLabels")
+		}
+		labels = append(labels, label)
+	}
+	return labels, errors.Wrap(rows.Err(), "db iteration failed in MessageLabels")
+}
+
+// HasHeader returns true if a header has been recorded for a message
+// since it was first listed.
+func (tx *Tx) HasHeader(ctx context.Context, account string, permID string) (bool, error) {
+	const q = `SELECT size_estimate IS NOT NULL FROM messages WHERE account == $1 AND message_id == $2`
+	var has bool
+	err := tx.tx.QueryRowContext(ctx, q, account, permID).Scan(&has)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "db scan failed in HasHeader")
+	}
+	return has, nil
+}
+
 func (tx *Tx) ListUpdated(ctx context.Context, account string, limit int, handler func(message.ID) error) error {
 	const sql = `
 SELECT message_id, thread_id
@@ -355,6 +771,32 @@ LIMIT $2
 	return nil
 }
 
+// CountUpdated returns the number of messages ListUpdated would return
+// without a limit.  Of those, the sizes of sized messages are known and
+// sum to sizeEstimate.
+func (tx *Tx) CountUpdated(ctx context.Context, account string) (count, sized, sizeEstimate int64, err error) {
+	const q = `
+SELECT COUNT(*), COUNT(size_estimate), COALESCE(SUM(size_estimate), 0)
+FROM messages
+WHERE account == $1 AND history_id IS NULL
+`
+	row := tx.tx.QueryRowContext(ctx, q, account)
+	if err = row.Scan(&count, &sized, &sizeEstimate); err != nil {
+		err = errors.Wrap(err, "db scan failed in CountUpdated")
+	}
+	return
+}
+
+// CountMessages returns the number of messages known in account.
+func (tx *Tx) CountMessages(ctx context.Context, account string) (int64, error) {
+	const q = `SELECT COUNT(*) FROM messages WHERE account == $1`
+	var count int64
+	if err := tx.tx.QueryRowContext(ctx, q, account).Scan(&count); err != nil {
+		return 0, errors.Wrap(err, "db scan failed in CountMessages")
+	}
+	return count, nil
+}
+
 func orderedToSigned(u uint64) int64 {
 	return int64(u - -math.MinInt64) // Imagine 0..255 -> -128..127
 }
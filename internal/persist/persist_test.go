@@ -23,7 +23,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/matta/gotmuch/internal/message"
 
@@ -303,9 +305,9 @@ func testInsertMessageID(t *testing.T, mode fixtureMode) {
 	tx := fixture.BeginOrFatal(ctx)
 	defer tx.Rollback()
 	for _, msg := range []message.ID{
-		message.ID{"m1", "t1"},
-		message.ID{"m2", "t2"},
-		message.ID{"m1", "t1"},
+		{PermID: "m1", ThreadID: "t1"},
+		{PermID: "m2", ThreadID: "t2"},
+		{PermID: "m1", ThreadID: "t1"},
 	} {
 		if err := tx.InsertMessageID(ctx, account, msg); err != nil {
 			t.Fatalf("tx.InsertMessageID() error: %+v", err)
@@ -313,8 +315,21 @@ func testInsertMessageID(t *testing.T, mode fixtureMode) {
 	}
 	CommitOrFatal(t, tx)
 
+	tx = fixture.BeginOrFatal(ctx)
+	count, sized, size, err := tx.CountUpdated(ctx, account)
+	if err != nil {
+		t.Fatalf("tx.CountUpdated() error: %+v", err)
+	}
+	if count != 2 || sized != 0 || size != 0 {
+		t.Errorf("tx.CountUpdated() = %d, %d, %d, want 2, 0, 0", count, sized, size)
+	}
+	RollbackOrFatal(t, tx)
+
 	got := fixture.ListUpdated(ctx, account)
-	want := map[string]message.ID{"m1": {"m1", "t1"}, "m2": {"m2", "t2"}}
+	want := map[string]message.ID{
+		"m1": {PermID: "m1", ThreadID: "t1"},
+		"m2": {PermID: "m2", ThreadID: "t2"},
+	}
 	if !cmp.Equal(got, want) {
 		t.Errorf("persist.Tx.ListUpdated() = %v, want %v, diff %s",
 			got, want, cmp.Diff(got, want))
@@ -332,13 +347,16 @@ func testUpdateHeader(t *testing.T, mode fixtureMode) {
 
 	tx := fixture.BeginOrFatal(ctx)
 	defer tx.Rollback()
-	id := message.ID{"m1", "t1"}
+	id := message.ID{PermID: "m1", ThreadID: "t1"}
 	const account = "account"
 	tx.InsertMessageID(ctx, account, id)
 	CommitOrFatal(t, tx)
 
 	tx = fixture.BeginOrFatal(ctx)
 	defer tx.Rollback()
+	if has, err := tx.HasHeader(ctx, account, id.PermID); err != nil || has {
+		t.Errorf("tx.HasHeader() before UpdateHeader = %v, %v, want false, nil", has, err)
+	}
 	hdr := message.Header{
 		ID:           id,
 		LabelIDs:     []string{"label_a", "label_b"},
@@ -351,8 +369,29 @@ func testUpdateHeader(t *testing.T, mode fixtureMode) {
 	}
 	CommitOrFatal(t, tx)
 
-	// TODO: add tests when persist gets an API to read these
-	// messages back.
+	tx = fixture.BeginOrFatal(ctx)
+	defer RollbackOrFatal(t, tx)
+	labels, err := tx.MessageLabels(ctx, account, id.PermID)
+	if err != nil {
+		t.Fatalf("tx.MessageLabels() error: %+v", err)
+	}
+	sort.Strings(labels)
+	if !cmp.Equal(labels, hdr.LabelIDs) {
+		t.Errorf("tx.MessageLabels() = %v, want %v", labels, hdr.LabelIDs)
+	}
+	if has, err := tx.HasHeader(ctx, account, id.PermID); err != nil || !has {
+		t.Errorf("tx.HasHeader() = %v, %v, want true, nil", has, err)
+	}
+
+	// Listing the message again keeps its labels.
+	if err := tx.InsertMessageID(ctx, account, id); err != nil {
+		t.Fatalf("tx.InsertMessageID() error: %+v", err)
+	}
+	labels, err = tx.MessageLabels(ctx, account, id.PermID)
+	sort.Strings(labels)
+	if err != nil || !cmp.Equal(labels, hdr.LabelIDs) {
+		t.Errorf("tx.MessageLabels() after InsertMessageID = %v, %v, want %v", labels, err, hdr.LabelIDs)
+	}
 }
 
 func TestUpdateHeader(t *testing.T) {
@@ -397,3 +436,196 @@ func testHistoryID(t *testing.T, mode fixtureMode) {
 func TestHistoryID(t *testing.T) {
 	runEachMode(t, testHistoryID)
 }
+
+func testDeleteMessage(t *testing.T, mode fixtureMode) {
+	ctx := context.Background()
+	fixture := createDBFixture(ctx, mode, t)
+	defer fixture.CloseOrFatal()
+
+	const account = "account"
+	tx := fixture.BeginOrFatal(ctx)
+	defer tx.Rollback()
+	m1 := message.ID{PermID: "m1", ThreadID: "t1"}
+	m2 := message.ID{PermID: "m2", ThreadID: "t2"}
+	if err := tx.InsertMessageID(ctx, account, m1); err != nil {
+		t.Fatalf("tx.InsertMessageID() error: %+v", err)
+	}
+	hdr := message.Header{ID: m1, LabelIDs: []string{"INBOX"}, HistoryID: 1}
+	if err := tx.UpdateHeader(ctx, account, &hdr); err != nil {
+		t.Fatalf("tx.UpdateHeader() error: %+v", err)
+	}
+	for _, tc := range []struct {
+		id   message.ID
+		want bool
+	}{{m1, false}, {m2, true}, {m2, false}} {
+		inserted, err := tx.InsertNewMessageID(ctx, account, tc.id)
+		if err != nil {
+			t.Fatalf("tx.InsertNewMessageID(%v) error: %+v", tc.id, err)
+		}
+		if inserted != tc.want {
+			t.Errorf("tx.InsertNewMessageID(%v) = %v, want %v", tc.id, inserted, tc.want)
+		}
+	}
+	// m1 keeps its state; only m2 needs an update.
+	if count, _, _, err := tx.CountUpdated(ctx, account); err != nil || count != 1 {
+		t.Errorf("tx.CountUpdated() = %d, %v, want 1, nil", count, err)
+	}
+	for _, tc := range []struct {
+		permID string
+		want   bool
+	}{{"m1", true}, {"m3", false}} {
+		known, err := tx.MarkUpdated(ctx, account, tc.permID)
+		if err != nil || known != tc.want {
+			t.Errorf("tx.MarkUpdated(%q) = %v, %v, want %v, nil", tc.permID, known, err, tc.want)
+		}
+	}
+	if count, _, _, err := tx.CountUpdated(ctx, account); err != nil || count != 2 {
+		t.Errorf("tx.CountUpdated() = %d, %v, want 2, nil", count, err)
+	}
+
+	if err := tx.DeleteMessage(ctx, account, m1.PermID); err != nil {
+		t.Fatalf("tx.DeleteMessage() error: %+v", err)
+	}
+	for permID, want := range map[string]*message.ID{"m1": nil, "m2": &m2} {
+		got, err := tx.LookupMessage(ctx, account, permID)
+		if err != nil || !cmp.Equal(got, want) {
+			t.Errorf("tx.LookupMessage(%q) = %v, %v, want %v, nil", permID, got, err, want)
+		}
+	}
+	if count, err := tx.CountMessages(ctx, account); err != nil || count != 1 {
+		t.Errorf("tx.CountMessages() = %d, %v, want 1, nil", count, err)
+	}
+	CommitOrFatal(t, tx)
+
+	tx = fixture.BeginOrFatal(ctx)
+	defer RollbackOrFatal(t, tx)
+	var got []message.ID
+	err := tx.ListMessageIDs(ctx, account, func(id message.ID) error {
+		got = append(got, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("tx.ListMessageIDs() error: %+v", err)
+	}
+	if want := []message.ID{m2}; !cmp.Equal(got, want) {
+		t.Errorf("tx.ListMessageIDs() = %v, want %v", got, want)
+	}
+	labels, err := tx.MessageLabels(ctx, account, m1.PermID)
+	if err != nil || len(labels) != 0 {
+		t.Errorf("tx.MessageLabels() = %v, %v, want none", labels, err)
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	runEachMode(t, testDeleteMessage)
+}
+
+func testLabelsAndSettings(t *testing.T, mode fixtureMode) {
+	ctx := context.Background()
+	fixture := createDBFixture(ctx, mode, t)
+	defer fixture.CloseOrFatal()
+
+	const account = "account"
+	tx := fixture.BeginOrFatal(ctx)
+	defer tx.Rollback()
+	id := message.ID{PermID: "m1", ThreadID: "t1"}
+	tx.InsertMessageID(ctx, account, id)
+	hdr := message.Header{ID: id, LabelIDs: []string{"Label_1", "Label_2"}, HistoryID: 1}
+	if err := tx.UpdateHeader(ctx, account, &hdr); err != nil {
+		t.Fatalf("tx.UpdateHeader() error: %+v", err)
+	}
+	for _, l := range []message.Label{
+		{ID: "INBOX", Name: "INBOX", Type: "system"},
+		{ID: "Label_1", Name: "old", Type: "user"},
+		{ID: "Label_1", Name: "Receipts", Type: "user"},
+	} {
+		if err := tx.UpdateLabel(ctx, account, l); err != nil {
+			t.Fatalf("tx.UpdateLabel(%v) error: %+v", l, err)
+		}
+	}
+	if err := tx.SetSetting(ctx, account, "scope", "all"); err != nil {
+		t.Fatalf("tx.SetSetting() error: %+v", err)
+	}
+	CommitOrFatal(t, tx)
+
+	tx = fixture.BeginOrFatal(ctx)
+	defer RollbackOrFatal(t, tx)
+	labels, err := tx.Labels(ctx, account)
+	if err != nil {
+		t.Fatalf("tx.Labels() error: %+v", err)
+	}
+	want := []message.Label{
+		{ID: "INBOX", Name: "INBOX", Type: "system"},
+		{ID: "Label_1", Name: "Receipts", Type: "user"},
+		{ID: "Label_2"},
+	}
+	if !cmp.Equal(labels, want) {
+		t.Errorf("tx.Labels() diff (-got +want):\n%s", cmp.Diff(labels, want))
+	}
+	for name, want := range map[string]string{"scope": "all", "unset": ""} {
+		got, err := tx.Setting(ctx, account, name)
+		if err != nil || got != want {
+			t.Errorf("tx.Setting(%q) = %q, %v, want %q, nil", name, got, err, want)
+		}
+	}
+}
+
+func TestLabelsAndSettings(t *testing.T) {
+	runEachMode(t, testLabelsAndSettings)
+}
+
+func testSyncRuns(t *testing.T, mode fixtureMode) {
+	ctx := context.Background()
+	fixture := createDBFixture(ctx, mode, t)
+	defer fixture.CloseOrFatal()
+
+	const account = "account"
+	start := time.Unix(1500000000, 0)
+	var want []*SyncRun
+	tx := fixture.BeginOrFatal(ctx)
+	defer tx.Rollback()
+	for i := 0; i < 3; i++ {
+		id, err := tx.BeginSyncRun(ctx, account, start)
+		if err != nil {
+			t.Fatalf("tx.BeginSyncRun() error: %+v", err)
+		}
+		run := &SyncRun{
+			ID:               id,
+			Account:          account,
+			Start:            start,
+			End:              start.Add(time.Minute),
+			Status:           RunOK,
+			Listed:           int64(10 * i),
+			Fetched:          int64(i),
+			BytesDownloaded:  1234,
+			ListDuration:     time.Second,
+			DownloadDuration: 2 * time.Second,
+		}
+		if err := tx.FinishSyncRun(ctx, run); err != nil {
+			t.Fatalf("tx.FinishSyncRun() error: %+v", err)
+		}
+		want = append([]*SyncRun{run}, want...)
+	}
+	if _, err := tx.BeginSyncRun(ctx, "other", start); err != nil {
+		t.Fatalf("tx.BeginSyncRun() error: %+v", err)
+	}
+	CommitOrFatal(t, tx)
+
+	tx = fixture.BeginOrFatal(ctx)
+	defer RollbackOrFatal(t, tx)
+	var got []*SyncRun
+	err := tx.ListSyncRuns(ctx, account, 10, func(run *SyncRun) error {
+		got = append(got, run)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("tx.ListSyncRuns() error: %+v", err)
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("tx.ListSyncRuns() diff (-got +want):\n%s", cmp.Diff(got, want))
+	}
+}
+
+func TestSyncRuns(t *testing.T) {
+	runEachMode(t, testSyncRuns)
+}
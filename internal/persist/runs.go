@@ -0,0 +1,169 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persist
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Valid values for SyncRun.Status.
+const (
+	RunRunning = "running"
+	RunOK      = "ok"
+	RunFailed  = "failed"
+)
+
+// SyncRun describes a single run of the synchronization engine.
+type SyncRun struct {
+	// ID is assigned by BeginSyncRun.
+	ID int64
+
+	Account string
+
+	// Start and End are the wall clock times the run started and
+	// finished.  End is zero if the run never finished.
+	Start time.Time
+	End   time.Time
+
+	// Status is one of RunRunning, RunOK or RunFailed.
+	Status string
+
+	// Error is the error that caused a RunFailed status.
+	Error string
+
+	// Listed is the number of message IDs returned by the list
+	// phase.
+	Listed int64
+
+	// Fetched is the number of full messages downloaded.
+	Fetched int64
+
+	// BytesDownloaded is the total size of the downloaded
+	// messages.
+	BytesDownloaded int64
+
+	// LabelsChanged is the number of messages whose set of labels
+	// changed.
+	LabelsChanged int64
+
+	// Deleted is the number of messages found to be no longer
+	// present in GMail, or pruned because they are no longer in
+	// the sync scope.
+	Deleted int64
+
+	// Retries is the number of retried GMail API requests, and
+	// Throttled is how many of those were due to HTTP 429 (Too
+	// Many Requests) responses.
+	Retries   int64
+	Throttled int64
+
+	// The time spent in each phase of the run.
+	ListDuration     time.Duration
+	DownloadDuration time.Duration
+}
+
+// Duration returns the wall clock duration of the run, or zero if the
+// run never finished.
+func (r *SyncRun) Duration() time.Duration {
+	if r.End.IsZero() {
+		return 0
+	}
+	return r.End.Sub(r.Start)
+}
+
+func timeToMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func millisToTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// BeginSyncRun records the start of a synchronization run and returns
+// its ID.
+func (tx *Tx) BeginSyncRun(ctx context.Context, account string, start time.Time) (int64, error) {
+	const sql = `INSERT INTO sync_runs (account, start_time, status) VALUES ($1, $2, $3)`
+	res, err := tx.tx.ExecContext(ctx, sql, account, timeToMillis(start), RunRunning)
+	if err != nil {
+		return 0, errors.Wrap(err, "db insert failed in BeginSyncRun")
+	}
+	id, err := res.LastInsertId()
+	return id, errors.Wrap(err, "no run ID in BeginSyncRun")
+}
+
+// FinishSyncRun records the outcome of a synchronization run
+// previously started with BeginSyncRun.
+func (tx *Tx) FinishSyncRun(ctx context.Context, run *SyncRun) error {
+	const sql = `
+UPDATE sync_runs SET
+(end_time, status, error, listed, fetched, bytes_downloaded,
+ labels_changed, deleted, retries, throttled, list_ms, download_ms) =
+($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+WHERE run_id = $13
+`
+	return tx.exec(ctx, sql,
+		timeToMillis(run.End), run.Status, run.Error,
+		run.Listed, run.Fetched, run.BytesDownloaded,
+		run.LabelsChanged, run.Deleted, run.Retries, run.Throttled,
+		run.ListDuration.Milliseconds(), run.DownloadDuration.Milliseconds(),
+		run.ID)
+}
+
+// ListSyncRuns calls handler for the most recent limit runs for the
+// account, newest first.
+func (tx *Tx) ListSyncRuns(ctx context.Context, account string, limit int, handler func(*SyncRun) error) error {
+	const q = `
+SELECT run_id, start_time, end_time, status, error, listed, fetched,
+       bytes_downloaded, labels_changed, deleted, retries, throttled,
+       list_ms, download_ms
+FROM sync_runs
+WHERE account == $1
+ORDER BY run_id DESC
+LIMIT $2
+`
+	rows, err := tx.query(ctx, q, account, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		run := &SyncRun{Account: account}
+		var start, listMS, downloadMS int64
+		var end sql.NullInt64
+		var errText sql.NullString
+		if err := rows.Scan(&run.ID, &start, &end, &run.Status, &errText,
+			&run.Listed, &run.Fetched, &run.BytesDownloaded,
+			&run.LabelsChanged, &run.Deleted, &run.Retries,
+			&run.Throttled, &listMS, &downloadMS); err != nil {
+			return errors.Wrap(err, "db scan failed in ListSyncRuns")
+		}
+		run.Start = millisToTime(start)
+		if end.Valid {
+			run.End = millisToTime(end.Int64)
+		}
+		run.Error = errText.String
+		run.ListDuration = time.Duration(listMS) * time.Millisecond
+		run.DownloadDuration = time.Duration(downloadMS) * time.Millisecond
+		if err := handler(run); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(rows.Err(), "db iteration failed in ListSyncRuns")
+}
@@ -0,0 +1,246 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package progress reports the progress of a long running operation over
+a known number of messages.
+
+When writing to a terminal a progress bar is redrawn in place a few
+times a second.  Otherwise a summary line is logged periodically.
+*/
+package progress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ttyInterval = 250 * time.Millisecond
+	logInterval = 30 * time.Second
+	barWidth    = 30
+)
+
+// Progress tracks the number of messages and bytes processed against
+// an expected total.
+type Progress struct {
+	w   io.Writer
+	tty bool
+	now func() time.Time
+
+	mu    sync.Mutex
+	start time.Time
+	total int64 // messages expected
+
+	// The sum of the known sizes of the expected messages, and
+	// the number of expected messages whose size is unknown.
+	knownBytes int64
+	unsized    int64
+
+	done  int64 // messages processed
+	bytes int64 // bytes processed
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// New returns a Progress expecting total messages.  The sizes of the
+// messages are expected to sum to knownBytes, except for unsized
+// messages whose sizes are not known in advance.  Output is written to
+// w, which is treated as a terminal if it is one.
+func New(w io.Writer, total, knownBytes, unsized int64) *Progress {
+	return &Progress{
+		w:          w,
+		tty:        isTerminal(w),
+		now:        time.Now,
+		total:      total,
+		knownBytes: knownBytes,
+		unsized:    unsized,
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Start begins periodic reporting.  It must be paired with a call to
+// Stop.
+func (p *Progress) Start(ctx context.Context) {
+	p.mu.Lock()
+	p.start = p.now()
+	p.mu.Unlock()
+
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+	interval := logInterval
+	if p.tty {
+		interval = ttyInterval
+	}
+	go func() {
+		defer close(p.stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				p.report(ctx)
+			}
+		}
+	}()
+}
+
+// Stop ends periodic reporting and reports the final state.
+func (p *Progress) Stop(ctx context.Context) {
+	close(p.stop)
+	<-p.stopped
+	p.report(ctx)
+	if p.tty {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// Add records that n more messages, totaling bytes in size, have been
+// processed.
+func (p *Progress) Add(n, bytes int64) {
+	p.mu.Lock()
+	p.done += n
+	p.bytes += bytes
+	p.mu.Unlock()
+}
+
+// snapshot holds a consistent view of a Progress.
+type snapshot struct {
+	done, total       int64
+	bytes, totalBytes int64
+	elapsed           time.Duration
+}
+
+func (p *Progress) snapshot() snapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := snapshot{
+		done:       p.done,
+		total:      p.total,
+		bytes:      p.bytes,
+		totalBytes: p.knownBytes,
+		elapsed:    p.now().Sub(p.start),
+	}
+	// Estimate the size of the unsized messages from the average
+	// size of those processed so far.
+	if p.unsized > 0 && p.done > 0 {
+		s.totalBytes += p.unsized * (p.bytes / p.done)
+	}
+	if s.done > s.total {
+		// More work than expected appeared along the way.
+		s.total = s.done
+	}
+	if s.bytes > s.totalBytes {
+		s.totalBytes = s.bytes
+	}
+	return s
+}
+
+// rate returns the messages processed per second.
+func (s snapshot) rate() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.done) / s.elapsed.Seconds()
+}
+
+// eta returns the estimated time remaining, or a negative duration if
+// it can not yet be estimated.
+func (s snapshot) eta() time.Duration {
+	if s.done == 0 {
+		return -1
+	}
+	remaining := float64(s.total-s.done) / s.rate()
+	return time.Duration(remaining * float64(time.Second)).Round(time.Second)
+}
+
+func (s snapshot) percent() float64 {
+	if s.total == 0 {
+		return 100
+	}
+	return 100 * float64(s.done) / float64(s.total)
+}
+
+func (s snapshot) etaString() string {
+	if eta := s.eta(); eta >= 0 {
+		return eta.String()
+	}
+	return "?"
+}
+
+// bar renders a one line progress bar.
+func (s snapshot) bar() string {
+	filled := barWidth
+	if s.total > 0 {
+		filled = int(int64(barWidth) * s.done / s.total)
+	}
+	arrow := ""
+	if filled < barWidth {
+		arrow = ">"
+	}
+	return fmt.Sprintf("[%s%s%s] %d/%d %5.1f%% %.1f msg/s %s/~%s ETA %s",
+		strings.Repeat("=", filled), arrow,
+		strings.Repeat(" ", barWidth-filled-len(arrow)),
+		s.done, s.total, s.percent(), s.rate(),
+		FormatBytes(s.bytes), FormatBytes(s.totalBytes), s.etaString())
+}
+
+func (p *Progress) report(ctx context.Context) {
+	s := p.snapshot()
+	if p.tty {
+		// Return to the start of the line and clear to its end
+		// after drawing the bar.
+		fmt.Fprintf(p.w, "\r%s\x1b[K", s.bar())
+		return
+	}
+	slog.InfoContext(ctx, "progress",
+		"done", s.done, "total", s.total,
+		"percent", fmt.Sprintf("%.1f", s.percent()),
+		"rate", fmt.Sprintf("%.1f/s", s.rate()),
+		"bytes", s.bytes, "total_bytes", s.totalBytes,
+		"eta", s.etaString())
+}
+
+// FormatBytes formats n as a human readable size using binary units.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	var buf bytes.Buffer
+	p := New(&buf, 100, 5000, 10)
+	if p.tty {
+		t.Errorf("New(&bytes.Buffer{}).tty = true, want false")
+	}
+	now := time.Unix(1000, 0)
+	p.now = func() time.Time { return now }
+	p.start = now
+
+	if got := p.snapshot().eta(); got >= 0 {
+		t.Errorf("eta() before any progress = %v, want negative", got)
+	}
+
+	p.Add(25, 1000)
+	now = now.Add(10 * time.Second)
+	s := p.snapshot()
+	if got, want := s.rate(), 2.5; got != want {
+		t.Errorf("rate() = %v, want %v", got, want)
+	}
+	if got, want := s.eta(), 30*time.Second; got != want {
+		t.Errorf("eta() = %v, want %v", got, want)
+	}
+	if got, want := s.percent(), 25.0; got != want {
+		t.Errorf("percent() = %v, want %v", got, want)
+	}
+	// 10 unsized messages at the average of 40 bytes each.
+	if got, want := s.totalBytes, int64(5400); got != want {
+		t.Errorf("totalBytes = %v, want %v", got, want)
+	}
+
+	// Processing more than expected grows the totals.
+	p.Add(100, 10000)
+	s = p.snapshot()
+	if s.total != 125 || s.totalBytes != 11000 {
+		t.Errorf("snapshot() = %+v, want total 125 and totalBytes 11000", s)
+	}
+	if got := s.eta(); got != 0 {
+		t.Errorf("eta() when done = %v, want 0", got)
+	}
+}
+
+func TestBar(t *testing.T) {
+	s := snapshot{done: 50, total: 100, bytes: 2048, totalBytes: 4096, elapsed: 10 * time.Second}
+	want := "[===============>              ] 50/100  50.0% 5.0 msg/s 2.0KiB/~4.0KiB ETA 10s"
+	if got := s.bar(); got != want {
+		t.Errorf("bar() =\n%q, want\n%q", got, want)
+	}
+	s.done = 100
+	want = "[==============================] 100/100 100.0% 10.0 msg/s 2.0KiB/~4.0KiB ETA 0s"
+	if got := s.bar(); got != want {
+		t.Errorf("bar() =\n%q, want\n%q", got, want)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536, "1.5KiB"},
+		{5 << 20, "5.0MiB"},
+		{3 << 30, "3.0GiB"},
+	}
+	for _, tc := range cases {
+		if got := FormatBytes(tc.n); got != tc.want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
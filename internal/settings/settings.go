@@ -0,0 +1,411 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package settings holds the GMail settings kept under version control
+// as a YAML document: filters, forwarding addresses, the vacation
+// responder and send-as aliases.  It works out the changes that bring
+// a mailbox's settings in line with a document, and applies them.
+package settings
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings is the settings document.
+type Settings struct {
+	Filters             []Filter `yaml:"filters"`
+	ForwardingAddresses []string `yaml:"forwarding_addresses"`
+	Vacation            Vacation `yaml:"vacation"`
+	SendAs              []SendAs `yaml:"send_as"`
+}
+
+// Filter is a GMail filter.  Filters cannot be changed, only created
+// and deleted, so they have no identity beyond their content.
+type Filter struct {
+	// The GMail ID of an existing filter, which is not part of the
+	// document.
+	ID string `yaml:"-"`
+
+	Criteria Criteria `yaml:"criteria"`
+	Action   Action   `yaml:"action"`
+}
+
+// Criteria select the messages a filter applies to.
+type Criteria struct {
+	From          string `yaml:"from,omitempty"`
+	To            string `yaml:"to,omitempty"`
+	Subject       string `yaml:"subject,omitempty"`
+	Query         string `yaml:"query,omitempty"`
+	NegatedQuery  string `yaml:"negated_query,omitempty"`
+	HasAttachment bool   `yaml:"has_attachment,omitempty"`
+	ExcludeChats  bool   `yaml:"exclude_chats,omitempty"`
+
+	// A size in bytes, compared by SizeComparison, "larger" or
+	// "smaller".
+	Size           int64  `yaml:"size,omitempty"`
+	SizeComparison string `yaml:"size_comparison,omitempty"`
+}
+
+// Action is what a filter does to the messages it applies to.  Labels
+// are named in documents, and given by ID to and from GMail.
+type Action struct {
+	AddLabels    []string `yaml:"add_labels,omitempty"`
+	RemoveLabels []string `yaml:"remove_labels,omitempty"`
+	Forward      string   `yaml:"forward,omitempty"`
+}
+
+// Vacation is the vacation responder.
+type Vacation struct {
+	Enabled      bool      `yaml:"enabled"`
+	Subject      string    `yaml:"subject,omitempty"`
+	Body         string    `yaml:"body,omitempty"`
+	HTMLBody     string    `yaml:"html_body,omitempty"`
+	ContactsOnly bool      `yaml:"contacts_only,omitempty"`
+	DomainOnly   bool      `yaml:"domain_only,omitempty"`
+	Start        time.Time `yaml:"start,omitempty"`
+	End          time.Time `yaml:"end,omitempty"`
+}
+
+// SendAs is a send-as alias.
+type SendAs struct {
+	Email        string `yaml:"email"`
+	DisplayName  string `yaml:"display_name,omitempty"`
+	ReplyTo      string `yaml:"reply_to,omitempty"`
+	Signature    string `yaml:"signature,omitempty"`
+	Default      bool   `yaml:"default,omitempty"`
+	TreatAsAlias bool   `yaml:"treat_as_alias,omitempty"`
+
+	// The account's own address, which cannot be created or
+	// deleted.
+	Primary bool `yaml:"primary,omitempty"`
+}
+
+// Read reads a settings document.  Unknown fields are an error, so
+// typos are not silently ignored.
+func Read(r io.Reader) (*Settings, error) {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	var s Settings
+	if err := dec.Decode(&s); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "malformed settings document")
+	}
+	return &s, nil
+}
+
+// Write writes s as a settings document.
+func Write(w io.Writer, s *Settings) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// NameLabels replaces the labels in the actions of s, given by ID or
+// name, with their names.  Names are matched ignoring case, as GMail
+// does.  It is an error for a label not to exist.
+func (s *Settings) NameLabels(labels []message.Label) error {
+	names := make(map[string]string, 2*len(labels))
+	for _, l := range labels {
+		names[strings.ToLower(l.Name)] = l.Name
+	}
+	for _, l := range labels {
+		names[l.ID] = l.Name
+	}
+	return s.mapLabels(func(l string) (string, bool) {
+		if name, ok := names[l]; ok {
+			return name, true
+		}
+		name, ok := names[strings.ToLower(l)]
+		return name, ok
+	})
+}
+
+// labelIDs replaces the label names in the actions of s with their
+// IDs.
+func (s *Settings) labelIDs(labels []message.Label) error {
+	ids := make(map[string]string, len(labels))
+	for _, l := range labels {
+		ids[strings.ToLower(l.Name)] = l.ID
+	}
+	return s.mapLabels(func(l string) (string, bool) {
+		id, ok := ids[strings.ToLower(l)]
+		return id, ok
+	})
+}
+
+// mapLabels replaces each label in the actions of s by fn.
+func (s *Settings) mapLabels(fn func(string) (string, bool)) error {
+	for i := range s.Filters {
+		a := &s.Filters[i].Action
+		for _, list := range []*[]string{&a.AddLabels, &a.RemoveLabels} {
+			mapped := make([]string, len(*list))
+			for j, l := range *list {
+				m, ok := fn(l)
+				if !ok {
+					return errors.Errorf("no label named %q; create it first", l)
+				}
+				mapped[j] = m
+			}
+			if len(mapped) > 0 {
+				*list = mapped
+			}
+		}
+	}
+	return nil
+}
+
+// key returns what identifies f among filters: its content, with
+// labels in order.
+func (f Filter) key() string {
+	f.ID = ""
+	f.Action.AddLabels = sorted(f.Action.AddLabels)
+	f.Action.RemoveLabels = sorted(f.Action.RemoveLabels)
+	return fmt.Sprintf("%#v", f)
+}
+
+func sorted(l []string) []string {
+	if len(l) == 0 {
+		return nil
+	}
+	l = append([]string(nil), l...)
+	sort.Strings(l)
+	return l
+}
+
+// Kind is the kind of setting a Change applies to.
+type Kind string
+
+const (
+	KindFilter            Kind = "filter"
+	KindForwardingAddress Kind = "forwarding address"
+	KindVacation          Kind = "vacation"
+	KindSendAs            Kind = "send-as"
+)
+
+// A Change is a difference between two settings documents.  Old is nil
+// for a setting added, and New for one removed.  Both are set for a
+// setting updated.
+type Change struct {
+	Kind Kind
+	Old  interface{}
+	New  interface{}
+}
+
+// Diff returns the changes that turn the settings in cur into those in
+// want.  Primary send-as addresses are never added or removed.  Filters
+// are added before those they replace are removed, so a failure part
+// way leaves mail filtered twice rather than not at all.
+func Diff(cur, want *Settings) []Change {
+	var changes []Change
+
+	// Current filters by content, less those wanted so far.
+	unmatched := make(map[string][]Filter)
+	for _, f := range cur.Filters {
+		unmatched[f.key()] = append(unmatched[f.key()], f)
+	}
+	kept := make(map[string]bool)
+	for _, f := range want.Filters {
+		if l := unmatched[f.key()]; len(l) > 0 {
+			kept[l[0].ID] = true
+			unmatched[f.key()] = l[1:]
+			continue
+		}
+		changes = append(changes, Change{Kind: KindFilter, New: f})
+	}
+	for _, f := range cur.Filters {
+		if !kept[f.ID] {
+			changes = append(changes, Change{Kind: KindFilter, Old: f})
+		}
+	}
+
+	addrs := make(map[string]bool)
+	for _, a := range want.ForwardingAddresses {
+		addrs[strings.ToLower(a)] = true
+	}
+	for _, a := range cur.ForwardingAddresses {
+		if !addrs[strings.ToLower(a)] {
+			changes = append(changes, Change{Kind: KindForwardingAddress, Old: a})
+		}
+		delete(addrs, strings.ToLower(a))
+	}
+	for _, a := range want.ForwardingAddresses {
+		if addrs[strings.ToLower(a)] {
+			changes = append(changes, Change{Kind: KindForwardingAddress, New: a})
+			delete(addrs, strings.ToLower(a))
+		}
+	}
+
+	if !cur.Vacation.equal(want.Vacation) {
+		changes = append(changes, Change{Kind: KindVacation, Old: cur.Vacation, New: want.Vacation})
+	}
+
+	wantSendAs := make(map[string]SendAs)
+	for _, a := range want.SendAs {
+		wantSendAs[strings.ToLower(a.Email)] = a
+	}
+	for _, a := range cur.SendAs {
+		w, ok := wantSendAs[strings.ToLower(a.Email)]
+		delete(wantSendAs, strings.ToLower(a.Email))
+		switch {
+		case !ok && !a.Primary:
+			changes = append(changes, Change{Kind: KindSendAs, Old: a})
+		case ok:
+			w.Primary = a.Primary
+			if w != a {
+				changes = append(changes, Change{Kind: KindSendAs, Old: a, New: w})
+			}
+		}
+	}
+	for _, a := range want.SendAs {
+		if w, ok := wantSendAs[strings.ToLower(a.Email)]; ok && !w.Primary {
+			changes = append(changes, Change{Kind: KindSendAs, New: w})
+			delete(wantSendAs, strings.ToLower(a.Email))
+		}
+	}
+	return changes
+}
+
+// equal reports whether v and w are the same, whatever the time zones
+// of their times.
+func (v Vacation) equal(w Vacation) bool {
+	if !v.Start.Equal(w.Start) || !v.End.Equal(w.End) {
+		return false
+	}
+	v.Start, v.End, w.Start, w.End = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	return reflect.DeepEqual(v, w)
+}
+
+// WriteDiff writes changes as a diff of the settings documents, each
+// setting removed prefixed by "-" and each added by "+".
+func WriteDiff(w io.Writer, changes []Change) error {
+	for _, c := range changes {
+		if _, err := fmt.Fprintf(w, "%s:\n", describe(c)); err != nil {
+			return err
+		}
+		for _, v := range []struct {
+			prefix string
+			value  interface{}
+		}{{"- ", c.Old}, {"+ ", c.New}} {
+			if v.value == nil {
+				continue
+			}
+			b, err := yaml.Marshal(v.value)
+			if err != nil {
+				return err
+			}
+			for _, line := range strings.SplitAfter(strings.TrimSuffix(string(b), "\n"), "\n") {
+				if _, err := io.WriteString(w, v.prefix+strings.TrimSuffix(line, "\n")+"\n"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Service changes the settings of a mailbox.  Filters give labels by
+// ID.
+type Service interface {
+	CreateFilter(ctx context.Context, f Filter) error
+	DeleteFilter(ctx context.Context, id string) error
+	CreateForwardingAddress(ctx context.Context, addr string) error
+	DeleteForwardingAddress(ctx context.Context, addr string) error
+	UpdateVacation(ctx context.Context, v Vacation) error
+	CreateSendAs(ctx context.Context, a SendAs) error
+	UpdateSendAs(ctx context.Context, a SendAs) error
+	DeleteSendAs(ctx context.Context, email string) error
+}
+
+// Apply makes changes, as returned by Diff, with s.  Filters name
+// labels, which must be among labels; they are checked before any
+// change is made.  Apply stops at the first change that fails,
+// returning the number made.
+func Apply(ctx context.Context, s Service, changes []Change, labels []message.Label) (int, error) {
+	var added Settings
+	for _, c := range changes {
+		if c.Kind == KindFilter && c.New != nil {
+			added.Filters = append(added.Filters, c.New.(Filter))
+		}
+	}
+	if err := added.labelIDs(labels); err != nil {
+		return 0, err
+	}
+	for i, c := range changes {
+		if err := apply(ctx, s, c, labels); err != nil {
+			return i, errors.Wrapf(err, "unable to %s", describe(c))
+		}
+	}
+	return len(changes), nil
+}
+
+func apply(ctx context.Context, s Service, c Change, labels []message.Label) error {
+	switch c.Kind {
+	case KindFilter:
+		if c.Old != nil {
+			return s.DeleteFilter(ctx, c.Old.(Filter).ID)
+		}
+		doc := Settings{Filters: []Filter{c.New.(Filter)}}
+		if err := doc.labelIDs(labels); err != nil {
+			return err
+		}
+		return s.CreateFilter(ctx, doc.Filters[0])
+	case KindForwardingAddress:
+		if c.Old != nil {
+			return s.DeleteForwardingAddress(ctx, c.Old.(string))
+		}
+		return s.CreateForwardingAddress(ctx, c.New.(string))
+	case KindVacation:
+		return s.UpdateVacation(ctx, c.New.(Vacation))
+	case KindSendAs:
+		switch {
+		case c.New == nil:
+			return s.DeleteSendAs(ctx, c.Old.(SendAs).Email)
+		case c.Old == nil:
+			return s.CreateSendAs(ctx, c.New.(SendAs))
+		}
+		return s.UpdateSendAs(ctx, c.New.(SendAs))
+	}
+	return errors.Errorf("unknown kind of setting %q", c.Kind)
+}
+
+// describe returns a short description of a change for errors.
+func describe(c Change) string {
+	verb, v := "update", c.New
+	switch {
+	case c.Old == nil:
+		verb = "add"
+	case c.New == nil:
+		verb, v = "remove", c.Old
+	}
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%s %s %s", verb, c.Kind, v)
+	case SendAs:
+		return fmt.Sprintf("%s %s %s", verb, c.Kind, v.Email)
+	}
+	return fmt.Sprintf("%s %s", verb, c.Kind)
+}
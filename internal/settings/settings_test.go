@@ -0,0 +1,262 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package settings
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matta/gotmuch/internal/message"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const doc = `filters:
+  - criteria:
+      from: list@example.com
+    action:
+      add_labels:
+        - Lists
+      remove_labels:
+        - INBOX
+  - criteria:
+      query: has:attachment
+      size: 1000000
+      size_comparison: larger
+    action:
+      forward: archive@example.com
+forwarding_addresses:
+  - archive@example.com
+vacation:
+  enabled: true
+  subject: Away
+  body: Back soon.
+  start: 2019-07-01T00:00:00Z
+send_as:
+  - email: alice@example.com
+    display_name: Alice
+    primary: true
+`
+
+var labels = []message.Label{
+	{ID: "INBOX", Name: "INBOX", Type: "system"},
+	{ID: "Label_1", Name: "Lists", Type: "user"},
+	{ID: "Label_2", Name: "Work", Type: "user"},
+}
+
+func TestReadWrite(t *testing.T) {
+	s, err := Read(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	want := &Settings{
+		Filters: []Filter{
+			{Criteria: Criteria{From: "list@example.com"}, Action: Action{AddLabels: []string{"Lists"}, RemoveLabels: []string{"INBOX"}}},
+			{Criteria: Criteria{Query: "has:attachment", Size: 1000000, SizeComparison: "larger"}, Action: Action{Forward: "archive@example.com"}},
+		},
+		ForwardingAddresses: []string{"archive@example.com"},
+		Vacation:            Vacation{Enabled: true, Subject: "Away", Body: "Back soon.", Start: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)},
+		SendAs:              []SendAs{{Email: "alice@example.com", DisplayName: "Alice", Primary: true}},
+	}
+	if diff := cmp.Diff(want, s); diff != "" {
+		t.Errorf("Read() diff (-want +got):\n%s", diff)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, s); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if diff := cmp.Diff(doc, buf.String()); diff != "" {
+		t.Errorf("Write() diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := Read(strings.NewReader("filter:\n  - {}\n")); err == nil {
+		t.Errorf("Read() of an unknown field succeeded, want an error")
+	}
+}
+
+func TestNameLabels(t *testing.T) {
+	s := &Settings{Filters: []Filter{{Action: Action{AddLabels: []string{"Label_1", "work"}, RemoveLabels: []string{"inbox"}}}}}
+	if err := s.NameLabels(labels); err != nil {
+		t.Fatalf("NameLabels() error: %v", err)
+	}
+	want := Action{AddLabels: []string{"Lists", "Work"}, RemoveLabels: []string{"INBOX"}}
+	if diff := cmp.Diff(want, s.Filters[0].Action); diff != "" {
+		t.Errorf("NameLabels() diff (-want +got):\n%s", diff)
+	}
+	if err := s.labelIDs(labels); err != nil {
+		t.Fatalf("labelIDs() error: %v", err)
+	}
+	want = Action{AddLabels: []string{"Label_1", "Label_2"}, RemoveLabels: []string{"INBOX"}}
+	if diff := cmp.Diff(want, s.Filters[0].Action); diff != "" {
+		t.Errorf("labelIDs() diff (-want +got):\n%s", diff)
+	}
+
+	s = &Settings{Filters: []Filter{{Action: Action{AddLabels: []string{"Missing"}}}}}
+	if err := s.NameLabels(labels); err == nil {
+		t.Errorf("NameLabels() of a missing label succeeded, want an error")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	keep := Filter{ID: "f1", Criteria: Criteria{From: "a@example.com"}, Action: Action{AddLabels: []string{"Lists", "Work"}}}
+	drop := Filter{ID: "f2", Criteria: Criteria{From: "b@example.com"}, Action: Action{RemoveLabels: []string{"INBOX"}}}
+	add := Filter{Criteria: Criteria{From: "c@example.com"}, Action: Action{AddLabels: []string{"Work"}}}
+	cur := &Settings{
+		Filters:             []Filter{keep, drop},
+		ForwardingAddresses: []string{"old@example.com", "kept@example.com"},
+		Vacation:            Vacation{Start: time.Date(2019, 7, 1, 2, 0, 0, 0, time.FixedZone("CEST", 7200))},
+		SendAs: []SendAs{
+			{Email: "alice@example.com", Primary: true, DisplayName: "Alice"},
+			{Email: "old@example.com"},
+			{Email: "alias@example.com", DisplayName: "A"},
+		},
+	}
+	want := &Settings{
+		// Labels in another order match.
+		Filters:             []Filter{{Criteria: keep.Criteria, Action: Action{AddLabels: []string{"Work", "Lists"}}}, add},
+		ForwardingAddresses: []string{"Kept@example.com", "new@example.com"},
+		// The same time in another zone.
+		Vacation: Vacation{Start: time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)},
+		SendAs: []SendAs{
+			{Email: "alias@example.com", DisplayName: "B"},
+			{Email: "new@example.com"},
+		},
+	}
+	got := Diff(cur, want)
+	wantChanges := []Change{
+		{Kind: KindFilter, New: add},
+		{Kind: KindFilter, Old: drop},
+		{Kind: KindForwardingAddress, Old: "old@example.com"},
+		{Kind: KindForwardingAddress, New: "new@example.com"},
+		// The primary address is kept.
+		{Kind: KindSendAs, Old: SendAs{Email: "old@example.com"}},
+		{Kind: KindSendAs, Old: SendAs{Email: "alias@example.com", DisplayName: "A"}, New: SendAs{Email: "alias@example.com", DisplayName: "B"}},
+		{Kind: KindSendAs, New: SendAs{Email: "new@example.com"}},
+	}
+	if diff := cmp.Diff(wantChanges, got); diff != "" {
+		t.Errorf("Diff() diff (-want +got):\n%s", diff)
+	}
+	if got := Diff(cur, cur); len(got) != 0 {
+		t.Errorf("Diff() of the same settings = %v, want none", got)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteDiff(&buf, got[4:6]); err != nil {
+		t.Fatalf("WriteDiff() error: %v", err)
+	}
+	wantDiff := "remove send-as old@example.com:\n" +
+		"- email: old@example.com\n" +
+		"update send-as alias@example.com:\n" +
+		"- email: alias@example.com\n" +
+		"- display_name: A\n" +
+		"+ email: alias@example.com\n" +
+		"+ display_name: B\n"
+	if diff := cmp.Diff(wantDiff, buf.String()); diff != "" {
+		t.Errorf("WriteDiff() diff (-want +got):\n%s", diff)
+	}
+}
+
+// fakeService records the calls made to it.
+type fakeService struct {
+	calls []string
+	fail  string
+}
+
+func (f *fakeService) call(format string, args ...interface{}) error {
+	c := fmt.Sprintf(format, args...)
+	if c == f.fail {
+		return fmt.Errorf("failed")
+	}
+	f.calls = append(f.calls, c)
+	return nil
+}
+
+func (f *fakeService) CreateFilter(ctx context.Context, fl Filter) error {
+	return f.call("CreateFilter %s %v", fl.Criteria.From, fl.Action.AddLabels)
+}
+func (f *fakeService) DeleteFilter(ctx context.Context, id string) error {
+	return f.call("DeleteFilter %s", id)
+}
+func (f *fakeService) CreateForwardingAddress(ctx context.Context, addr string) error {
+	return f.call("CreateForwardingAddress %s", addr)
+}
+func (f *fakeService) DeleteForwardingAddress(ctx context.Context, addr string) error {
+	return f.call("DeleteForwardingAddress %s", addr)
+}
+func (f *fakeService) UpdateVacation(ctx context.Context, v Vacation) error {
+	return f.call("UpdateVacation %v", v.Enabled)
+}
+func (f *fakeService) CreateSendAs(ctx context.Context, a SendAs) error {
+	return f.call("CreateSendAs %s", a.Email)
+}
+func (f *fakeService) UpdateSendAs(ctx context.Context, a SendAs) error {
+	return f.call("UpdateSendAs %s %s", a.Email, a.DisplayName)
+}
+func (f *fakeService) DeleteSendAs(ctx context.Context, email string) error {
+	return f.call("DeleteSendAs %s", email)
+}
+
+func TestApply(t *testing.T) {
+	changes := []Change{
+		{Kind: KindFilter, New: Filter{Criteria: Criteria{From: "c@example.com"}, Action: Action{AddLabels: []string{"Work"}}}},
+		{Kind: KindFilter, Old: Filter{ID: "f2"}},
+		{Kind: KindForwardingAddress, Old: "old@example.com"},
+		{Kind: KindForwardingAddress, New: "new@example.com"},
+		{Kind: KindVacation, Old: Vacation{}, New: Vacation{Enabled: true}},
+		{Kind: KindSendAs, Old: SendAs{Email: "old@example.com"}},
+		{Kind: KindSendAs, Old: SendAs{Email: "alias@example.com"}, New: SendAs{Email: "alias@example.com", DisplayName: "B"}},
+		{Kind: KindSendAs, New: SendAs{Email: "new@example.com"}},
+	}
+	s := &fakeService{}
+	n, err := Apply(context.Background(), s, changes, labels)
+	if err != nil || n != len(changes) {
+		t.Fatalf("Apply() = %d, %v, want %d, nil", n, err, len(changes))
+	}
+	want := []string{
+		"CreateFilter c@example.com [Label_2]",
+		"DeleteFilter f2",
+		"DeleteForwardingAddress old@example.com",
+		"CreateForwardingAddress new@example.com",
+		"UpdateVacation true",
+		"DeleteSendAs old@example.com",
+		"UpdateSendAs alias@example.com B",
+		"CreateSendAs new@example.com",
+	}
+	if diff := cmp.Diff(want, s.calls); diff != "" {
+		t.Errorf("Apply() calls diff (-want +got):\n%s", diff)
+	}
+
+	// Apply stops at the first failure.
+	s = &fakeService{fail: "CreateForwardingAddress new@example.com"}
+	n, err = Apply(context.Background(), s, changes, labels)
+	if err == nil || n != 3 {
+		t.Errorf("Apply() = %d, %v, want 3 and an error", n, err)
+	}
+
+	// Unknown labels are found before any change is made.
+	s = &fakeService{}
+	unknown := []Change{
+		{Kind: KindFilter, Old: Filter{ID: "f1"}},
+		{Kind: KindFilter, New: Filter{Action: Action{AddLabels: []string{"Nope"}}}},
+	}
+	n, err = Apply(context.Background(), s, unknown, labels)
+	if err == nil || n != 0 || len(s.calls) != 0 {
+		t.Errorf("Apply() with an unknown label = %d, %v, calls %v, want 0 and an error, no calls", n, err, s.calls)
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// This file synchronizes GMail drafts both ways.  Each draft has a
+// local copy in the notmuch drafts folder, whose digest is recorded so
+// edits made to it can be told apart.  Drafts composed in notmuch, such
+// as those saved by notmuch-emacs, are uploaded and moved to that
+// folder.
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/mail"
+	"os"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Finds the local copies of drafts sent or discarded in notmuch,
+	// which notmuch-emacs tags "deleted".
+	deletedDraftsQuery = "tag:deleted and folder:" + notmuch.DraftsFolder
+
+	// Finds drafts composed in notmuch, along with the local copies
+	// of GMail drafts, which are told apart by their paths.
+	localDraftsQuery = "tag:draft and not tag:deleted"
+)
+
+// DraftsReport describes the outcome of SyncDrafts.
+type DraftsReport struct {
+	// Drafts new or changed in GMail, downloaded.
+	Downloaded int
+
+	// Drafts new or changed locally, uploaded.
+	Uploaded int
+
+	// Drafts deleted locally, deleted from GMail.
+	Deleted int
+
+	// Drafts gone from GMail, whose local copies were removed.
+	Removed int
+
+	// Drafts changed both locally and in GMail, whose local
+	// changes were lost.
+	Conflicts int
+}
+
+// SyncDrafts synchronizes the drafts in GMail with the local copies
+// kept in the notmuch drafts folder, recording their state in db.
+// Deleting drafts from GMail counts against limits.DraftDeletions,
+// unless force is set.
+//
+// Drafts new or changed in GMail are downloaded, and the local copies
+// of those gone from GMail, having been sent or discarded, are removed.
+// Where a draft changed on both sides GMail wins.  Local copies edited
+// in place are uploaded, and drafts whose local copies are removed, or
+// tagged "deleted" in notmuch, are deleted from GMail.  Finally, other
+// messages tagged "draft" in notmuch are uploaded, as new drafts or, if
+// they share the Message-ID of a draft, as its new version, and moved
+// to the drafts folder.
+func SyncDrafts(ctx context.Context, g DraftStorage, db *persist.DB, nm *notmuch.Service, limits Limits, force bool) (*DraftsReport, error) {
+	remote, err := g.ListDrafts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := recordedDrafts(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	deleted := make(map[string]bool)
+	paths, err := nm.Files(ctx, deletedDraftsQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if id, ok := nm.DraftID(path); ok {
+			deleted[id] = true
+		}
+	}
+
+	current := make(map[string]message.Draft, len(remote))
+	for _, d := range remote {
+		current[d.DraftID] = d
+	}
+	if err := checkDraftDeletions(ctx, nm, recorded, current, deleted, limits, force); err != nil {
+		return nil, err
+	}
+	rep := &DraftsReport{}
+	for _, d := range recorded {
+		if err := syncDraft(ctx, g, db, nm, d, current, deleted[d.DraftID], rep); err != nil {
+			return rep, errors.Wrapf(err, "unable to sync draft %v", d.DraftID)
+		}
+		delete(current, d.DraftID)
+	}
+	for _, d := range remote {
+		if _, ok := current[d.DraftID]; !ok {
+			continue
+		}
+		if err := downloadDraft(ctx, g, db, nm, d.DraftID); err != nil {
+			return rep, errors.Wrapf(err, "unable to download draft %v", d.DraftID)
+		}
+		rep.Downloaded++
+	}
+
+	if recorded, err = recordedDrafts(ctx, db); err != nil {
+		return rep, err
+	}
+	byMID := make(map[string]string)
+	for _, d := range recorded {
+		if d.HeaderMessageID != "" {
+			byMID[d.HeaderMessageID] = d.DraftID
+		}
+	}
+	if paths, err = nm.Files(ctx, localDraftsQuery); err != nil {
+		return rep, err
+	}
+	for _, path := range paths {
+		if nm.Owns(path) {
+			continue
+		}
+		ok, err := uploadDraft(ctx, g, db, nm, path, byMID)
+		if err != nil {
+			return rep, errors.Wrapf(err, "unable to upload draft %s", path)
+		}
+		if ok {
+			rep.Uploaded++
+		}
+	}
+	return rep, nil
+}
+
+// recordedDrafts returns the drafts recorded in db.
+func recordedDrafts(ctx context.Context, db *persist.DB) ([]persist.Draft, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return tx.Drafts(ctx, fixmeUser)
+}
+
+// checkDraftDeletions returns an error if the drafts syncDraft would
+// delete from GMail exceed limits, or if the local copies of all of the
+// recorded drafts are missing, which suggests the drafts folder was
+// lost rather than each draft deleted.
+func checkDraftDeletions(ctx context.Context, nm *notmuch.Service, recorded []persist.Draft, current map[string]message.Draft, deleted map[string]bool, limits Limits, force bool) error {
+	var missing, deletions int64
+	for _, d := range recorded {
+		if r, ok := current[d.DraftID]; !ok || r.PermID != d.MessageID {
+			continue
+		}
+		_, err := nm.DraftDigest(d.DraftID)
+		gone := os.IsNotExist(err)
+		if err != nil && !gone {
+			return err
+		}
+		if gone {
+			missing++
+		}
+		if gone || deleted[d.DraftID] {
+			deletions++
+		}
+	}
+	if missing > 1 && missing == int64(len(recorded)) && !force {
+		return errors.Wrapf(ErrLimitExceeded, "the local copies of all %d drafts are missing", missing)
+	}
+	b := &breaker{force: force}
+	return b.check(ctx, "draft deletions", deletions, limits.DraftDeletions.of(int64(len(recorded))))
+}
+
+// syncDraft brings a recorded draft up to date, given the drafts
+// current in GMail, and whether its local copy is tagged "deleted".
+func syncDraft(ctx context.Context, g DraftStorage, db *persist.DB, nm *notmuch.Service, d persist.Draft, current map[string]message.Draft, deleted bool, rep *DraftsReport) error {
+	local, err := nm.DraftDigest(d.DraftID)
+	missing := os.IsNotExist(err)
+	if err != nil && !missing {
+		return err
+	}
+	r, ok := current[d.DraftID]
+	switch {
+	case !ok:
+		slog.InfoContext(ctx, "draft gone from GMail; removing it", "draft_id", d.DraftID)
+		if err := nm.RemoveDraft(ctx, d.DraftID); err != nil {
+			return err
+		}
+		rep.Removed++
+		return forgetDraft(ctx, db, d.DraftID)
+
+	case r.PermID != d.MessageID:
+		if !missing && local != d.Digest {
+			slog.WarnContext(ctx, "draft changed both locally and in GMail; keeping the GMail version",
+				"draft_id", d.DraftID)
+			rep.Conflicts++
+		}
+		rep.Downloaded++
+		return downloadDraft(ctx, g, db, nm, d.DraftID)
+
+	case missing || deleted:
+		slog.InfoContext(ctx, "draft deleted locally; deleting it from GMail", "draft_id", d.DraftID)
+		if err := g.DeleteDraft(ctx, d.DraftID); err != nil && !isNotFound(err) {
+			return err
+		}
+		if err := nm.RemoveDraft(ctx, d.DraftID); err != nil {
+			return err
+		}
+		rep.Deleted++
+		return forgetDraft(ctx, db, d.DraftID)
+
+	case local != d.Digest:
+		f, err := nm.OpenDraft(d.DraftID)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		u, err := g.UpdateDraft(ctx, d.DraftID, f, r.ThreadID)
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "uploaded draft edited locally", "draft_id", d.DraftID, "message_id", u.PermID)
+		d.MessageID, d.Digest = u.PermID, local
+		rep.Uploaded++
+		return recordDraft(ctx, db, d)
+	}
+	return nil
+}
+
+// downloadDraft replaces the local copy of a draft with its current
+// version in GMail, and records it.
+func downloadDraft(ctx context.Context, g DraftStorage, db *persist.DB, nm *notmuch.Service, draftID string) error {
+	var buf bytes.Buffer
+	d, err := g.DownloadDraft(ctx, draftID, &buf)
+	if err != nil {
+		return err
+	}
+	digest, err := storeDraft(ctx, nm, draftID, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "downloaded draft", "draft_id", draftID, "message_id", d.PermID)
+	return recordDraft(ctx, db, persist.Draft{
+		DraftID:         draftID,
+		MessageID:       d.PermID,
+		HeaderMessageID: headerMessageID(buf.String()),
+		Digest:          digest,
+	})
+}
+
+// uploadDraft uploads the draft composed in notmuch in the file at
+// path, as the new version of the draft byMID maps its Message-ID to,
+// if any, and otherwise as a new draft.  The file is then moved to the
+// drafts folder.  uploadDraft reports false if the file is gone, as
+// happens when the notmuch index is out of date.
+func uploadDraft(ctx context.Context, g DraftStorage, db *persist.DB, nm *notmuch.Service, path string, byMID map[string]string) (bool, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		return false, errors.Wrap(err, "malformed draft")
+	}
+	threadID, err := replyThread(ctx, db, m.Header)
+	if err != nil {
+		return false, err
+	}
+
+	mid := headerMessageID(string(content))
+	var d *message.Draft
+	if id, ok := byMID[mid]; ok && mid != "" {
+		d, err = g.UpdateDraft(ctx, id, bytes.NewReader(content), threadID)
+		if isNotFound(err) {
+			// Deleted from GMail since listed.
+			err = forgetDraft(ctx, db, id)
+			d = nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if d == nil {
+		if d, err = g.CreateDraft(ctx, bytes.NewReader(content), threadID); err != nil {
+			return false, err
+		}
+		byMID[mid] = d.DraftID
+	}
+	slog.InfoContext(ctx, "uploaded draft", "path", path, "draft_id", d.DraftID, "message_id", d.PermID)
+
+	digest, err := storeDraft(ctx, nm, d.DraftID, content)
+	if err != nil {
+		return false, err
+	}
+	err = recordDraft(ctx, db, persist.Draft{
+		DraftID:         d.DraftID,
+		MessageID:       d.PermID,
+		HeaderMessageID: mid,
+		Digest:          digest,
+	})
+	if err != nil {
+		return false, err
+	}
+	// The copy in the drafts folder has the same Message-ID, so
+	// notmuch keeps the message and its tags.
+	return true, os.Remove(path)
+}
+
+// storeDraft writes the local copy of a draft.
+func storeDraft(ctx context.Context, nm *notmuch.Service, draftID string, content []byte) (message.Digest, error) {
+	w, err := nm.CreateDraft(draftID)
+	if err != nil {
+		return message.Digest{}, err
+	}
+	if _, err := w.Write(content); err != nil {
+		w.Abort()
+		return message.Digest{}, err
+	}
+	return w.Commit(ctx)
+}
+
+// recordDraft records the state of a draft in its own transaction, so
+// it is kept should a later draft fail.
+func recordDraft(ctx context.Context, db *persist.DB, d persist.Draft) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.PutDraft(ctx, fixmeUser, d); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// forgetDraft forgets a draft in its own transaction.
+func forgetDraft(ctx context.Context, db *persist.DB, draftID string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.DeleteDraft(ctx, fixmeUser, draftID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+)
+
+func TestSyncDrafts(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "drafts.json", t)
+	defer f.CloseOrFatal()
+
+	got, err := SyncDrafts(ctx, f.g, f.db, f.nm, Limits{}, false)
+	if err != nil {
+		t.Fatalf("SyncDrafts() error %v", err)
+	}
+	if diff := cmp.Diff(&DraftsReport{Downloaded: 2}, got); diff != "" {
+		t.Errorf("first SyncDrafts() report differs (-want +got):\n%s", diff)
+	}
+
+	// With every local copy missing, the drafts folder is more
+	// likely lost than each draft deleted.
+	for _, id := range []string{"r1", "r2"} {
+		if err := f.nm.RemoveDraft(ctx, id); err != nil {
+			t.Fatalf("RemoveDraft() error %v", err)
+		}
+	}
+	_, err = SyncDrafts(ctx, f.g, f.db, f.nm, Limits{}, false)
+	if errors.Cause(err) != ErrLimitExceeded {
+		t.Fatalf("SyncDrafts() error = %v, want %v", err, ErrLimitExceeded)
+	}
+
+	// Editing r1 leaves one deletion, still over the limit.  The
+	// limit on local deletions does not apply to drafts.
+	w, err := f.nm.CreateDraft("r1")
+	if err != nil {
+		t.Fatalf("CreateDraft() error %v", err)
+	}
+	if _, err := w.Write([]byte("Subject: Draft one\r\nMessage-ID: <d1@example.com>\r\n\r\nDone.\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Commit(ctx); err != nil {
+		t.Fatalf("Commit() error %v", err)
+	}
+	limits := Limits{Deletions: "1", DraftDeletions: "0"}
+	_, err = SyncDrafts(ctx, f.g, f.db, f.nm, limits, false)
+	if errors.Cause(err) != ErrLimitExceeded {
+		t.Fatalf("SyncDrafts() error = %v, want %v", err, ErrLimitExceeded)
+	}
+
+	got, err = SyncDrafts(ctx, f.g, f.db, f.nm, limits, true)
+	if err != nil {
+		t.Fatalf("SyncDrafts() error %v", err)
+	}
+	if diff := cmp.Diff(&DraftsReport{Uploaded: 1, Deleted: 1}, got); diff != "" {
+		t.Errorf("forced SyncDrafts() report differs (-want +got):\n%s", diff)
+	}
+	recorded, err := recordedDrafts(ctx, f.db)
+	if err != nil {
+		t.Fatalf("recordedDrafts() error %v", err)
+	}
+	if len(recorded) != 1 || recorded[0].DraftID != "r1" || recorded[0].MessageID != "m51" {
+		t.Errorf("recorded drafts = %+v, want r1 as message m51", recorded)
+	}
+}
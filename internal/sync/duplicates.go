@@ -0,0 +1,215 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// This file handles GMail messages that share a Message-ID, such as
+// the sent and received copies of a message, or copies delivered by
+// several mailing lists.  notmuch merges them into one message with
+// several files, so the labels of the copies must be merged too.
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/metrics"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+var duplicateMessageIDs = metrics.NewGauge("gotmuch_duplicate_message_ids",
+	"Message-IDs shared by several stored GMail messages, as of the last sync.")
+
+// LabelMerge names the policy deciding the labels of a notmuch message
+// merged from several GMail messages.
+type LabelMerge string
+
+const (
+	// MergeUnion gives a merged message the labels of any copy.
+	MergeUnion LabelMerge = "union"
+
+	// MergeIntersection gives a merged message the labels of every
+	// copy.
+	MergeIntersection LabelMerge = "intersection"
+)
+
+// ParseLabelMerge validates the name of a label merge policy.
+func ParseLabelMerge(s string) (LabelMerge, error) {
+	switch m := LabelMerge(s); m {
+	case MergeUnion, MergeIntersection:
+		return m, nil
+	}
+	return "", errors.Errorf("unknown label merge policy %q; want %s or %s",
+		s, MergeUnion, MergeIntersection)
+}
+
+// merge returns the labels of a message merged from copies with the
+// given labels, sorted.
+func (m LabelMerge) merge(labels [][]string) []string {
+	count := make(map[string]int)
+	for _, l := range labels {
+		seen := make(map[string]bool)
+		for _, name := range l {
+			if !seen[name] {
+				seen[name] = true
+				count[name]++
+			}
+		}
+	}
+	merged := []string{}
+	for name, n := range count {
+		if m == MergeUnion || n == len(labels) {
+			merged = append(merged, name)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// Copy is one of the GMail messages merged by notmuch.
+type Copy struct {
+	PermID string
+
+	// The names of the copy's labels.
+	Labels []string
+}
+
+// Duplicate describes GMail messages notmuch merges into one.
+type Duplicate struct {
+	// The Message-ID the copies share.
+	MessageID string
+
+	Copies []Copy
+
+	// The labels of the merged message under the policy.
+	Labels []string
+}
+
+// Duplicates returns the stored GMail messages that notmuch merges, by
+// Message-ID, with their labels merged under policy.
+func Duplicates(ctx context.Context, db *persist.DB, policy LabelMerge) ([]Duplicate, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	labels, err := tx.Labels(ctx, fixmeUser)
+	if err != nil {
+		return nil, err
+	}
+	names := labelNames(labels)
+
+	var dups []Duplicate
+	err = tx.ListDuplicates(ctx, fixmeUser, func(mid string, ids []string) error {
+		dups = append(dups, Duplicate{MessageID: mid})
+		for _, id := range ids {
+			dups[len(dups)-1].Copies = append(dups[len(dups)-1].Copies, Copy{PermID: id})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range dups {
+		d := &dups[i]
+		var sets [][]string
+		for j := range d.Copies {
+			c := &d.Copies[j]
+			ids, err := tx.MessageLabels(ctx, fixmeUser, c.PermID)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				name := names[id]
+				if name == "" {
+					name = id
+				}
+				c.Labels = append(c.Labels, name)
+			}
+			sort.Strings(c.Labels)
+			sets = append(sets, c.Labels)
+		}
+		d.Labels = policy.merge(sets)
+	}
+	return dups, nil
+}
+
+// recordFile records the digest and Message-ID of the file last written
+// for a message.  The zero Digest records that no file is stored.
+func recordFile(ctx context.Context, tx *persist.Tx, nm *notmuch.Service, permID string, digest message.Digest) error {
+	if err := tx.SetDigest(ctx, fixmeUser, permID, digest); err != nil {
+		return err
+	}
+	var mid string
+	if digest != (message.Digest{}) {
+		var err error
+		if mid, err = nm.MessageID(permID); err != nil {
+			return errors.Wrapf(err, "unable to read message %v", permID)
+		}
+	}
+	return tx.SetHeaderMessageID(ctx, fixmeUser, permID, mid)
+}
+
+// checkDuplicates logs and counts the Message-IDs shared by several
+// stored messages, first recording the Message-IDs of any stored
+// messages missing one.
+func checkDuplicates(ctx context.Context, db *persist.DB, nm *notmuch.Service) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var unidentified []string
+	err = tx.ListUnidentified(ctx, fixmeUser, func(permID string) error {
+		unidentified = append(unidentified, permID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range unidentified {
+		if !nm.HaveMessage(id) {
+			continue
+		}
+		mid, err := nm.MessageID(id)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read message %v", id)
+		}
+		if err := tx.SetHeaderMessageID(ctx, fixmeUser, id, mid); err != nil {
+			return err
+		}
+	}
+
+	n := 0
+	err = tx.ListDuplicates(ctx, fixmeUser, func(mid string, ids []string) error {
+		n++
+		slog.DebugContext(ctx, "messages share a Message-ID", "header_message_id", mid, "copies", ids)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	duplicateMessageIDs.Set(float64(n))
+	if n > 0 {
+		slog.InfoContext(ctx, "some messages share a Message-ID and are merged by notmuch; see \"gotmuch duplicates\"",
+			"count", n)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"time"
+
+	"github.com/matta/gotmuch/internal/export"
+	"github.com/matta/gotmuch/internal/gmail"
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+// ExportReport describes the outcome of Export.
+type ExportReport struct {
+	// Messages added to the archive.
+	Exported int
+
+	// Messages stored only in part by the sync policy, which were
+	// left out.  "gotmuch fetch" stores them in full.
+	Partial int
+}
+
+// Export adds the messages stored in full in nm to a, in order of
+// receipt, with X-Gmail-* headers holding the GMail IDs and labels last
+// recorded in db.  If label is not empty, only messages with that
+// label, given by name or ID, are added.  If since is not zero, only
+// messages received since then are.
+func Export(ctx context.Context, db *persist.DB, nm *notmuch.Service, a export.Archive, label string, since time.Time) (*ExportReport, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	labels, err := tx.Labels(ctx, fixmeUser)
+	if err != nil {
+		return nil, err
+	}
+	var scope gmail.Scope
+	if label != "" {
+		if scope, err = (gmail.Scope{Include: []string{label}}).Resolve(labels); err != nil {
+			return nil, err
+		}
+	}
+	names := labelNames(labels)
+
+	var ids []message.ID
+	var dates []time.Time
+	err = tx.ListReceivedSince(ctx, fixmeUser, since, func(id message.ID, received time.Time) error {
+		if nm.HaveMessage(id.PermID) {
+			ids = append(ids, id)
+			dates = append(dates, received)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rep := &ExportReport{}
+	for i, id := range ids {
+		labelIDs, err := tx.MessageLabels(ctx, fixmeUser, id.PermID)
+		if err != nil {
+			return rep, err
+		}
+		if !scope.Match(labelIDs) {
+			continue
+		}
+		state, err := tx.FetchState(ctx, fixmeUser, id.PermID)
+		if err != nil {
+			return rep, err
+		}
+		if state != "" && state != persist.FetchFull {
+			rep.Partial++
+			continue
+		}
+		m := &export.Message{
+			PermID:   id.PermID,
+			Received: dates[i],
+			LabelIDs: labelIDs,
+			Fields:   gmailHeaders(&message.Header{ID: id, LabelIDs: labelIDs}, names),
+		}
+		if err := exportMessage(nm, a, m); err != nil {
+			return rep, errors.Wrapf(err, "unable to export message %v", id.PermID)
+		}
+		rep.Exported++
+	}
+	return rep, nil
+}
+
+func exportMessage(nm *notmuch.Service, a export.Archive, m *export.Message) error {
+	f, err := nm.Open(m.PermID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return a.Add(m, f)
+}
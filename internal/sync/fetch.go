@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+// Fetch downloads messages in full, replacing any partial copies
+// stored under the sync policy.  Each target is either a GMail message
+// ID or a notmuch query.  Only the header options in opts apply.
+func Fetch(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service, targets []string, opts Options) error {
+	ids, err := resolveTargets(ctx, db, nm, targets)
+	if err != nil {
+		return err
+	}
+	if opts.GmailHeaders {
+		if opts.labelNames, err = knownLabelNames(ctx, db); err != nil {
+			return err
+		}
+	}
+	if len(ids) == 0 {
+		return errors.New("no known messages match")
+	}
+	for _, id := range ids {
+		if err := storeMessage(ctx, g, db, nm, id, persist.FetchFull, &opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveTargets returns the IDs of the known messages named by
+// targets, without duplicates.
+func resolveTargets(ctx context.Context, db *persist.DB, nm *notmuch.Service, targets []string) ([]string, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var ids []string
+	seen := make(map[string]bool)
+	add := func(permID string) {
+		if !seen[permID] {
+			seen[permID] = true
+			ids = append(ids, permID)
+		}
+	}
+	for _, target := range targets {
+		id, err := tx.LookupMessage(ctx, fixmeUser, target)
+		if err != nil {
+			return nil, err
+		}
+		if id != nil {
+			add(id.PermID)
+			continue
+		}
+		found, err := nm.Search(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		for _, permID := range found {
+			id, err := tx.LookupMessage(ctx, fixmeUser, permID)
+			if err != nil {
+				return nil, err
+			}
+			if id == nil {
+				slog.WarnContext(ctx, "skipping message unknown to the database", "message_id", permID)
+				continue
+			}
+			add(id.PermID)
+		}
+	}
+	return ids, nil
+}
+
+// storeMessage downloads the part of a message called for by state,
+// which is not persist.FetchSkipped, and stores it in nm, replacing any
+// existing copy.
+func storeMessage(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service, permID, state string, opts *Options) error {
+	existed := nm.HaveMessage(permID)
+	var hdr *message.Header
+	var digest message.Digest
+	var size int64
+	var err error
+	if state == persist.FetchFull {
+		hdr, digest, size, err = downloadMessage(ctx, g, nm, permID, opts)
+	} else {
+		var msg *message.Body
+		msg, err = g.GetMessageMetadata(ctx, permID)
+		if err == nil {
+			hdr, size = &msg.Header, int64(len(msg.Raw))
+			digest, err = nm.Insert(ctx, decorate(stub(msg, state), opts))
+		}
+	}
+	if isNotFound(err) {
+		return errors.Errorf("message %v is no longer in GMail", permID)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to store message %v", permID)
+	}
+	if err := nm.Index(ctx, permID, existed); err != nil {
+		return errors.Wrapf(err, "unable to index message %v", permID)
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.UpdateHeader(ctx, fixmeUser, hdr); err != nil {
+		return err
+	}
+	if err := tx.SetFetchState(ctx, fixmeUser, permID, state); err != nil {
+		return err
+	}
+	if err := recordFile(ctx, tx, nm, permID, digest); err != nil {
+		return err
+	}
+	if state == persist.FetchFull {
+		messagesFetched.Inc()
+		bytesFetched.Add(float64(size))
+	}
+	slog.InfoContext(ctx, "stored message", "message_id", permID, "state", state, "bytes", size)
+	return tx.Commit()
+}
+
+// knownLabelNames returns the label names recorded by the last sync,
+// by ID.
+func knownLabelNames(ctx context.Context, db *persist.DB) (map[string]string, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	labels, err := tx.Labels(ctx, fixmeUser)
+	if err != nil {
+		return nil, err
+	}
+	return labelNames(labels), nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/persist"
+)
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "fetch.json", t)
+	defer f.CloseOrFatal()
+	f.Store(ctx, message.Header{ID: message.ID{PermID: "m5", ThreadID: "t5"}, LabelIDs: []string{"INBOX"}, HistoryID: 150},
+		"Subject: Big\r\n\r\n", persist.FetchHeaders)
+	f.Respond(f.StoredPath("m5")+"\n", "search", "--output=files", "subject:big")
+
+	if err := Fetch(ctx, f.g, f.db, f.nm, []string{"subject:big"}, Options{}); err != nil {
+		t.Fatalf("Fetch() error %v", err)
+	}
+	if got := f.FetchState(ctx, "m5"); got != persist.FetchFull {
+		t.Errorf("fetch state of m5 = %q, want %q", got, persist.FetchFull)
+	}
+	if got := f.ReadStored("m5"); !strings.Contains(got, "A very large body.") {
+		t.Errorf("stored copy of m5 lacks its body:\n%s", got)
+	}
+	// m5 has no Message-ID, so notmuch knows it by the one added
+	// when it was written.
+	reindex := `reindex id:"gmail-m5@gotmuch.invalid"`
+	if calls := f.NotmuchCalls(); !slices.Contains(calls, reindex) {
+		t.Errorf("notmuch was run with %q, want a run with %q", calls, reindex)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// This file adds headers carrying GMail metadata to messages before
+// they are stored.
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/message"
+)
+
+// decorate returns msg with the extra headers requested by opts.
+func decorate(msg *message.Body, opts *Options) *message.Body {
+	return msg.PrependHeaders(extraHeaders(&msg.Header, opts)...)
+}
+
+// extraHeaders returns the extra headers requested by opts for a
+// message.
+func extraHeaders(hdr *message.Header, opts *Options) []message.HeaderField {
+	var fields []message.HeaderField
+	if opts.ThreadHeader && hdr.ThreadID != "" {
+		fields = append(fields, message.HeaderField{Name: "X-GM-THRID", Value: imapID(hdr.ThreadID)})
+	}
+	if opts.GmailHeaders {
+		fields = append(fields, gmailHeaders(hdr, opts.labelNames)...)
+	}
+	return fields
+}
+
+// gmailHeaders returns the X-Gmail-* headers describing hdr.  Labels
+// are given by name where known, in the order GMail lists them.
+func gmailHeaders(hdr *message.Header, names map[string]string) []message.HeaderField {
+	labels := make([]string, 0, len(hdr.LabelIDs))
+	for _, id := range hdr.LabelIDs {
+		name := names[id]
+		if name == "" {
+			name = id
+		}
+		labels = append(labels, name)
+	}
+	fields := []message.HeaderField{
+		{Name: "X-Gmail-Message-Id", Value: hdr.PermID},
+		{Name: "X-Gmail-Thread-Id", Value: hdr.ThreadID},
+		{Name: "X-Gmail-Labels", Value: mime.QEncoding.Encode("utf-8", strings.Join(labels, ","))},
+	}
+	if hdr.HistoryID != 0 {
+		fields = append(fields, message.HeaderField{
+			Name: "X-Gmail-History-Id", Value: strconv.FormatUint(hdr.HistoryID, 10)})
+	}
+	return fields
+}
+
+// labelNames returns a map from label ID to name.
+func labelNames(labels []message.Label) map[string]string {
+	names := make(map[string]string, len(labels))
+	for _, l := range labels {
+		if l.Name != "" {
+			names[l.ID] = l.Name
+		}
+	}
+	return names
+}
+
+// imapID converts a GMail API message or thread ID, which is
+// hexadecimal, to the decimal form used by GMail's IMAP extensions.
+func imapID(id string) string {
+	n, err := strconv.ParseUint(id, 16, 64)
+	if err != nil {
+		return id
+	}
+	return strconv.FormatUint(n, 10)
+}
@@ -0,0 +1,223 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// This file implements safety limits on the changes a sync makes, so a
+// bug or a mistaken scope does not wipe out a mailbox.
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/gmail"
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLimitExceeded is the cause of errors returned when a sync would
+// make more changes than its Limits allow.
+var ErrLimitExceeded = errors.New("safety limit exceeded; rerun with -force to allow it")
+
+// A Limit caps the number of changes of some kind a sync makes, either
+// absolutely, e.g. "500", or as a percentage of the messages known when
+// the sync starts, e.g. "5%".  The empty Limit allows any number.
+type Limit string
+
+// ParseLimit validates a Limit.
+func ParseLimit(s string) (Limit, error) {
+	if s == "" {
+		return "", nil
+	}
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		if f, err := strconv.ParseFloat(p, 64); err != nil || f < 0 || f > 100 {
+			return "", errors.Errorf("invalid limit %q; want a percentage from 0%% to 100%%", s)
+		}
+		return Limit(s), nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err != nil || n < 0 {
+		return "", errors.Errorf("invalid limit %q; want a count or a percentage", s)
+	}
+	return Limit(s), nil
+}
+
+// of returns the number of changes l allows in a mailbox of total
+// messages, or -1 if it allows any number.  l must be valid.
+func (l Limit) of(total int64) int64 {
+	if l == "" {
+		return -1
+	}
+	if p, ok := strings.CutSuffix(string(l), "%"); ok {
+		f, _ := strconv.ParseFloat(p, 64)
+		return int64(f * float64(total) / 100)
+	}
+	n, _ := strconv.ParseInt(string(l), 10, 64)
+	return n
+}
+
+// Limits are the safety limits of a sync.  Sync makes no changes to
+// GMail, so only its local changes are limited.  SyncDrafts, which
+// deletes drafts from GMail, has a limit of its own.
+type Limits struct {
+	// Deletions limits the local copies removed, whether because
+	// the message was deleted from GMail, fell out of scope or was
+	// evicted.
+	Deletions Limit
+
+	// LabelRemovals limits the messages that lose one or more
+	// labels.
+	LabelRemovals Limit
+
+	// DraftDeletions limits the drafts SyncDrafts deletes from
+	// GMail, as a count or a percentage of the drafts recorded.
+	DraftDeletions Limit
+}
+
+// breaker counts the changes a sync would make, failing once a limit
+// is exceeded.  The nil breaker allows any number of changes.
+type breaker struct {
+	force  bool
+	warned bool // Set once a forced change is logged.
+
+	maxDeletions, maxLabelRemovals int64 // -1 for no limit.
+	deletions, labelRemovals       int64
+}
+
+// newBreaker returns a breaker enforcing limits in a mailbox of total
+// messages.  If force is set, changes over the limits are logged but
+// allowed.
+func newBreaker(limits Limits, force bool, total int64) *breaker {
+	return &breaker{
+		force:            force,
+		maxDeletions:     limits.Deletions.of(total),
+		maxLabelRemovals: limits.LabelRemovals.of(total),
+	}
+}
+
+// limited returns true if b limits some kind of change.
+func (b *breaker) limited() bool {
+	return b != nil && (b.maxDeletions >= 0 || b.maxLabelRemovals >= 0)
+}
+
+// delete counts n deletions.
+func (b *breaker) delete(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+	b.deletions += n
+	return b.check(ctx, "deletions", b.deletions, b.maxDeletions)
+}
+
+// removeLabels counts a message losing labels.
+func (b *breaker) removeLabels(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.labelRemovals++
+	return b.check(ctx, "label removals", b.labelRemovals, b.maxLabelRemovals)
+}
+
+func (b *breaker) check(ctx context.Context, what string, n, max int64) error {
+	if max < 0 || n <= max {
+		return nil
+	}
+	if b.force {
+		if !b.warned {
+			b.warned = true
+			slog.WarnContext(ctx, "safety limit exceeded; continuing since forced",
+				"changes", what, "limit", max)
+		}
+		return nil
+	}
+	return errors.Wrapf(ErrLimitExceeded, "%d %s exceed the limit of %d", n, what, max)
+}
+
+// precheck counts the deletions and label removals that downloading
+// the messages listed in tx would make, so that a sync over its limits
+// fails before anything is written.  The headers of messages stored or
+// recorded are fetched for this, and kept in st so the download phase
+// decides on the same ones.
+func precheck(ctx context.Context, g MessageStorage, tx *persist.Tx, nm *notmuch.Service, st *stats, opts *Options) error {
+	if !st.limits.limited() {
+		return nil
+	}
+	var ids []string
+	// A negative limit lists every message.
+	err := tx.ListUpdated(ctx, fixmeUser, -1, func(id message.ID) error {
+		ids = append(ids, id.PermID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	st.headers = make(map[string]*message.Header)
+	for _, id := range ids {
+		haveBody := nm.HaveMessage(id)
+		recorded, err := tx.HasHeader(ctx, fixmeUser, id)
+		if err != nil {
+			return err
+		}
+		if !haveBody && !recorded {
+			// New messages change nothing stored.
+			continue
+		}
+		hdr, err := g.GetMessageHeader(ctx, id)
+		if isNotFound(err) {
+			st.headers[id] = nil
+			if haveBody {
+				if err := st.limits.delete(ctx, 1); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed getting header of message %v", id)
+		}
+		st.headers[id] = hdr
+		if haveBody && opts.Prune && !opts.Scope.Match(hdr.LabelIDs) {
+			if err := st.limits.delete(ctx, 1); err != nil {
+				return err
+			}
+			continue
+		}
+		old, err := tx.MessageLabels(ctx, fixmeUser, id)
+		if err != nil {
+			return err
+		}
+		if removesLabels(old, hdr.LabelIDs) {
+			if err := st.limits.removeLabels(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getHeader returns the header of a message, as fetched by precheck if
+// it was.
+func getHeader(ctx context.Context, g MessageStorage, st *stats, permID string) (*message.Header, error) {
+	if hdr, ok := st.headers[permID]; ok {
+		if hdr == nil {
+			return nil, gmail.ErrMessageNotFound
+		}
+		return hdr, nil
+	}
+	return g.GetMessageHeader(ctx, permID)
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in    string
+		total int64
+		want  int64
+		ok    bool
+	}{
+		{"", 1000, -1, true},
+		{"0", 1000, 0, true},
+		{"500", 1000, 500, true},
+		{"5%", 1000, 50, true},
+		{"0.5%", 1000, 5, true},
+		{"-1", 1000, 0, false},
+		{"101%", 1000, 0, false},
+		{"many", 1000, 0, false},
+	}
+	for _, tc := range tests {
+		l, err := ParseLimit(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("ParseLimit(%q) error = %v, want ok %v", tc.in, err, tc.ok)
+			continue
+		}
+		if err == nil && l.of(tc.total) != tc.want {
+			t.Errorf("ParseLimit(%q).of(%d) = %d, want %d", tc.in, tc.total, l.of(tc.total), tc.want)
+		}
+	}
+}
+
+func TestSyncLimits(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "limits.json", t)
+	defer f.CloseOrFatal()
+	f.storeInboxAndWork(ctx)
+
+	// GMail removed INBOX from m1, which the limit refuses before
+	// the new m7 is downloaded.
+	opts := Options{Limits: Limits{LabelRemovals: "0"}}
+	err := Sync(ctx, f.g, f.db, f.nm, opts)
+	if errors.Cause(err) != ErrLimitExceeded {
+		t.Fatalf("Sync() error = %v, want %v", err, ErrLimitExceeded)
+	}
+	if got := f.LastRun(ctx).Status; got != persist.RunFailed {
+		t.Errorf("run status = %q, want %q", got, persist.RunFailed)
+	}
+	if got, _ := f.Recorded(ctx, "m1"); !cmp.Equal(got, []string{"INBOX"}) {
+		t.Errorf("labels of m1 = %v after a refused sync, want [INBOX]", got)
+	}
+	if f.nm.HaveMessage("m7") {
+		t.Errorf("message m7 was downloaded by a refused sync")
+	}
+
+	// Forced, the sync goes over the limit.
+	opts.Force = true
+	f.SyncOrFatal(ctx, opts)
+	want := runCounts{Status: persist.RunOK, Listed: 2, Fetched: 1, LabelsChanged: 1}
+	if diff := cmp.Diff(want, countsOf(f.LastRun(ctx))); diff != "" {
+		t.Errorf("forced run counts differ (-want +got):\n%s", diff)
+	}
+	if got, _ := f.Recorded(ctx, "m1"); len(got) != 0 {
+		t.Errorf("labels of m1 = %v, want none", got)
+	}
+	if !f.nm.HaveMessage("m7") {
+		t.Errorf("message m7 is not stored after a forced sync")
+	}
+}
+
+func TestSyncDeletionLimit(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "deletions.json", t)
+	defer f.CloseOrFatal()
+	f.storeInboxAndWork(ctx)
+
+	// m3 is gone from GMail, and removing its copy is refused.
+	err := Sync(ctx, f.g, f.db, f.nm, Options{Limits: Limits{Deletions: "0"}})
+	if errors.Cause(err) != ErrLimitExceeded {
+		t.Fatalf("Sync() error = %v, want %v", err, ErrLimitExceeded)
+	}
+	if !f.nm.HaveMessage("m3") {
+		t.Errorf("message m3 was removed by a refused sync")
+	}
+	if _, ok := f.Recorded(ctx, "m3"); !ok {
+		t.Errorf("message m3 was forgotten by a refused sync")
+	}
+}
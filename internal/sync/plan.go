@@ -0,0 +1,193 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// This file implements plans, which collect the local copies the
+// listing phases of a sync remove so they can be checked first, and dry
+// runs, which go through those phases without writing anything and
+// report what a sync would do.
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+// Removal is a local copy of a message a sync would remove.
+type Removal struct {
+	PermID string `json:"message_id"`
+	Reason string `json:"reason"`
+
+	evicted bool // Set if the message aged out of the sync window.
+}
+
+// Refresh is a stored message whose labels a sync would refresh.
+// Labels are given by name, or by ID for those GMail did not name.
+type Refresh struct {
+	PermID  string   `json:"message_id"`
+	Added   []string `json:"labels_added"`
+	Removed []string `json:"labels_removed"`
+}
+
+// Plan describes what a sync would do.  gotmuch changes neither notmuch
+// tags nor GMail labels, so a Plan holds only changes to message files
+// and to the labels recorded for them.
+type Plan struct {
+	// Messages that would be downloaded and added.
+	Add []string `json:"add"`
+
+	// Stored messages that GMail reports as changed.  Their labels
+	// would be refreshed, and their files replaced if the sync
+	// policy calls for it.
+	Refresh []Refresh `json:"refresh"`
+
+	// Local copies that would be removed.
+	Remove []Removal `json:"remove"`
+
+	mu sync.Mutex // Guards Remove, which download workers add to.
+}
+
+// remove adds the removal of a message's local copy, if it has one.
+func (p *Plan) remove(nm *notmuch.Service, permID, reason string) {
+	if nm.HaveMessage(permID) {
+		p.add(Removal{PermID: permID, Reason: reason})
+	}
+}
+
+// evict adds the eviction of a message's local copy, if it has one.
+func (p *Plan) evict(nm *notmuch.Service, permID, reason string) {
+	if nm.HaveMessage(permID) {
+		p.add(Removal{PermID: permID, Reason: reason, evicted: true})
+	}
+}
+
+func (p *Plan) add(r Removal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Remove = append(p.Remove, r)
+}
+
+// apply removes the local copies in p.Remove from nm.
+func (p *Plan) apply(ctx context.Context, nm *notmuch.Service) error {
+	evicted := 0
+	for _, r := range p.Remove {
+		if err := nm.Remove(ctx, r.PermID); err != nil {
+			return errors.Wrapf(err, "unable to remove message %v", r.PermID)
+		}
+		if r.evicted {
+			evicted++
+			policyDecisions.Inc("evicted")
+		}
+	}
+	if evicted > 0 {
+		slog.InfoContext(ctx, "evicted messages older than the sync window", "count", evicted)
+	}
+	return nil
+}
+
+// DryRun lists messages as Sync would, and returns what it would do
+// with them.  It reads from GMail, db and nm but writes to none of
+// them.  Messages are not downloaded, so the decisions of the sync
+// policy, which depend on their headers, are not known.  The headers
+// of stored messages GMail reports as changed are fetched, to find
+// their label changes.
+func DryRun(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service, opts Options) (*Plan, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Everything is done in tx, which is never committed, so each
+	// phase sees the changes of those before it.
+	defer tx.Rollback()
+
+	plan := &Plan{Add: []string{}, Refresh: []Refresh{}, Remove: []Removal{}}
+	if err := planList(ctx, g, tx, nm, &stats{}, &opts, plan); err != nil {
+		return nil, err
+	}
+	// A negative limit lists every message.
+	var stored []string
+	err = tx.ListUpdated(ctx, fixmeUser, -1, func(id message.ID) error {
+		if nm.HaveMessage(id.PermID) {
+			stored = append(stored, id.PermID)
+		} else {
+			plan.Add = append(plan.Add, id.PermID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range stored {
+		r, err := planRefresh(ctx, g, tx, id, opts.labelNames)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			plan.remove(nm, id, "deleted from GMail")
+			continue
+		}
+		plan.Refresh = append(plan.Refresh, *r)
+	}
+	slog.InfoContext(ctx, "dry run complete; nothing was written", "add", len(plan.Add),
+		"refresh", len(plan.Refresh), "remove", len(plan.Remove))
+	return plan, nil
+}
+
+// planRefresh fetches the header of a stored message and compares its
+// labels with those recorded.  It returns nil if the message is no
+// longer in GMail.
+func planRefresh(ctx context.Context, g MessageStorage, tx *persist.Tx, permID string, names map[string]string) (*Refresh, error) {
+	old, err := tx.MessageLabels(ctx, fixmeUser, permID)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := g.GetMessageHeader(ctx, permID)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed getting header of message %v", permID)
+	}
+	return &Refresh{
+		PermID:  permID,
+		Added:   labelsMissing(hdr.LabelIDs, old, names),
+		Removed: labelsMissing(old, hdr.LabelIDs, names),
+	}, nil
+}
+
+// labelsMissing returns the names of the labels in a but not in b.
+func labelsMissing(a, b []string, names map[string]string) []string {
+	set := make(map[string]bool, len(b))
+	for _, l := range b {
+		set[l] = true
+	}
+	missing := []string{}
+	for _, l := range a {
+		if set[l] {
+			continue
+		}
+		if name, ok := names[l]; ok {
+			l = name
+		}
+		missing = append(missing, l)
+	}
+	return missing
+}
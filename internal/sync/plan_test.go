@@ -0,0 +1,87 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/gmail"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// ignorePlanState ignores the fields of a Plan that only a sync uses.
+var ignorePlanState = cmpopts.IgnoreUnexported(Plan{}, Removal{})
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "plan.json", t)
+	defer f.CloseOrFatal()
+	f.storeInboxAndWork(ctx)
+
+	opts := Options{Scope: gmail.Scope{Include: []string{"Work"}}, Prune: true}
+	got, err := DryRun(ctx, f.g, f.db, f.nm, opts)
+	if err != nil {
+		t.Fatalf("DryRun() error %v", err)
+	}
+	want := &Plan{
+		Add:     []string{},
+		Refresh: []Refresh{},
+		Remove:  []Removal{{PermID: "m1", Reason: "out of scope"}},
+	}
+	if diff := cmp.Diff(want, got, ignorePlanState); diff != "" {
+		t.Errorf("DryRun() plan differs (-want +got):\n%s", diff)
+	}
+
+	// Nothing was written.
+	if !f.nm.HaveMessage("m1") {
+		t.Errorf("message m1 was removed by a dry run")
+	}
+	if _, ok := f.Recorded(ctx, "m1"); !ok {
+		t.Errorf("message m1 was forgotten by a dry run")
+	}
+	if got := f.Setting(ctx, scopeSetting); got != "all" {
+		t.Errorf("scope setting = %q after a dry run, want \"all\"", got)
+	}
+}
+
+func TestDryRunLabels(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "planlabels.json", t)
+	defer f.CloseOrFatal()
+	f.storeInboxAndWork(ctx)
+
+	// m1 moved from the inbox to the starred, m3 is no longer in
+	// GMail, and m7 is new.
+	got, err := DryRun(ctx, f.g, f.db, f.nm, Options{})
+	if err != nil {
+		t.Fatalf("DryRun() error %v", err)
+	}
+	want := &Plan{
+		Add: []string{"m7"},
+		Refresh: []Refresh{
+			{PermID: "m1", Added: []string{"STARRED"}, Removed: []string{"INBOX"}},
+		},
+		Remove: []Removal{{PermID: "m3", Reason: "deleted from GMail"}},
+	}
+	if diff := cmp.Diff(want, got, ignorePlanState); diff != "" {
+		t.Errorf("DryRun() plan differs (-want +got):\n%s", diff)
+	}
+	if got, _ := f.Recorded(ctx, "m1"); !cmp.Equal(got, []string{"INBOX"}) {
+		t.Errorf("labels of m1 = %v after a dry run, want [INBOX]", got)
+	}
+}
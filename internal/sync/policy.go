@@ -0,0 +1,198 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// This file implements sync policies, which limit how much of each
+// message is stored locally.  Messages not stored in full are recorded
+// in persist so they can be fetched later.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/metrics"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+// The setting holding the policy the fetch states were last decided
+// with.
+const policySetting = "policy"
+
+var policyDecisions = metrics.NewCounter("gotmuch_policy_decisions_total",
+	"Messages not stored in full due to the sync policy, by decision.", "decision")
+
+// Policy limits how much of each message is stored locally.  The zero
+// Policy stores every message in full.
+type Policy struct {
+	// If MaxAge is positive, messages received longer ago are
+	// skipped.
+	MaxAge time.Duration
+
+	// If Evict is set, local copies of messages that have aged past
+	// MaxAge are removed, making MaxAge a rolling window.
+	Evict bool
+
+	// If MaxSize is positive, only the header section of messages
+	// whose size estimate exceeds it is stored, as decided by
+	// Oversize.
+	MaxSize int64
+
+	// Oversize is persist.FetchHeaders to store the header section
+	// alone, or persist.FetchStub to add a placeholder body saying
+	// what was left out.
+	Oversize string
+}
+
+// ParseOversize validates the name of an oversize mode.
+func ParseOversize(s string) (string, error) {
+	switch s {
+	case persist.FetchHeaders, persist.FetchStub:
+		return s, nil
+	}
+	return "", errors.Errorf("unknown oversize mode %q; want %s or %s",
+		s, persist.FetchHeaders, persist.FetchStub)
+}
+
+func (p Policy) enabled() bool {
+	return p.MaxAge > 0 || p.MaxSize > 0
+}
+
+// String describes the parts of the policy that decide fetch states.
+func (p Policy) String() string {
+	var parts []string
+	if p.MaxAge > 0 {
+		parts = append(parts, fmt.Sprintf("max-age=%v", p.MaxAge))
+	}
+	if p.MaxSize > 0 {
+		parts = append(parts, fmt.Sprintf("max-size=%d", p.MaxSize), "oversize="+p.Oversize)
+	}
+	if len(parts) == 0 {
+		return "full"
+	}
+	return strings.Join(parts, ",")
+}
+
+// decide returns the fetch state the policy calls for, given a message
+// header and the current time.
+func (p Policy) decide(hdr *message.Header, now time.Time) string {
+	if p.MaxAge > 0 && !hdr.InternalDate.IsZero() && hdr.InternalDate.Before(now.Add(-p.MaxAge)) {
+		return persist.FetchSkipped
+	}
+	if p.MaxSize > 0 && hdr.SizeEstimate > p.MaxSize {
+		if p.Oversize == "" {
+			return persist.FetchStub
+		}
+		return p.Oversize
+	}
+	return persist.FetchFull
+}
+
+// stub returns msg, which holds only a header section, with the body
+// called for by state.
+func stub(msg *message.Body, state string) *message.Body {
+	if state != persist.FetchStub {
+		return msg
+	}
+	stubbed := *msg
+	stubbed.Raw = msg.Raw + fmt.Sprintf(
+		"[gotmuch: the body of this message, about %d bytes, was not\r\n"+
+			"downloaded because it exceeds the sync size limit.  Run\r\n"+
+			"\"gotmuch fetch %s\" to download it.]\r\n",
+		msg.SizeEstimate, msg.PermID)
+	return &stubbed
+}
+
+// storePartial stores the part of a message called for by state, which
+// is not persist.FetchFull.  Local copies to remove are added to plan.
+func storePartial(ctx context.Context, tx *persist.Tx, g MessageStorage, nm *notmuch.Service, hdr *message.Header, state string, st *stats, opts *Options, plan *Plan) error {
+	policyDecisions.Inc(state)
+	var digest message.Digest
+	if state != persist.FetchSkipped {
+		msg, err := g.GetMessageMetadata(ctx, hdr.ID.PermID)
+		if isNotFound(err) {
+			return handleNotFound(ctx, tx, nm, hdr.ID, st, plan)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed getting message %v", hdr.ID.PermID)
+		}
+		slog.DebugContext(ctx, "inserting partial message", "message_id", hdr.ID.PermID,
+			"state", state, "size_estimate", msg.SizeEstimate)
+		if digest, err = nm.Insert(ctx, decorate(stub(msg, state), opts)); err != nil {
+			return err
+		}
+		hdr = &msg.Header
+	}
+	if err := handleUpdatedHeader(ctx, tx, hdr, st); err != nil {
+		return err
+	}
+	if err := recordFile(ctx, tx, nm, hdr.ID.PermID, digest); err != nil {
+		return err
+	}
+	return tx.SetFetchState(ctx, fixmeUser, hdr.ID.PermID, state)
+}
+
+// applyPolicy records the policy in tx.  If it changed since the last
+// run, messages not stored in full are queued for the policy to be
+// evaluated again.
+func applyPolicy(ctx context.Context, tx *persist.Tx, policy Policy) error {
+	prev, err := tx.Setting(ctx, fixmeUser, policySetting)
+	if err != nil {
+		return err
+	}
+	if prev == policy.String() {
+		return nil
+	}
+	n, err := tx.RequeueFetchStates(ctx, fixmeUser,
+		persist.FetchHeaders, persist.FetchStub, persist.FetchSkipped)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "sync policy changed", "from", prev,
+		"to", policy.String(), "requeued", n)
+	return tx.SetSetting(ctx, fixmeUser, policySetting, policy.String())
+}
+
+// evictOld adds the local copies of messages that have aged out of the
+// policy's rolling window to plan, recording their removal in tx.
+func evictOld(ctx context.Context, tx *persist.Tx, nm *notmuch.Service, policy Policy, plan *Plan) error {
+	if !policy.Evict || policy.MaxAge <= 0 {
+		return nil
+	}
+	var old []string
+	err := tx.ListStoredBefore(ctx, fixmeUser, time.Now().Add(-policy.MaxAge), func(id message.ID) error {
+		old = append(old, id.PermID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range old {
+		plan.evict(nm, id, "older than "+policy.MaxAge.String())
+		if err := tx.SetFetchState(ctx, fixmeUser, id, persist.FetchSkipped); err != nil {
+			return err
+		}
+		if err := recordFile(ctx, tx, nm, id, message.Digest{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
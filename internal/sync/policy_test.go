@@ -0,0 +1,53 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/persist"
+)
+
+func TestSyncPolicy(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "policy.json", t)
+	defer f.CloseOrFatal()
+	f.Synced(ctx, 100, "all")
+
+	// m5 exceeds the size limit, so only its header section is
+	// stored, with a stub body.
+	opts := Options{Policy: Policy{MaxSize: 1000, Oversize: persist.FetchStub}}
+	f.SyncOrFatal(ctx, opts)
+	if got := f.FetchState(ctx, "m5"); got != persist.FetchStub {
+		t.Errorf("fetch state of m5 = %q, want %q", got, persist.FetchStub)
+	}
+	if got := f.ReadStored("m5"); !strings.Contains(got, `"gotmuch fetch m5"`) {
+		t.Errorf("stored copy of m5 has no stub body:\n%s", got)
+	}
+	if got := f.Setting(ctx, policySetting); got != opts.Policy.String() {
+		t.Errorf("policy setting = %q, want %q", got, opts.Policy.String())
+	}
+
+	// Lifting the limit replaces the stub with the full message.
+	f.SyncOrFatal(ctx, Options{})
+	if got := f.FetchState(ctx, "m5"); got != persist.FetchFull {
+		t.Errorf("fetch state of m5 = %q, want %q", got, persist.FetchFull)
+	}
+	if got := f.ReadStored("m5"); !strings.Contains(got, "A very large body.") {
+		t.Errorf("stored copy of m5 lacks its body:\n%s", got)
+	}
+}
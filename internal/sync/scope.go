@@ -0,0 +1,113 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// This file implements the sync scope: which messages are
+// synchronized, and reconciling the local state when the scope
+// changes.
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/matta/gotmuch/internal/gmail"
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+// The setting holding the resolved scope the messages table was last
+// populated with.  Databases created before scopes were configurable
+// have none, and are reconciled on first use.
+const scopeSetting = "scope"
+
+// recordLabels records the mailbox's labels in tx and returns them.
+func recordLabels(ctx context.Context, g MessageStorage, tx *persist.Tx) ([]message.Label, error) {
+	labels, err := g.ListLabels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range labels {
+		if err := tx.UpdateLabel(ctx, fixmeUser, l); err != nil {
+			return nil, err
+		}
+	}
+	return labels, nil
+}
+
+// reconcile lists every message in scope, queueing those not yet known
+// for download.  If prune is set, messages no longer in scope are
+// forgotten and the removal of their local copies is added to plan.
+func reconcile(ctx context.Context, g MessageStorage, tx *persist.Tx, nm *notmuch.Service, st *stats, scope gmail.Scope, prune bool, plan *Plan) error {
+	listed := make(map[string]bool)
+	err := pipeIds(ctx, func(ctx context.Context, handler func(message.ID) error) error {
+		return g.ListAll(ctx, scope, handler)
+	}, func(id message.ID) error {
+		listed[id.PermID] = true
+		inserted, err := tx.InsertNewMessageID(ctx, fixmeUser, id)
+		if inserted {
+			st.listed.Add(1)
+		}
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to list messages in scope")
+	}
+	if !prune {
+		return nil
+	}
+
+	var known []string
+	err = tx.ListMessageIDs(ctx, fixmeUser, func(id message.ID) error {
+		known = append(known, id.PermID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Listing does not apply excluded labels, so check them against
+	// the labels last seen on each listed message.
+	exclude := gmail.Scope{Exclude: scope.Exclude}
+	for _, id := range known {
+		if listed[id] {
+			labels, err := tx.MessageLabels(ctx, fixmeUser, id)
+			if err != nil {
+				return err
+			}
+			if exclude.Match(labels) {
+				continue
+			}
+		}
+		if err := pruneMessage(ctx, tx, nm, id, st, plan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneMessage forgets a message that is out of scope, adding the
+// removal of its local copy to plan.  nm is left alone until tx is
+// committed.
+func pruneMessage(ctx context.Context, tx *persist.Tx, nm *notmuch.Service, permID string, st *stats, plan *Plan) error {
+	slog.DebugContext(ctx, "pruning message out of scope", "message_id", permID)
+	plan.remove(nm, permID, "out of scope")
+	if err := tx.DeleteMessage(ctx, fixmeUser, permID); err != nil {
+		return err
+	}
+	st.deleted.Add(1)
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/gmail"
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var (
+	inboxHeader = message.Header{ID: message.ID{PermID: "m1", ThreadID: "t1"}, LabelIDs: []string{"INBOX"}, HistoryID: 90}
+	inboxRaw    = "From: bob@example.com\r\nSubject: Lunch\r\nMessage-ID: <m1@example.com>\r\n\r\nNoon?\r\n"
+	workHeader  = message.Header{ID: message.ID{PermID: "m3", ThreadID: "t3"}, LabelIDs: []string{"Label_1"}, HistoryID: 95}
+	workRaw     = "From: carol@example.com\r\nSubject: Report\r\nMessage-ID: <m3@example.com>\r\n\r\nAttached.\r\n"
+)
+
+// storeInboxAndWork stores m1, labeled INBOX, and m3, labeled Work,
+// after a sync of every message.
+func (f *syncFixture) storeInboxAndWork(ctx context.Context) {
+	f.t.Helper()
+	f.Synced(ctx, 100, "all")
+	f.Store(ctx, inboxHeader, inboxRaw, persist.FetchFull)
+	f.Store(ctx, workHeader, workRaw, persist.FetchFull)
+}
+
+func TestSyncPrune(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "prune.json", t)
+	defer f.CloseOrFatal()
+	f.storeInboxAndWork(ctx)
+
+	f.SyncOrFatal(ctx, Options{Scope: gmail.Scope{Include: []string{"Work"}}, Prune: true})
+	want := runCounts{Status: persist.RunOK, Deleted: 1}
+	if diff := cmp.Diff(want, countsOf(f.LastRun(ctx))); diff != "" {
+		t.Errorf("run counts differ (-want +got):\n%s", diff)
+	}
+	if f.nm.HaveMessage("m1") {
+		t.Errorf("message m1 out of scope is still stored")
+	}
+	if _, ok := f.Recorded(ctx, "m1"); ok {
+		t.Errorf("message m1 out of scope is still recorded")
+	}
+	if !f.nm.HaveMessage("m3") {
+		t.Errorf("message m3 in scope was removed")
+	}
+	if got := f.Setting(ctx, scopeSetting); got != "labels:Label_1" {
+		t.Errorf("scope setting = %q, want \"labels:Label_1\"", got)
+	}
+}
+
+func TestSyncQueryScope(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "query.json", t)
+	defer f.CloseOrFatal()
+	f.Synced(ctx, 100, "all")
+	f.Store(ctx, inboxHeader, inboxRaw, persist.FetchFull)
+	opts := Options{Scope: gmail.Scope{Query: "from:bob"}}
+
+	// The first run reconciles the new scope, finding m5.  The
+	// messages history adds that it did not list are out of scope,
+	// so m6 is not checked against the query.
+	f.SyncOrFatal(ctx, opts)
+	want := runCounts{Status: persist.RunOK, Listed: 1, Fetched: 1}
+	if diff := cmp.Diff(want, countsOf(f.LastRun(ctx))); diff != "" {
+		t.Errorf("first run counts differ (-want +got):\n%s", diff)
+	}
+
+	// The second checks the messages new to history, m7 and m8,
+	// without listing the query again.
+	f.SyncOrFatal(ctx, opts)
+	want = runCounts{Status: persist.RunOK, Listed: 2, Fetched: 1, LabelsChanged: 1}
+	if diff := cmp.Diff(want, countsOf(f.LastRun(ctx))); diff != "" {
+		t.Errorf("second run counts differ (-want +got):\n%s", diff)
+	}
+	for _, id := range []string{"m1", "m5", "m7"} {
+		if !f.nm.HaveMessage(id) {
+			t.Errorf("message %s in scope is not stored", id)
+		}
+	}
+	for _, id := range []string{"m6", "m8"} {
+		if _, ok := f.Recorded(ctx, id); ok {
+			t.Errorf("message %s out of scope is recorded", id)
+		}
+	}
+	if got, _ := f.Recorded(ctx, "m1"); !cmp.Equal(got, []string{"INBOX", "STARRED"}) {
+		t.Errorf("labels of m1 = %v, want [INBOX STARRED]", got)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// This file sends mail through GMail, so replies need no separate SMTP
+// setup and stay in the threads they answer.
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/mail"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+// Send sends the message read from r, in RFC 5322 format, to the
+// recipients its To, Cc and Bcc headers name and to recipients.
+// Recipients those headers do not name are added in a Bcc header.  A
+// reply is added to the GMail thread of the message it answers, if
+// that is recorded in db.  The message sent is stored in nm and
+// recorded in db, so the next sync does not download it.
+func Send(ctx context.Context, g MessageSender, db *persist.DB, nm *notmuch.Service, r io.Reader, recipients []string) (*message.Header, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read message")
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed message")
+	}
+	if bcc := missingRecipients(m.Header, recipients); len(bcc) > 0 {
+		eol := "\n"
+		if i := bytes.IndexByte(raw, '\n'); i > 0 && raw[i-1] == '\r' {
+			eol = "\r\n"
+		}
+		raw = append([]byte("Bcc: "+strings.Join(bcc, ", ")+eol), raw...)
+	}
+
+	threadID, err := replyThread(ctx, db, m.Header)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := g.SendMessage(ctx, bytes.NewReader(raw), threadID)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "sent message", "message_id", hdr.PermID, "thread_id", hdr.ThreadID)
+
+	if err := storeCopy(ctx, db, nm, hdr.ID, bytes.NewReader(raw)); err != nil {
+		return hdr, errors.Wrapf(err, "message sent, but unable to store it as %v", hdr.PermID)
+	}
+	return hdr, nil
+}
+
+// missingRecipients returns the addresses in recipients that the To,
+// Cc and Bcc fields of h do not name.
+func missingRecipients(h mail.Header, recipients []string) []string {
+	named := make(map[string]bool)
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		addrs, _ := h.AddressList(field)
+		for _, a := range addrs {
+			named[strings.ToLower(a.Address)] = true
+		}
+	}
+	var missing []string
+	for _, r := range recipients {
+		if !named[strings.ToLower(r)] {
+			named[strings.ToLower(r)] = true
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+// replyThread returns the GMail thread ID of the message h answers,
+// named by the first Message-ID in In-Reply-To, or else the last in
+// References.  It returns "" if h answers no message or that message is
+// not recorded in db.
+func replyThread(ctx context.Context, db *persist.DB, h mail.Header) (string, error) {
+	var mid string
+	if ids := messageIDs(h.Get("In-Reply-To")); len(ids) > 0 {
+		mid = ids[0]
+	} else if ids := messageIDs(h.Get("References")); len(ids) > 0 {
+		mid = ids[len(ids)-1]
+	}
+	if mid == "" {
+		return "", nil
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	thread, err := tx.LookupThread(ctx, fixmeUser, mid)
+	if err != nil {
+		return "", err
+	}
+	if thread == "" {
+		slog.InfoContext(ctx, "message answered is not recorded; starting a new thread",
+			"header_message_id", mid)
+	}
+	return thread, nil
+}
+
+// messageIDs returns the Message-IDs listed in a header field value,
+// without angle brackets.
+func messageIDs(v string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(v, '<')
+		if start < 0 {
+			return ids
+		}
+		end := strings.IndexByte(v[start:], '>')
+		if end < 0 {
+			return ids
+		}
+		if id := strings.TrimSpace(v[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		v = v[start+end+1:]
+	}
+}
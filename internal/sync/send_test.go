@@ -0,0 +1,56 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "send.json", t)
+	defer f.CloseOrFatal()
+	f.storeInboxAndWork(ctx)
+	reply := "From: alice@example.com\r\n" +
+		"To: bob@example.com\r\n" +
+		"Subject: Re: Lunch\r\n" +
+		"In-Reply-To: <m1@example.com>\r\n" +
+		"Message-ID: <r1@example.com>\r\n" +
+		"\r\n" +
+		"Sure.\r\n"
+
+	// The reply belongs in the thread of m1.
+	m, err := mail.ReadMessage(strings.NewReader(reply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := replyThread(ctx, f.db, m.Header); err != nil || got != "t1" {
+		t.Errorf("replyThread() = %q, %v, want \"t1\", nil", got, err)
+	}
+
+	hdr, err := Send(ctx, f.g, f.db, f.nm, strings.NewReader(reply), []string{"bob@example.com", "carol@example.com"})
+	if err != nil {
+		t.Fatalf("Send() error %v", err)
+	}
+	if hdr.PermID != "m40" || hdr.ThreadID != "t1" {
+		t.Errorf("Send() = %v, want message m40 in thread t1", hdr.ID)
+	}
+	if got := f.ReadStored("m40"); !strings.HasPrefix(got, "Bcc: carol@example.com\n") {
+		t.Errorf("stored copy of the message sent lacks a Bcc for carol:\n%s", got)
+	}
+}
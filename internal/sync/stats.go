@@ -0,0 +1,180 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/metrics"
+	"github.com/matta/gotmuch/internal/persist"
+	"github.com/matta/gotmuch/internal/progress"
+)
+
+var (
+	messagesFetched = metrics.NewCounter("gotmuch_messages_fetched_total",
+		"Full messages downloaded from GMail.")
+	bytesFetched = metrics.NewCounter("gotmuch_message_bytes_fetched_total",
+		"Bytes of full messages downloaded from GMail.")
+	syncRuns = metrics.NewCounter("gotmuch_sync_runs_total",
+		"Sync runs by final status.", "status")
+	syncDuration = metrics.NewHistogram("gotmuch_sync_duration_seconds",
+		"Wall clock duration of sync runs.", metrics.DefaultBuckets, "status")
+	lastSuccess = metrics.NewGauge("gotmuch_last_successful_sync_timestamp_seconds",
+		"Unix time at which the last successful sync run finished.")
+)
+
+// stats accumulates the counters describing a single Sync run.  The
+// counters are updated concurrently by the download workers.
+type stats struct {
+	listed          atomic.Int64
+	fetched         atomic.Int64
+	bytesDownloaded atomic.Int64
+	labelsChanged   atomic.Int64
+	deleted         atomic.Int64
+
+	listDuration     time.Duration
+	downloadDuration time.Duration
+
+	// If not nil, progress is advanced as each message is
+	// processed by the download phase.
+	progress *progress.Progress
+
+	// If not nil, deletions and label removals are checked against
+	// the run's safety limits.
+	limits *breaker
+
+	// Headers fetched by precheck, nil for messages not found.
+	// Read only once downloads start.
+	headers map[string]*message.Header
+}
+
+// processed records that the download phase is done with a message.
+func (s *stats) processed(hdr *message.Header) {
+	if s.progress != nil {
+		s.progress.Add(1, hdr.SizeEstimate)
+	}
+}
+
+// fetchedMessage records the download of a full message of size
+// bytes.
+func (s *stats) fetchedMessage(size int64) {
+	s.fetched.Add(1)
+	s.bytesDownloaded.Add(size)
+	messagesFetched.Inc()
+	bytesFetched.Add(float64(size))
+}
+
+// fill copies the counters into run.
+func (s *stats) fill(run *persist.SyncRun) {
+	run.Listed = s.listed.Load()
+	run.Fetched = s.fetched.Load()
+	run.BytesDownloaded = s.bytesDownloaded.Load()
+	run.LabelsChanged = s.labelsChanged.Load()
+	run.Deleted = s.deleted.Load()
+	run.ListDuration = s.listDuration
+	run.DownloadDuration = s.downloadDuration
+}
+
+// exportRun updates the exported metrics for a finished run.
+func exportRun(run *persist.SyncRun) {
+	syncRuns.Inc(run.Status)
+	syncDuration.Observe(run.Duration().Seconds(), run.Status)
+	if run.Status == persist.RunOK {
+		lastSuccess.Set(float64(run.End.Unix()))
+	}
+}
+
+func retryCounts(g MessageStorage) (retries, throttled int64) {
+	if rc, ok := g.(RetryCounter); ok {
+		return rc.RetryCounts()
+	}
+	return 0, 0
+}
+
+// labelsEqual returns true if a and b hold the same set of labels.
+func labelsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, l := range a {
+		set[l] = true
+	}
+	for _, l := range b {
+		if !set[l] {
+			return false
+		}
+	}
+	return true
+}
+
+// removesLabels returns true if labels in old are missing from new.
+func removesLabels(old, new []string) bool {
+	set := make(map[string]bool, len(new))
+	for _, l := range new {
+		set[l] = true
+	}
+	for _, l := range old {
+		if !set[l] {
+			return true
+		}
+	}
+	return false
+}
+
+func beginRun(ctx context.Context, db *persist.DB, run *persist.SyncRun) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	run.ID, err = tx.BeginSyncRun(ctx, run.Account, run.Start)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func finishRun(ctx context.Context, db *persist.DB, run *persist.SyncRun) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.FinishSyncRun(ctx, run); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecentRuns returns up to limit of the most recent synchronization
+// runs, newest first.
+func RecentRuns(ctx context.Context, db *persist.DB, limit int) ([]*persist.SyncRun, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var runs []*persist.SyncRun
+	err = tx.ListSyncRuns(ctx, fixmeUser, limit, func(run *persist.SyncRun) error {
+		runs = append(runs, run)
+		return nil
+	})
+	return runs, err
+}
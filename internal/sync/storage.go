@@ -19,15 +19,23 @@ package sync
 
 import (
 	"context"
+	"io"
 
+	"github.com/matta/gotmuch/internal/gmail"
 	"github.com/matta/gotmuch/internal/message"
 )
 
-// MessageLister lists all message identifiers from a message storage
-// system.
+// MessageLister lists all message identifiers in a scope from a
+// message storage system.
 type MessageLister interface {
-	ListAll(ctx context.Context, handler func(message.ID) error) error
-	ListFrom(ctx context.Context, historyId uint64, handler func(message.ID) error) error
+	ListAll(ctx context.Context, scope gmail.Scope, handler func(message.ID) error) error
+	ListFrom(ctx context.Context, historyId uint64, scope gmail.Scope, handler func(message.ID) error) error
+	MatchQuery(ctx context.Context, scope gmail.Scope, id string) (bool, error)
+}
+
+// LabelLister lists the labels defined in a message storage system.
+type LabelLister interface {
+	ListLabels(ctx context.Context) ([]message.Label, error)
 }
 
 // MessageMetaGetter gets per message metadata from message storage
@@ -35,6 +43,48 @@ type MessageLister interface {
 type MessageMetaGetter interface {
 	GetMessageHeader(ctx context.Context, id string) (*message.Header, error)
 	GetMessageFull(ctx context.Context, id string) (*message.Body, error)
+
+	// DownloadMessage writes the message GetMessageFull would
+	// return in Raw to w, without holding it in memory, and
+	// returns its header.
+	DownloadMessage(ctx context.Context, id string, w io.Writer) (*message.Header, error)
+
+	// GetMessageMetadata returns a message with only its header
+	// section in Raw.
+	GetMessageMetadata(ctx context.Context, id string) (*message.Body, error)
+}
+
+// MessageImporter adds existing messages to a message storage system.
+type MessageImporter interface {
+	// ImportMessage adds the message read from r, with the given
+	// labels, and returns its header.  r is read again from the
+	// start if the request is retried.
+	ImportMessage(ctx context.Context, r io.ReadSeeker, labelIDs []string) (*message.Header, error)
+}
+
+// DraftStorage holds drafts, which are updated by replacing their
+// message.
+type DraftStorage interface {
+	ListDrafts(ctx context.Context) ([]message.Draft, error)
+
+	// DownloadDraft writes the current version of a draft to w.
+	DownloadDraft(ctx context.Context, draftID string, w io.Writer) (*message.Draft, error)
+
+	// CreateDraft and UpdateDraft read the draft from r, again
+	// from the start if the request is retried.
+	CreateDraft(ctx context.Context, r io.ReadSeeker, threadID string) (*message.Draft, error)
+	UpdateDraft(ctx context.Context, draftID string, r io.ReadSeeker, threadID string) (*message.Draft, error)
+
+	DeleteDraft(ctx context.Context, draftID string) error
+}
+
+// MessageSender sends messages.
+type MessageSender interface {
+	// SendMessage sends the message read from r, adding it to the
+	// given thread if not empty, and returns the header of the
+	// copy kept.  r is read again from the start if the request is
+	// retried.
+	SendMessage(ctx context.Context, r io.ReadSeeker, threadID string) (*message.Header, error)
 }
 
 // MessageProfiler gets per account metadata from a message storage
@@ -43,10 +93,18 @@ type MessageProfiler interface {
 	GetProfile(ctx context.Context) (*message.Profile, error)
 }
 
+// RetryCounter is optionally implemented by message storage systems
+// that retry failed requests.  The counts are cumulative over the life
+// of the object.
+type RetryCounter interface {
+	RetryCounts() (retries, throttled int64)
+}
+
 // MessageStorage provides all possible actions available to deal with
 // message storage.
 type MessageStorage interface {
 	MessageLister
+	LabelLister
 	MessageMetaGetter
 	MessageProfiler
 }
@@ -16,14 +16,16 @@ package sync
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"time"
 
 	"github.com/matta/gotmuch/internal/gmail"
 	"github.com/matta/gotmuch/internal/message"
 	"github.com/matta/gotmuch/internal/notmuch"
 	"github.com/matta/gotmuch/internal/persist"
+	"github.com/matta/gotmuch/internal/progress"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
@@ -43,75 +45,70 @@ func init() {
 	}
 }
 
-func listIds(ctx context.Context, historyId uint64, g MessageStorage, msgs chan<- message.ID) error {
-	defer close(msgs)
-
-	if historyId == 0 {
-		err := g.ListAll(ctx, func(msg message.ID) error {
+// pipeIds calls list, passing each listed message to save.  Listing
+// runs concurrently with saving, so save need not be quick.
+func pipeIds(ctx context.Context, list func(context.Context, func(message.ID) error) error, save func(message.ID) error) error {
+	grp, ctx := errgroup.WithContext(ctx)
+	ids := make(chan message.ID, 1000)
+	grp.Go(func() error {
+		defer close(ids)
+		return list(ctx, func(msg message.ID) error {
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case msgs <- msg:
+			case ids <- msg:
 				return nil
 			}
 		})
-		if err != nil {
-			return errors.Wrap(err, "unable to retrieve all messages")
+	})
+	grp.Go(func() error {
+		for id := range ids {
+			if err := save(id); err != nil {
+				return err
+			}
 		}
 		return nil
-	}
-	err := g.ListFrom(ctx, historyId, func(msg message.ID) error {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case msgs <- msg:
-			return nil
-		}
 	})
-	if err != nil {
-		return errors.Wrap(err, "unable to retrieve incremental messages")
-	}
-	return nil
-
+	return grp.Wait()
 }
 
-func saveIds(ctx context.Context, tx *persist.Tx, ids <-chan message.ID) error {
-	for id := range ids {
+// saveId queues a message for download or a header refresh.
+func saveId(ctx context.Context, tx *persist.Tx, st *stats) func(message.ID) error {
+	return func(id message.ID) error {
 		if err := tx.InsertMessageID(ctx, fixmeUser, id); err != nil {
 			return err
 		}
+		st.listed.Add(1)
+		return nil
 	}
-	return nil
 }
 
-func pullAll(ctx context.Context, g MessageStorage, tx *persist.Tx) error {
+func pullAll(ctx context.Context, g MessageStorage, tx *persist.Tx, st *stats, scope gmail.Scope) error {
 	profile, err := g.GetProfile(ctx)
 	if err != nil {
 		return err
 	}
-	log.Println("Full sync to History ID", profile.HistoryID, "for", profile.EmailAddress)
+	slog.InfoContext(ctx, "full sync", "history_id", profile.HistoryID,
+		"email", profile.EmailAddress, "scope", scope.String())
 	err = tx.WriteHistoryID(ctx, fixmeUser, profile.HistoryID)
 	if err != nil {
 		return err
 	}
 
-	grp, ctx := errgroup.WithContext(ctx)
-	ids := make(chan message.ID, 1000)
-	grp.Go(func() error {
-		return listIds(ctx, 0, g, ids)
-	})
-	grp.Go(func() error {
-		return saveIds(ctx, tx, ids)
-	})
-	return grp.Wait()
+	err = pipeIds(ctx, func(ctx context.Context, handler func(message.ID) error) error {
+		return g.ListAll(ctx, scope, handler)
+	}, saveId(ctx, tx, st))
+	return errors.Wrap(err, "unable to retrieve all messages")
 }
 
-func pullIncremental(ctx context.Context, historyID uint64, g MessageStorage, tx *persist.Tx) error {
+func pullIncremental(ctx context.Context, historyID uint64, g MessageStorage, tx *persist.Tx, st *stats, scope gmail.Scope, reconciled bool) error {
 	profile, err := g.GetProfile(ctx)
 	if err != nil {
 		return err
 	}
-	log.Println("Incremental sync from", historyID, "for", profile.EmailAddress)
+	slog.InfoContext(ctx, "incremental sync", "from_history_id", historyID,
+		"to_history_id", profile.HistoryID, "email", profile.EmailAddress,
+		"scope", scope.String())
 	if historyID == profile.HistoryID {
 		return nil
 	}
@@ -126,46 +123,206 @@ func pullIncremental(ctx context.Context, historyID uint64, g MessageStorage, tx
 		return err
 	}
 
-	grp, ctx := errgroup.WithContext(ctx)
-	ids := make(chan message.ID, 1000)
-	grp.Go(func() error {
-		return listIds(ctx, historyID, g, ids)
-	})
-	grp.Go(func() error {
-		return saveIds(ctx, tx, ids)
+	if scope.Query == "" {
+		err = pipeIds(ctx, func(ctx context.Context, handler func(message.ID) error) error {
+			return g.ListFrom(ctx, historyID, scope, handler)
+		}, saveId(ctx, tx, st))
+		return errors.Wrap(err, "unable to retrieve incremental messages")
+	}
+
+	// History cannot be matched against a query, so refresh the
+	// known messages it mentions and check the others against the
+	// query one by one.  When the scope was just reconciled, every
+	// message in it is already known, so the others are out of scope.
+	err = pipeIds(ctx, func(ctx context.Context, handler func(message.ID) error) error {
+		return g.ListFrom(ctx, historyID, gmail.Scope{}, handler)
+	}, func(id message.ID) error {
+		known, err := tx.MarkUpdated(ctx, fixmeUser, id.PermID)
+		if err != nil {
+			return err
+		}
+		if known {
+			st.listed.Add(1)
+			return nil
+		}
+		if reconciled {
+			return nil
+		}
+		match, err := g.MatchQuery(ctx, scope, id.PermID)
+		if err != nil || !match {
+			return err
+		}
+		return saveId(ctx, tx, st)(id)
 	})
-	return grp.Wait()
+	return errors.Wrap(err, "unable to retrieve incremental messages")
 }
 
-func pullList(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service) error {
+// pullList lists messages, removing local copies as called for once
+// the changes the sync would make are known to be within the safety
+// limits.
+func pullList(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service, st *stats, opts *Options) error {
 	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
 	defer tx.Rollback()
+	total, err := tx.CountMessages(ctx, fixmeUser)
+	if err != nil {
+		return err
+	}
+	st.limits = newBreaker(opts.Limits, opts.Force, total)
+	plan := &Plan{}
+	if err := planList(ctx, g, tx, nm, st, opts, plan); err != nil {
+		return err
+	}
+	if err := precheck(ctx, g, tx, nm, st, opts); err != nil {
+		return err
+	}
+	if err := st.limits.delete(ctx, int64(len(plan.Remove))); err != nil {
+		return err
+	}
+	if err := plan.apply(ctx, nm); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+// planList records the mailbox's labels and lists messages in tx,
+// adding the local copies to remove to plan.
+func planList(ctx context.Context, g MessageStorage, tx *persist.Tx, nm *notmuch.Service, st *stats, opts *Options, plan *Plan) error {
+	labels, err := recordLabels(ctx, g, tx)
+	if err != nil {
+		return err
+	}
+	opts.labelNames = labelNames(labels)
+	if opts.Scope, err = opts.Scope.Resolve(labels); err != nil {
+		return err
+	}
+	if err := listMessages(ctx, g, tx, nm, st, opts, plan); err != nil {
+		return err
+	}
+	return evictOld(ctx, tx, nm, opts.Policy, plan)
+}
+
+// listMessages queues the messages new or changed since the last sync
+// in tx, adding the local copies to remove to plan.
+func listMessages(ctx context.Context, g MessageStorage, tx *persist.Tx, nm *notmuch.Service, st *stats, opts *Options, plan *Plan) error {
 	historyId, err := tx.LatestHistoryID(ctx)
 	if err != nil {
 		return err
 	}
-	if historyId == 0 {
-		err = pullAll(ctx, g, tx)
-	} else {
-		err = pullIncremental(ctx, historyId, g, tx)
+	prev, err := tx.Setting(ctx, fixmeUser, scopeSetting)
+	if err != nil {
+		return err
+	}
+	scope := opts.Scope
+	switch {
+	case historyId == 0:
+		err = pullAll(ctx, g, tx, st, scope)
+	case prev != scope.String():
+		slog.InfoContext(ctx, "sync scope changed; reconciling",
+			"from", prev, "to", scope.String(), "prune", opts.Prune)
+		err = reconcile(ctx, g, tx, nm, st, scope, opts.Prune, plan)
+		if err == nil {
+			err = pullIncremental(ctx, historyId, g, tx, st, scope, true)
+		}
+	default:
+		err = pullIncremental(ctx, historyId, g, tx, st, scope, false)
 	}
 	if err != nil {
 		return errors.Wrap(err, "failed to list messages in pullList()")
 	}
+	if err := tx.SetSetting(ctx, fixmeUser, scopeSetting, scope.String()); err != nil {
+		return err
+	}
+	return applyPolicy(ctx, tx, opts.Policy)
+}
 
-	return tx.Commit()
+// Options control the behavior of Sync.
+type Options struct {
+	// If not nil, progress of the download phase is reported to
+	// Progress.
+	Progress io.Writer
+
+	// Scope selects the messages to synchronize.  Label names in
+	// the scope are resolved when the sync starts.  Changing the
+	// scope between runs triggers a reconcile, which queues
+	// messages new to the scope for download.
+	Scope gmail.Scope
+
+	// If Prune is set, the local copies of messages found to be
+	// out of scope are removed.
+	Prune bool
+
+	// Policy limits how much of each message is stored locally.
+	// Changing the policy between runs queues the messages it
+	// limited for another look.
+	Policy Policy
+
+	// If ThreadHeader is set, an X-GM-THRID header holding the
+	// GMail thread ID is added to each message stored.
+	ThreadHeader bool
+
+	// If GmailHeaders is set, X-Gmail-Message-Id,
+	// X-Gmail-Thread-Id, X-Gmail-Labels and X-Gmail-History-Id
+	// headers are added to each message stored.  The labels are
+	// those at the time the message was stored.  notmuch indexes
+	// the headers when configured to, e.g. with "notmuch config
+	// set index.header.GmailLabel X-Gmail-Labels".
+	GmailHeaders bool
+
+	// Limits cap the changes a sync makes.  They are checked
+	// before anything is written, fetching the headers of the
+	// changed messages that are stored or recorded.
+	Limits Limits
+
+	// If Force is set, changes over the Limits are made anyway.
+	Force bool
+
+	// Label names by ID, set by Sync.
+	labelNames map[string]string
 }
 
-func pullDownload(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service) error {
+// startProgress returns a progress.Progress expecting every message
+// listed for download, or nil if no progress reporting is requested.
+func startProgress(ctx context.Context, db *persist.DB, w io.Writer) (*progress.Progress, error) {
+	if w == nil {
+		return nil, nil
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	count, sized, size, err := tx.CountUpdated(ctx, fixmeUser)
+	if err != nil {
+		return nil, err
+	}
+	p := progress.New(w, count, size, count-sized)
+	p.Start(ctx)
+	return p, nil
+}
+
+func pullDownload(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service, st *stats, opts *Options) error {
+	p, err := startProgress(ctx, db, opts.Progress)
+	if err != nil {
+		return errors.Wrap(err, "unable to count messages to download")
+	}
+	if p != nil {
+		st.progress = p
+		defer p.Stop(ctx)
+	}
+
 	const batchSize = 1000
 	count := batchSize // dummy value
 	for count == batchSize {
-		log.Print("Downloading updated messages...")
+		slog.DebugContext(ctx, "downloading batch of updated messages")
 		count = 0
 
 		tx, err := db.Begin(ctx)
 		defer tx.Rollback()
+		// Local copies are removed once the batch is committed.
+		plan := &Plan{}
 
 		grp, ctx := errgroup.WithContext(ctx)
 		ids := make(chan message.ID)
@@ -191,7 +348,7 @@ func pullDownload(ctx context.Context, g MessageStorage, db *persist.DB, nm *not
 			}
 			grp.Go(func() error {
 				for {
-					if err = handleUpdatedMessage(ctx, tx, g, nm, id); err != nil {
+					if err = handleUpdatedMessage(ctx, tx, g, nm, id, st, opts, plan); err != nil {
 						return errors.Wrap(err, "unable to pull message")
 					}
 					id, ok = <-ids
@@ -208,67 +365,199 @@ func pullDownload(ctx context.Context, g MessageStorage, db *persist.DB, nm *not
 		if err := tx.Commit(); err != nil {
 			return errors.Wrap(err, "unable to commit transaction")
 		}
+		if err := plan.apply(ctx, nm); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func handleUpdatedHeader(ctx context.Context, tx *persist.Tx, hdr *message.Header) error {
-	return tx.UpdateHeader(ctx, fixmeUser, hdr)
+func handleUpdatedHeader(ctx context.Context, tx *persist.Tx, hdr *message.Header, st *stats) error {
+	old, err := tx.MessageLabels(ctx, fixmeUser, hdr.ID.PermID)
+	if err != nil {
+		return err
+	}
+	// New messages have no labels to change.
+	recorded, err := tx.HasHeader(ctx, fixmeUser, hdr.ID.PermID)
+	if err != nil {
+		return err
+	}
+	if recorded && !labelsEqual(old, hdr.LabelIDs) {
+		st.labelsChanged.Add(1)
+	}
+	if err := tx.UpdateHeader(ctx, fixmeUser, hdr); err != nil {
+		return err
+	}
+	st.processed(hdr)
+	return nil
 }
 
 func isNotFound(err error) bool {
 	return errors.Cause(err) == gmail.ErrMessageNotFound
 }
 
-func handleUpdatedMessage(ctx context.Context, tx *persist.Tx, g MessageStorage, nm *notmuch.Service, id message.ID) error {
+// handleNotFound forgets a message that is no longer in GMail, adding
+// the removal of its local copy, if any, to plan.  Only removals count
+// as deletions.
+func handleNotFound(ctx context.Context, tx *persist.Tx, nm *notmuch.Service, id message.ID, st *stats, plan *Plan) error {
+	slog.WarnContext(ctx, "message not found, forgetting it",
+		"message_id", id.PermID, "thread_id", id.ThreadID)
+	if nm.HaveMessage(id.PermID) {
+		plan.remove(nm, id.PermID, "deleted from GMail")
+		st.deleted.Add(1)
+	}
+	if err := tx.DeleteMessage(ctx, fixmeUser, id.PermID); err != nil {
+		return err
+	}
+	st.processed(&message.Header{ID: id})
+	return nil
+}
+
+// handleUpdatedMessage downloads a listed message, or refreshes its
+// header.  Local copies to remove are added to plan.
+func handleUpdatedMessage(ctx context.Context, tx *persist.Tx, g MessageStorage, nm *notmuch.Service, id message.ID, st *stats, opts *Options, plan *Plan) error {
 	// TODO: move full message download elsewhere?
 	haveBody := nm.HaveMessage(id.PermID)
-	if haveBody {
-		header, err := g.GetMessageHeader(ctx, id.PermID)
+
+	// Listing applies the scope only partially (see
+	// gmail.GmailService.ListAll), so when the scope depends on
+	// labels check the header before downloading.  The same goes
+	// for the sync policy, which depends on the date and size.
+	if haveBody || opts.Scope.HasLabels() || opts.Policy.enabled() {
+		header, err := getHeader(ctx, g, st, id.PermID)
 		if isNotFound(err) {
-			// TODO: Treat this as a delete.  The message is no
-			// longer in Gmail.
-			//
-			// For now, ceate a fake message with a HistoryID of
-			// zero.
-			log.Printf("Warning: message not found, setting history ID of %+v to zero", id)
-			return handleUpdatedHeader(ctx, tx, &message.Header{ID: id, HistoryID: 0})
+			return handleNotFound(ctx, tx, nm, id, st, plan)
 		}
 		if err != nil {
 			return errors.Wrapf(err, "from handleUpdatedMessage")
 		}
-		return handleUpdatedHeader(ctx, tx, header)
+		if !opts.Scope.Match(header.LabelIDs) {
+			if !haveBody {
+				// Nothing was stored; forget it.
+				return tx.DeleteMessage(ctx, fixmeUser, id.PermID)
+			}
+			if opts.Prune {
+				return pruneMessage(ctx, tx, nm, id.PermID, st, plan)
+			}
+		}
+		decision := opts.Policy.decide(header, time.Now())
+		if haveBody {
+			state, err := tx.FetchState(ctx, fixmeUser, id.PermID)
+			if err != nil {
+				return err
+			}
+			// Replace partial copies the policy no longer
+			// calls for.
+			if state == "" || state == persist.FetchFull || decision != persist.FetchFull {
+				return handleUpdatedHeader(ctx, tx, header, st)
+			}
+		} else if decision != persist.FetchFull {
+			return storePartial(ctx, tx, g, nm, header, decision, st, opts, plan)
+		}
 	}
-	fullMsg, err := g.GetMessageFull(ctx, id.PermID)
-
+	hdr, digest, n, err := downloadMessage(ctx, g, nm, id.PermID, opts)
 	if isNotFound(err) {
-		// TODO: Treat this as a delete.  The message is no
-		// longer in Gmail.
-		//
-		// For now, ceate a fake message with a HistoryID of
-		// zero.
-		log.Printf("Warning: message not found, setting history ID of %+v to zero", id)
-		return handleUpdatedHeader(ctx, tx, &message.Header{ID: id, HistoryID: 0})
+		return handleNotFound(ctx, tx, nm, id, st, plan)
 	}
 	if err != nil {
-		return errors.Wrapf(err, "failed getting message %v", id.PermID)
+		return err
+	}
+	st.fetchedMessage(n)
+	if err := handleUpdatedHeader(ctx, tx, hdr, st); err != nil {
+		return err
 	}
-	fmt.Println("Inserting ID", id.PermID, "HistoryID",
-		fullMsg.HistoryID, "SizeEstimate", fullMsg.SizeEstimate)
-	if err := nm.Insert(ctx, fullMsg); err != nil {
+	if err := recordFile(ctx, tx, nm, id.PermID, digest); err != nil {
 		return err
 	}
-	return handleUpdatedHeader(ctx, tx, &fullMsg.Header)
+	return tx.SetFetchState(ctx, fixmeUser, id.PermID, persist.FetchFull)
 }
 
-func Sync(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service) error {
-	log.Print("Pulling list of GMail messages")
-	if err := pullList(ctx, g, db, nm); err != nil {
+// downloadMessage streams a message in full from g to its file in nm,
+// and returns its header, the digest of the file and the size of the
+// message downloaded.  Streaming matters since with many workers,
+// holding large messages in memory adds up.
+func downloadMessage(ctx context.Context, g MessageStorage, nm *notmuch.Service, permID string, opts *Options) (*message.Header, message.Digest, int64, error) {
+	w, err := nm.Create(permID)
+	if err != nil {
+		return nil, message.Digest{}, 0, err
+	}
+	var n counter
+	hdr, err := g.DownloadMessage(ctx, permID, io.MultiWriter(w, &n))
+	if isNotFound(err) {
+		w.Abort()
+		return nil, message.Digest{}, 0, err
+	}
+	if err != nil {
+		w.Abort()
+		return nil, message.Digest{}, 0, errors.Wrapf(err, "failed getting message %v", permID)
+	}
+	slog.DebugContext(ctx, "inserting message", "message_id", permID,
+		"history_id", hdr.HistoryID, "size_estimate", hdr.SizeEstimate)
+	digest, err := w.Commit(ctx, extraHeaders(hdr, opts)...)
+	return hdr, digest, int64(n), err
+}
+
+// counter is an io.Writer that counts the bytes written to it.
+type counter int64
+
+func (c *counter) Write(p []byte) (int, error) {
+	*c += counter(len(p))
+	return len(p), nil
+}
+
+func pull(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service, st *stats, opts *Options) error {
+	slog.InfoContext(ctx, "pulling list of GMail messages")
+	start := time.Now()
+	err := pullList(ctx, g, db, nm, st, opts)
+	st.listDuration = time.Since(start)
+	if err != nil {
 		return errors.Wrap(err, "failed to sync")
 	}
-	log.Print("Pulling GMail messages")
-	if err := pullDownload(ctx, g, db, nm); err != nil {
+	slog.InfoContext(ctx, "pulling GMail messages")
+	start = time.Now()
+	err = pullDownload(ctx, g, db, nm, st, opts)
+	st.downloadDuration = time.Since(start)
+	if err != nil {
 		return errors.Wrap(err, "failed to sync")
 	}
-	return nil
+	return checkDuplicates(ctx, db, nm)
+}
+
+// Sync pulls new and changed messages from g into nm, recording the
+// outcome of the run and its statistics in db.
+func Sync(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service, opts Options) error {
+	run := &persist.SyncRun{Account: fixmeUser, Start: time.Now()}
+	if err := beginRun(ctx, db, run); err != nil {
+		return errors.Wrap(err, "unable to record sync run")
+	}
+	retries, throttled := retryCounts(g)
+
+	st := &stats{}
+	err := pull(ctx, g, db, nm, st, &opts)
+
+	st.fill(run)
+	run.End = time.Now()
+	run.Retries, run.Throttled = retryCounts(g)
+	run.Retries -= retries
+	run.Throttled -= throttled
+	run.Status = persist.RunOK
+	if err != nil {
+		run.Status = persist.RunFailed
+		run.Error = err.Error()
+	}
+	exportRun(run)
+	slog.InfoContext(ctx, "sync run finished", "run_id", run.ID,
+		"status", run.Status, "listed", run.Listed, "fetched", run.Fetched,
+		"bytes", run.BytesDownloaded, "labels_changed", run.LabelsChanged,
+		"deleted", run.Deleted, "retries", run.Retries,
+		"throttled", run.Throttled, "duration", run.Duration())
+
+	// Record the run even if ctx has been canceled.
+	if ferr := finishRun(context.WithoutCancel(ctx), db, run); ferr != nil {
+		if err == nil {
+			return errors.Wrap(ferr, "unable to record sync run")
+		}
+		slog.WarnContext(ctx, "unable to record sync run", "err", ferr.Error())
+	}
+	return err
 }
@@ -0,0 +1,322 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// These tests drive the sync engine against recorded GMail API
+// exchanges from testdata, a fresh database, and a notmuch directory
+// farm in a temporary directory.  A shell script stands in for the
+// notmuch binary.
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/gmail"
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+	"github.com/matta/gotmuch/internal/tracehttp"
+
+	"github.com/google/go-cmp/cmp"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The account the tests sync.  Package variables are initialized
+// before init runs, which panics if GOTMUCH_USER is unset.
+var testUser = setenv("GOTMUCH_USER", "alice@example.com")
+
+func setenv(key, value string) string {
+	if err := os.Setenv(key, value); err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// fakeNotmuch logs the arguments it is run with to the calls file, and
+// prints the output recorded for them in an output.* file, whose first
+// line holds the arguments.
+const fakeNotmuch = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$*" >> "$dir/calls"
+if [ "$*" = "config get database.path" ]; then
+	echo "$dir/mail"
+	exit 0
+fi
+for f in "$dir"/output.*; do
+	if [ -f "$f" ] && [ "$(head -n 1 "$f")" = "$*" ]; then
+		tail -n +2 "$f"
+	fi
+done
+`
+
+type syncFixture struct {
+	t        *testing.T
+	dir      string
+	replayer *tracehttp.Replayer
+	g        *gmail.GmailService
+	db       *persist.DB
+	nm       *notmuch.Service
+	outputs  int
+}
+
+// createSyncFixture returns a fixture replaying the named cassette from
+// testdata.
+func createSyncFixture(ctx context.Context, cassette string, t *testing.T) *syncFixture {
+	t.Helper()
+	f := &syncFixture{t: t, dir: t.TempDir()}
+	if err := os.WriteFile(filepath.Join(f.dir, "notmuch"), []byte(fakeNotmuch), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(f.dir, "mail"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", f.dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	var err error
+	if f.replayer, err = tracehttp.NewReplayer(filepath.Join("testdata", cassette)); err != nil {
+		t.Fatalf("tracehttp.NewReplayer() error %v", err)
+	}
+	if f.g, err = gmail.New(&http.Client{Transport: f.replayer}); err != nil {
+		t.Fatalf("gmail.New() error %v", err)
+	}
+	if f.nm, err = notmuch.New(); err != nil {
+		t.Fatalf("notmuch.New() error %v", err)
+	}
+	if f.db, err = persist.Open(ctx, filepath.Join(f.dir, "gotmuch.db")); err != nil {
+		t.Fatalf("persist.Open() error %v", err)
+	}
+	return f
+}
+
+// CloseOrFatal closes the database, and fails the test if part of the
+// cassette was not replayed.
+func (f *syncFixture) CloseOrFatal() {
+	f.t.Helper()
+	if err := f.db.Close(); err != nil {
+		f.t.Errorf("db.Close() error: %v", err)
+	}
+	if n := f.replayer.Unused(); n != 0 && !f.t.Failed() {
+		f.t.Errorf("%d recorded GMail exchanges were not replayed", n)
+	}
+}
+
+func (f *syncFixture) BeginOrFatal(ctx context.Context) *persist.Tx {
+	f.t.Helper()
+	tx, err := f.db.Begin(ctx)
+	if err != nil {
+		f.t.Fatalf("persist.DB.Begin() error %v", err)
+	}
+	return tx
+}
+
+func RollbackOrFatal(t *testing.T, tx *persist.Tx) {
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("tx.Rollback() error %v", err)
+	}
+}
+
+func CommitOrFatal(t *testing.T, tx *persist.Tx) {
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("tx.Commit() error %v", err)
+	}
+}
+
+func (f *syncFixture) SyncOrFatal(ctx context.Context, opts Options) {
+	f.t.Helper()
+	if err := Sync(ctx, f.g, f.db, f.nm, opts); err != nil {
+		f.t.Fatalf("Sync() error %v", err)
+	}
+}
+
+// Synced records a sync of scope up to historyID, as if run before the
+// test.
+func (f *syncFixture) Synced(ctx context.Context, historyID uint64, scope string) {
+	f.t.Helper()
+	tx := f.BeginOrFatal(ctx)
+	if err := tx.WriteHistoryID(ctx, testUser, historyID); err != nil {
+		f.t.Fatalf("tx.WriteHistoryID() error %v", err)
+	}
+	if err := tx.SetSetting(ctx, testUser, scopeSetting, scope); err != nil {
+		f.t.Fatalf("tx.SetSetting() error %v", err)
+	}
+	CommitOrFatal(f.t, tx)
+}
+
+// Store stores a message and records it with the given fetch state, as
+// a sync would.
+func (f *syncFixture) Store(ctx context.Context, hdr message.Header, raw, state string) {
+	f.t.Helper()
+	digest, err := f.nm.Insert(ctx, &message.Body{Header: hdr, Raw: raw})
+	if err != nil {
+		f.t.Fatalf("notmuch.Service.Insert() error %v", err)
+	}
+	tx := f.BeginOrFatal(ctx)
+	if err := tx.InsertMessageID(ctx, testUser, hdr.ID); err != nil {
+		f.t.Fatalf("tx.InsertMessageID() error %v", err)
+	}
+	if err := tx.UpdateHeader(ctx, testUser, &hdr); err != nil {
+		f.t.Fatalf("tx.UpdateHeader() error %v", err)
+	}
+	if err := recordFile(ctx, tx, f.nm, hdr.ID.PermID, digest); err != nil {
+		f.t.Fatalf("recordFile() error %v", err)
+	}
+	if err := tx.SetFetchState(ctx, testUser, hdr.ID.PermID, state); err != nil {
+		f.t.Fatalf("tx.SetFetchState() error %v", err)
+	}
+	CommitOrFatal(f.t, tx)
+}
+
+// Recorded returns the labels recorded for a message, and whether it is
+// recorded at all.
+func (f *syncFixture) Recorded(ctx context.Context, permID string) ([]string, bool) {
+	f.t.Helper()
+	tx := f.BeginOrFatal(ctx)
+	defer RollbackOrFatal(f.t, tx)
+	found := false
+	err := tx.ListMessageIDs(ctx, testUser, func(id message.ID) error {
+		found = found || id.PermID == permID
+		return nil
+	})
+	if err != nil {
+		f.t.Fatalf("tx.ListMessageIDs() error %v", err)
+	}
+	labels, err := tx.MessageLabels(ctx, testUser, permID)
+	if err != nil {
+		f.t.Fatalf("tx.MessageLabels() error %v", err)
+	}
+	return labels, found
+}
+
+func (f *syncFixture) FetchState(ctx context.Context, permID string) string {
+	f.t.Helper()
+	tx := f.BeginOrFatal(ctx)
+	defer RollbackOrFatal(f.t, tx)
+	state, err := tx.FetchState(ctx, testUser, permID)
+	if err != nil {
+		f.t.Fatalf("tx.FetchState() error %v", err)
+	}
+	return state
+}
+
+// StoredPath returns the path of the stored copy of a message.
+func (f *syncFixture) StoredPath(permID string) string {
+	f.t.Helper()
+	var found string
+	err := filepath.WalkDir(filepath.Join(f.dir, "mail"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(path, "-"+permID) {
+			found = path
+		}
+		return err
+	})
+	if err != nil {
+		f.t.Fatalf("filepath.WalkDir() error %v", err)
+	}
+	if found == "" {
+		f.t.Fatalf("message %s is not stored", permID)
+	}
+	return found
+}
+
+// ReadStored returns the stored copy of a message.
+func (f *syncFixture) ReadStored(permID string) string {
+	f.t.Helper()
+	b, err := os.ReadFile(f.StoredPath(permID))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return string(b)
+}
+
+// Respond has the fake notmuch print output when run with args.
+func (f *syncFixture) Respond(output string, args ...string) {
+	f.t.Helper()
+	f.outputs++
+	name := filepath.Join(f.dir, fmt.Sprintf("output.%d", f.outputs))
+	if err := os.WriteFile(name, []byte(strings.Join(args, " ")+"\n"+output), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// NotmuchCalls returns the arguments of each run of the fake notmuch.
+func (f *syncFixture) NotmuchCalls() []string {
+	f.t.Helper()
+	b, err := os.ReadFile(filepath.Join(f.dir, "calls"))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func (f *syncFixture) Setting(ctx context.Context, name string) string {
+	f.t.Helper()
+	tx := f.BeginOrFatal(ctx)
+	defer RollbackOrFatal(f.t, tx)
+	value, err := tx.Setting(ctx, testUser, name)
+	if err != nil {
+		f.t.Fatalf("tx.Setting() error %v", err)
+	}
+	return value
+}
+
+// LastRun returns the most recent sync run.
+func (f *syncFixture) LastRun(ctx context.Context) *persist.SyncRun {
+	f.t.Helper()
+	runs, err := RecentRuns(ctx, f.db, 1)
+	if err != nil {
+		f.t.Fatalf("RecentRuns() error %v", err)
+	}
+	if len(runs) != 1 {
+		f.t.Fatalf("RecentRuns() = %d runs, want 1", len(runs))
+	}
+	return runs[0]
+}
+
+// runCounts holds the counts of a sync run the tests check.
+type runCounts struct {
+	Status                                  string
+	Listed, Fetched, LabelsChanged, Deleted int64
+}
+
+func countsOf(run *persist.SyncRun) runCounts {
+	return runCounts{run.Status, run.Listed, run.Fetched, run.LabelsChanged, run.Deleted}
+}
+
+func TestSyncNotFound(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "notfound.json", t)
+	defer f.CloseOrFatal()
+	f.Synced(ctx, 100, "all")
+	f.Store(ctx, inboxHeader, inboxRaw, persist.FetchFull)
+
+	// History reports a change to m1, which is gone by the time
+	// its header is fetched.
+	f.SyncOrFatal(ctx, Options{})
+	want := runCounts{Status: persist.RunOK, Listed: 1, Deleted: 1}
+	if diff := cmp.Diff(want, countsOf(f.LastRun(ctx))); diff != "" {
+		t.Errorf("run counts differ (-want +got):\n%s", diff)
+	}
+	if f.nm.HaveMessage("m1") {
+		t.Errorf("message m1 gone from GMail is still stored")
+	}
+	if _, ok := f.Recorded(ctx, "m1"); ok {
+		t.Errorf("message m1 gone from GMail is still recorded")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// This file bootstraps the message store from a Google Takeout export,
+// so the first sync of a large mailbox need not download every
+// message.
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/gmail"
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+	"github.com/matta/gotmuch/internal/takeout"
+
+	"github.com/pkg/errors"
+)
+
+// TakeoutReport describes the outcome of ImportTakeout.
+type TakeoutReport struct {
+	// Messages stored.
+	Imported int
+
+	// Messages already stored, which were left alone.
+	Stored int
+
+	// Chats, which the GMail API does not expose.
+	Chats int
+
+	// Messages no longer in GMail, or that could not be matched to
+	// a GMail message.
+	Unmatched int
+}
+
+// ImportTakeout stores the messages of the Takeout mbox at path in nm,
+// and records them in db as stored in full.  Takeout does not record
+// GMail message IDs, so messages are matched to those GMail lists by
+// thread, looking up Message-IDs where a thread holds several
+// messages.  The next sync refreshes the headers and labels of the
+// messages imported instead of downloading them.
+//
+// Messages are stored as Takeout has them, without the headers
+// Options.ThreadHeader and Options.GmailHeaders call for.
+func ImportTakeout(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service, path string) (*TakeoutReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Read the mbox once to match its messages, and again to store
+	// them, so messages need not be held in memory.
+	var refs []takeout.Ref
+	r := takeout.NewReader(f)
+	for {
+		m, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read Takeout mbox")
+		}
+		if m.IsChat() {
+			refs = append(refs, takeout.Ref{})
+		} else {
+			refs = append(refs, takeout.Ref{ThreadID: m.ThreadID, MessageID: m.MessageID})
+		}
+	}
+	slog.InfoContext(ctx, "read Takeout mbox; matching messages to GMail", "messages", len(refs))
+
+	threads := make(map[string][]string)
+	err = g.ListAll(ctx, gmail.Scope{}, func(id message.ID) error {
+		threads[id.ThreadID] = append(threads[id.ThreadID], id.PermID)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list messages")
+	}
+	ids, err := takeout.Match(refs, threads, func(permID string) (string, error) {
+		msg, err := g.GetMessageMetadata(ctx, permID)
+		if isNotFound(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return headerMessageID(msg.Raw), nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to match messages")
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	rep := &TakeoutReport{}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { tx.Rollback() }()
+	const batchSize = 1000
+	r = takeout.NewReader(f)
+	for i := 0; ; i++ {
+		m, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rep, errors.Wrap(err, "unable to read Takeout mbox")
+		}
+		switch id := ids[i]; {
+		case m.IsChat():
+			rep.Chats++
+		case id == "":
+			slog.DebugContext(ctx, "no GMail message matches Takeout message",
+				"header_message_id", m.MessageID, "thread_id", m.ThreadID)
+			rep.Unmatched++
+		case nm.HaveMessage(id):
+			rep.Stored++
+		default:
+			if err := importMessage(ctx, tx, nm, message.ID{PermID: id, ThreadID: m.ThreadID}, m.Content); err != nil {
+				return rep, errors.Wrapf(err, "unable to import message %v", id)
+			}
+			rep.Imported++
+			if rep.Imported%batchSize == 0 {
+				if err := tx.Commit(); err != nil {
+					return rep, err
+				}
+				if tx, err = db.Begin(ctx); err != nil {
+					return rep, err
+				}
+			}
+		}
+	}
+	return rep, tx.Commit()
+}
+
+// importMessage stores a message read from content, and records it as
+// stored in full and due for a header refresh.
+func importMessage(ctx context.Context, tx *persist.Tx, nm *notmuch.Service, id message.ID, content io.Reader) error {
+	w, err := nm.Create(id.PermID)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, content); err != nil {
+		w.Abort()
+		return err
+	}
+	digest, err := w.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	if err := tx.InsertMessageID(ctx, fixmeUser, id); err != nil {
+		return err
+	}
+	if err := tx.SetFetchState(ctx, fixmeUser, id.PermID, persist.FetchFull); err != nil {
+		return err
+	}
+	return recordFile(ctx, tx, nm, id.PermID, digest)
+}
+
+// headerMessageID returns the Message-ID in a message's header section,
+// without angle brackets, or "" if it has none.
+func headerMessageID(raw string) string {
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(m.Header.Get("Message-ID")), "<>")
+}
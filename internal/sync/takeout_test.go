@@ -0,0 +1,87 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// The threads of takeoutMbox are 3e8 and 7d0 in hexadecimal, as GMail
+// lists them.
+const takeoutMbox = "From 1@xxx Mon Sep 27 18:49:01 +0000 2021\n" +
+	"X-GM-THRID: 1000\n" +
+	"X-Gmail-Labels: Inbox\n" +
+	"Message-ID: <a@example.com>\n" +
+	"Subject: Alone\n" +
+	"\n" +
+	"a\n" +
+	"\n" +
+	"From 2@xxx Mon Sep 27 18:49:02 +0000 2021\n" +
+	"X-GM-THRID: 2000\n" +
+	"X-Gmail-Labels: Inbox\n" +
+	"Message-ID: <b@example.com>\n" +
+	"Subject: Plans\n" +
+	"\n" +
+	"b\n" +
+	"\n" +
+	"From 3@xxx Mon Sep 27 18:49:03 +0000 2021\n" +
+	"X-GM-THRID: 2000\n" +
+	"X-Gmail-Labels: Inbox\n" +
+	"Message-ID: <c@example.com>\n" +
+	"Subject: Re: Plans\n" +
+	"\n" +
+	"c\n" +
+	"\n" +
+	"From 4@xxx Mon Sep 27 18:49:04 +0000 2021\n" +
+	"X-GM-THRID: 3000\n" +
+	"X-Gmail-Labels: Chat\n" +
+	"Subject: Chat\n" +
+	"\n" +
+	"hi\n"
+
+func TestImportTakeout(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "takeout.json", t)
+	defer f.CloseOrFatal()
+	path := filepath.Join(f.dir, "takeout.mbox")
+	if err := os.WriteFile(path, []byte(takeoutMbox), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ImportTakeout(ctx, f.g, f.db, f.nm, path)
+	if err != nil {
+		t.Fatalf("ImportTakeout() error %v", err)
+	}
+	if diff := cmp.Diff(&TakeoutReport{Imported: 3, Chats: 1}, got); diff != "" {
+		t.Errorf("ImportTakeout() report differs (-want +got):\n%s", diff)
+	}
+	// The messages of thread 7d0 are matched by Message-ID.
+	for id, mid := range map[string]string{"m20": "a@example.com", "m21": "c@example.com", "m22": "b@example.com"} {
+		if got := f.ReadStored(id); !strings.Contains(got, "Message-ID: <"+mid+">") {
+			t.Errorf("message %s holds\n%s\nwant Message-ID <%s>", id, got, mid)
+		}
+		if got := f.FetchState(ctx, id); got != persist.FetchFull {
+			t.Errorf("fetch state of %s = %q, want %q", id, got, persist.FetchFull)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+	"github.com/matta/gotmuch/internal/threads"
+)
+
+// ThreadsDiff compares GMail's threads with notmuch's for the messages
+// matching a notmuch query, or all messages if query is empty.
+func ThreadsDiff(ctx context.Context, db *persist.DB, nm *notmuch.Service, query string) ([]threads.Disagreement, error) {
+	nmThreads, err := nm.Threads(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	gmail := make(map[string]string)
+	err = tx.ListMessageIDs(ctx, fixmeUser, func(id message.ID) error {
+		gmail[id.PermID] = id.ThreadID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return threads.Diff(gmail, nmThreads), nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+// This file uploads mail that did not come from GMail, such as old
+// archives, so it is kept in GMail and synced like the rest.
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+// Uploader is a message storage system messages can be uploaded to.
+type Uploader interface {
+	LabelLister
+	MessageImporter
+}
+
+// UploadReport describes the outcome of Upload.
+type UploadReport struct {
+	// Messages uploaded.
+	Uploaded int
+
+	// Messages already uploaded but not yet indexed by notmuch,
+	// which were left alone.
+	Recorded int
+
+	// Tags naming no GMail label, which were left out, sorted.
+	IgnoredTags []string
+}
+
+// systemTags maps notmuch tag conventions to the GMail system labels
+// that do not share their names.
+var systemTags = map[string]string{
+	"flagged": "STARRED",
+	"deleted": "TRASH",
+}
+
+// tagLabels returns the IDs of the GMail labels matching notmuch tags,
+// and the tags matching none.  Tags name labels by name or ID, ignoring
+// case.
+func tagLabels(tags []string, labels []message.Label) (ids, ignored []string) {
+	byName := make(map[string]string, 2*len(labels))
+	for _, l := range labels {
+		byName[strings.ToLower(l.Name)] = l.ID
+	}
+	for _, l := range labels {
+		byName[strings.ToLower(l.ID)] = l.ID
+	}
+	for _, tag := range tags {
+		id, ok := byName[strings.ToLower(tag)]
+		if !ok {
+			id, ok = systemTags[tag]
+		}
+		if ok {
+			ids = append(ids, id)
+		} else {
+			ignored = append(ignored, tag)
+		}
+	}
+	return ids, ignored
+}
+
+// Upload imports into GMail the messages matching a notmuch query that
+// did not come from GMail, with labels matching their notmuch tags.
+// Each message is then stored and recorded in db as if downloaded, so
+// it is synced like any other.
+func Upload(ctx context.Context, g Uploader, db *persist.DB, nm *notmuch.Service, query string) (*UploadReport, error) {
+	msgs, err := nm.LocalMessages(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := g.ListLabels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rep := &UploadReport{}
+	ignored := make(map[string]bool)
+	for _, m := range msgs {
+		// Until notmuch indexes the stored copy of an uploaded
+		// message, the query matches the message still.
+		known, err := recorded(ctx, db, m.MessageID)
+		if err != nil {
+			return rep, err
+		}
+		if known {
+			rep.Recorded++
+			continue
+		}
+		ids, unknown := tagLabels(m.Tags, labels)
+		for _, tag := range unknown {
+			ignored[tag] = true
+		}
+		if err := uploadMessage(ctx, g, db, nm, m.Path, ids); err != nil {
+			return rep, errors.Wrapf(err, "unable to upload id:%s", m.MessageID)
+		}
+		rep.Uploaded++
+	}
+	for tag := range ignored {
+		rep.IgnoredTags = append(rep.IgnoredTags, tag)
+	}
+	sort.Strings(rep.IgnoredTags)
+	return rep, nil
+}
+
+// recorded returns true if db records a GMail message with the given
+// Message-ID.
+func recorded(ctx context.Context, db *persist.DB, mid string) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	thread, err := tx.LookupThread(ctx, fixmeUser, mid)
+	return thread != "", err
+}
+
+// uploadMessage imports the message in the file at path with the given
+// labels, then stores and records it.  It is recorded at once, so
+// Upload skips the message should it be run again before notmuch
+// indexes the stored copy.
+func uploadMessage(ctx context.Context, g MessageImporter, db *persist.DB, nm *notmuch.Service, path string, labelIDs []string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hdr, err := g.ImportMessage(ctx, f, labelIDs)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "uploaded message", "path", path, "message_id", hdr.PermID,
+		"thread_id", hdr.ThreadID, "labels", labelIDs)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return storeCopy(ctx, db, nm, hdr.ID, f)
+}
+
+// storeCopy stores the message read from r, which GMail holds as id,
+// and records it in db as stored in full, so the next sync refreshes
+// its header instead of downloading it.
+func storeCopy(ctx context.Context, db *persist.DB, nm *notmuch.Service, id message.ID, r io.Reader) error {
+	w, err := nm.Create(id.PermID)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	digest, err := w.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// The header refresh of the next sync fills in the rest.
+	if err := tx.InsertMessageID(ctx, fixmeUser, id); err != nil {
+		return err
+	}
+	if err := tx.SetFetchState(ctx, fixmeUser, id.PermID, persist.FetchFull); err != nil {
+		return err
+	}
+	if err := recordFile(ctx, tx, nm, id.PermID, digest); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "upload.json", t)
+	defer f.CloseOrFatal()
+	path := filepath.Join(f.dir, "mail", "archive", "1")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	raw := "From: bob@example.com\r\nSubject: Old\r\nMessage-ID: <u1@example.com>\r\n\r\nFrom long ago.\r\n"
+	if err := os.WriteFile(path, []byte(raw), 0644); err != nil {
+		t.Fatal(err)
+	}
+	show := fmt.Sprintf(`[[[{"id": "u1@example.com", "filename": [%q], "tags": ["inbox", "work", "old"]}, []]]]`, path)
+	f.Respond(show, "show", "--format=json", "--body=false", "--entire-thread=false", "folder:archive")
+
+	got, err := Upload(ctx, f.g, f.db, f.nm, "folder:archive")
+	if err != nil {
+		t.Fatalf("Upload() error %v", err)
+	}
+	want := &UploadReport{Uploaded: 1, IgnoredTags: []string{"old"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Upload() report differs (-want +got):\n%s", diff)
+	}
+	if !f.nm.HaveMessage("m30") {
+		t.Errorf("uploaded message m30 is not stored")
+	}
+
+	// Until notmuch indexes the stored copy, the query matches the
+	// message still, but it is not uploaded again.
+	got, err = Upload(ctx, f.g, f.db, f.nm, "folder:archive")
+	if err != nil {
+		t.Fatalf("Upload() error %v", err)
+	}
+	want = &UploadReport{Recorded: 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("second Upload() report differs (-want +got):\n%s", diff)
+	}
+}
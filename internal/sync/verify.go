@@ -0,0 +1,137 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/persist"
+
+	"github.com/pkg/errors"
+)
+
+// Damage describes a message whose local copy is missing or corrupt.
+type Damage struct {
+	PermID  string
+	Problem error
+
+	// Set if the message was downloaded again.
+	Repaired bool
+}
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	// The number of messages checked.
+	Checked int
+
+	// Messages whose local copy is missing or corrupt.
+	Damaged []Damage
+
+	// Files in the notmuch directory farm that hold no known
+	// message.
+	Orphans []string
+}
+
+// Verify checks the local copy of every message that should be stored
+// against its file and recorded digest, and looks for files that hold
+// no known message.  If repair is set, damaged messages are downloaded
+// again.  Only the header options in opts apply.
+func Verify(ctx context.Context, g MessageStorage, db *persist.DB, nm *notmuch.Service, repair bool, opts Options) (*VerifyReport, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var ids []string
+	states := make(map[string]string)
+	err = tx.ListStored(ctx, fixmeUser, func(id message.ID, state string) error {
+		if state != "" {
+			ids = append(ids, id.PermID)
+			states[id.PermID] = state
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{Checked: len(ids)}
+	for _, id := range ids {
+		problem, err := check(ctx, tx, nm, id)
+		if err != nil {
+			return nil, err
+		}
+		if problem != nil {
+			report.Damaged = append(report.Damaged, Damage{PermID: id, Problem: problem})
+		}
+	}
+	if opts.GmailHeaders {
+		labels, err := tx.Labels(ctx, fixmeUser)
+		if err != nil {
+			return nil, err
+		}
+		opts.labelNames = labelNames(labels)
+	}
+	tx.Rollback()
+
+	err = nm.Walk(func(id, path string) error {
+		if states[id] == "" {
+			report.Orphans = append(report.Orphans, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !repair {
+		return report, nil
+	}
+	for i := range report.Damaged {
+		d := &report.Damaged[i]
+		slog.InfoContext(ctx, "repairing damaged message", "message_id", d.PermID, "problem", d.Problem.Error())
+		if err := storeMessage(ctx, g, db, nm, d.PermID, states[d.PermID], &opts); err != nil {
+			return report, err
+		}
+		d.Repaired = true
+	}
+	return report, nil
+}
+
+// check returns what is wrong with the local copy of a message, or nil
+// if it looks intact and matches its recorded digest, if any.
+func check(ctx context.Context, tx *persist.Tx, nm *notmuch.Service, permID string) (problem, err error) {
+	if problem := nm.Check(permID); problem != nil {
+		return problem, nil
+	}
+	want, err := tx.Digest(ctx, fixmeUser, permID)
+	if err != nil || want == nil {
+		return nil, err
+	}
+	got, err := nm.Digest(permID)
+	if err != nil {
+		return err, nil
+	}
+	switch {
+	case got.Size != want.Size:
+		return errors.Errorf("message file is %d bytes, want %d", got.Size, want.Size), nil
+	case got.SHA256 != want.SHA256:
+		return errors.Errorf("message file SHA-256 is %s, want %s", got.SHA256, want.SHA256), nil
+	}
+	return nil, nil
+}
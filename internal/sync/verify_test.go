@@ -0,0 +1,75 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matta/gotmuch/internal/message"
+	"github.com/matta/gotmuch/internal/notmuch"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	f := createSyncFixture(ctx, "verify.json", t)
+	defer f.CloseOrFatal()
+	f.storeInboxAndWork(ctx)
+
+	// m1 is changed without changing its size, and m3 is emptied.
+	changed := strings.Replace(f.ReadStored("m1"), "Noon?", "Noon!", 1)
+	if err := os.WriteFile(f.StoredPath("m1"), []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f.StoredPath("m3"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	orphan := &message.Body{Header: message.Header{ID: message.ID{PermID: "m99"}}, Raw: "Subject: Lost\r\n\r\n"}
+	if _, err := f.nm.Insert(ctx, orphan); err != nil {
+		t.Fatalf("notmuch.Service.Insert() error %v", err)
+	}
+
+	got, err := Verify(ctx, f.g, f.db, f.nm, true, Options{})
+	if err != nil {
+		t.Fatalf("Verify() error %v", err)
+	}
+	if got.Checked != 2 {
+		t.Errorf("Verify() checked %d messages, want 2", got.Checked)
+	}
+	if len(got.Damaged) != 2 {
+		t.Fatalf("Verify() damaged = %+v, want m1 and m3", got.Damaged)
+	}
+	if d := got.Damaged[0]; d.PermID != "m1" || !strings.Contains(d.Problem.Error(), "SHA-256") || !d.Repaired {
+		t.Errorf("Verify() damage %+v, want a repaired SHA-256 mismatch of m1", d)
+	}
+	if d := got.Damaged[1]; d.PermID != "m3" || !errors.Is(d.Problem, notmuch.ErrEmpty) || !d.Repaired {
+		t.Errorf("Verify() damage %+v, want m3 empty and repaired", d)
+	}
+	if want := []string{f.StoredPath("m99")}; len(got.Orphans) != 1 || got.Orphans[0] != want[0] {
+		t.Errorf("Verify() orphans = %q, want %q", got.Orphans, want)
+	}
+
+	// The repaired copies match their digests.
+	got, err = Verify(ctx, f.g, f.db, f.nm, false, Options{})
+	if err != nil {
+		t.Fatalf("Verify() error %v", err)
+	}
+	if len(got.Damaged) != 0 {
+		t.Errorf("Verify() after repair damaged = %+v, want none", got.Damaged)
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package takeout reads the mbox files of Google Takeout mail exports,
+// and matches their messages to GMail API message IDs, which Takeout
+// does not record.
+package takeout
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Message is a message read from a Takeout mbox.
+type Message struct {
+	// The GMail thread ID, in the hexadecimal form used by the
+	// API, from the X-GM-THRID header.
+	ThreadID string
+
+	// The names of the message's labels, from the X-Gmail-Labels
+	// header.
+	Labels []string
+
+	// The Message-ID, without angle brackets, or "" if it has none.
+	MessageID string
+
+	// Content reads the message, without the headers Takeout adds
+	// and with the mbox quoting of "From " lines undone.  It is
+	// valid until the next call to Next.
+	Content io.Reader
+}
+
+// IsChat reports whether m is a chat rather than an email.  Takeout
+// exports chats along with email, but the GMail API hides them.
+func (m *Message) IsChat() bool {
+	for _, l := range m.Labels {
+		if l == "Chat" {
+			return true
+		}
+	}
+	return false
+}
+
+// The headers Takeout adds to each message.
+var takeoutHeaders = map[string]bool{
+	"x-gm-thrid":     true,
+	"x-gmail-labels": true,
+}
+
+// A Reader reads the messages of a Takeout mbox in turn.
+type Reader struct {
+	r       *bufio.Reader
+	started bool
+	content *content
+}
+
+// NewReader returns a Reader reading an mbox from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next message, or io.EOF if there are no more.  Any
+// content of the previous message not yet read is skipped.
+func (r *Reader) Next() (*Message, error) {
+	if r.content != nil {
+		if _, err := io.Copy(io.Discard, r.content); err != nil {
+			return nil, err
+		}
+		r.content = nil
+	}
+	if !r.started {
+		r.started = true
+		// Anything before the first "From " line is not a
+		// message.
+		for !r.atFrom() {
+			if _, err := r.r.ReadBytes('\n'); err != nil {
+				if err == io.EOF {
+					return nil, io.EOF
+				}
+				return nil, err
+			}
+		}
+	}
+	if !r.atFrom() {
+		return nil, io.EOF
+	}
+	if _, err := r.r.ReadBytes('\n'); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	m := &Message{}
+	var fields bytes.Buffer // The header fields parsed.
+	dropping := false
+	for !r.atFrom() {
+		line, err := r.r.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(line, []byte("\r\n"))
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			if len(line) == 0 {
+				header.WriteByte('\n')
+				fields.WriteByte('\n')
+				break
+			}
+			fields.Write(line)
+			fields.WriteByte('\n')
+			if !dropping || (line[0] != ' ' && line[0] != '\t') {
+				name, _, ok := bytes.Cut(line, []byte(":"))
+				dropping = ok && takeoutHeaders[strings.ToLower(string(bytes.TrimSpace(name)))]
+			}
+			if !dropping {
+				header.Write(line)
+				header.WriteByte('\n')
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	fields.WriteByte('\n')
+	if err := m.parse(fields.Bytes()); err != nil {
+		return nil, err
+	}
+	r.content = &content{r: r, pending: header.Bytes()}
+	m.Content = r.content
+	return m, nil
+}
+
+// atFrom reports whether the next line starts a message.
+func (r *Reader) atFrom() bool {
+	b, _ := r.r.Peek(5)
+	return string(b) == "From "
+}
+
+// parse sets the fields of m from the header section in header.
+func (m *Message) parse(header []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(header))
+	if err != nil {
+		return errors.Wrap(err, "malformed message header")
+	}
+	if thrid := msg.Header.Get("X-GM-THRID"); thrid != "" {
+		n, err := strconv.ParseUint(thrid, 10, 64)
+		if err != nil {
+			return errors.Errorf("malformed X-GM-THRID %q", thrid)
+		}
+		m.ThreadID = strconv.FormatUint(n, 16)
+	}
+	if labels := msg.Header.Get("X-Gmail-Labels"); labels != "" {
+		var dec mime.WordDecoder
+		if d, err := dec.DecodeHeader(labels); err == nil {
+			labels = d
+		}
+		for _, l := range strings.Split(labels, ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				m.Labels = append(m.Labels, l)
+			}
+		}
+	}
+	m.MessageID = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(msg.Header.Get("Message-ID")), "<"), ">")
+	return nil
+}
+
+// content reads the rest of a message, up to the next "From " line.
+type content struct {
+	r       *Reader
+	pending []byte // Read but not yet returned.
+	blank   bool   // A blank line is held back.
+	mid     bool   // In the middle of a line of input.
+	eof     bool
+}
+
+func (c *content) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// fill reads the next line, or piece of a long line, into pending.
+// The blank line before each "From " line separates messages, so blank
+// lines are held back until more of the message follows.
+func (c *content) fill() error {
+	if !c.mid && c.r.atFrom() {
+		c.eof = true
+		return nil
+	}
+	line, err := c.r.r.ReadSlice('\n')
+	if err == io.EOF && len(line) == 0 {
+		c.eof = true
+		return nil
+	}
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	atStart := !c.mid
+	c.mid = err == bufio.ErrBufferFull
+	if atStart {
+		if string(line) == "\n" || string(line) == "\r\n" {
+			if c.blank {
+				c.pending = append(c.pending, '\n')
+			}
+			c.blank = true
+			return nil
+		}
+		if i := len(line) - len(bytes.TrimLeft(line, ">")); i > 0 && bytes.HasPrefix(line[i:], []byte("From ")) {
+			line = line[1:]
+		}
+	}
+	if c.blank {
+		c.pending = append(c.pending, '\n')
+		c.blank = false
+	}
+	c.pending = append(c.pending, line...)
+	c.eof = err == io.EOF
+	return nil
+}
+
+// A Ref holds what identifies a Takeout message for matching.
+type Ref struct {
+	ThreadID  string
+	MessageID string
+}
+
+// Match returns the GMail message ID of each message in refs, by
+// index, or "" for messages without a match.  threads holds the IDs of
+// the messages GMail holds in each thread.  A thread holding a single
+// message in both is matched as is.  Otherwise messages are matched by
+// Message-ID, which lookup returns for a GMail message, or "" if it
+// has none.  Each GMail message is matched at most once.
+func Match(refs []Ref, threads map[string][]string, lookup func(permID string) (string, error)) ([]string, error) {
+	byThread := make(map[string][]int)
+	for i, r := range refs {
+		if r.ThreadID != "" {
+			byThread[r.ThreadID] = append(byThread[r.ThreadID], i)
+		}
+	}
+	keys := make([]string, 0, len(byThread))
+	for k := range byThread {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ids := make([]string, len(refs))
+	for _, thread := range keys {
+		idx, cands := byThread[thread], threads[thread]
+		if len(idx) == 1 && len(cands) == 1 {
+			ids[idx[0]] = cands[0]
+			continue
+		}
+		if len(cands) == 0 {
+			continue
+		}
+		byMID := make(map[string][]string)
+		for _, c := range cands {
+			mid, err := lookup(c)
+			if err != nil {
+				return nil, err
+			}
+			if mid != "" {
+				byMID[mid] = append(byMID[mid], c)
+			}
+		}
+		for _, i := range idx {
+			mid := refs[i].MessageID
+			if l := byMID[mid]; mid != "" && len(l) > 0 {
+				ids[i], byMID[mid] = l[0], l[1:]
+			}
+		}
+	}
+	return ids, nil
+}
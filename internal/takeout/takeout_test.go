@@ -0,0 +1,133 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package takeout
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const mbox = "From 1632768541912345678@xxx Mon Sep 27 18:49:01 +0000 2021\r\n" +
+	"X-GM-THRID: 1632768541912345678\r\n" +
+	"X-Gmail-Labels: Inbox,=?UTF-8?Q?Caf=C3=A9?=,\r\n" +
+	" Unread\r\n" +
+	"Message-ID: <one@example.com>\r\n" +
+	"Subject: one\r\n" +
+	"\r\n" +
+	">From the start\r\n" +
+	">>From quoted\r\n" +
+	"\r\n" +
+	"\r\n" +
+	"end\r\n" +
+	"\r\n" +
+	"From 1632768541912345679@xxx Mon Sep 27 18:49:02 +0000 2021\n" +
+	"X-GM-THRID: 1632768541912345678\n" +
+	"X-Gmail-Labels: Chat\n" +
+	"Subject: two\n" +
+	"\n" +
+	"chat"
+
+func TestReader(t *testing.T) {
+	type msg struct {
+		ThreadID, MessageID string
+		Labels              []string
+		Chat                bool
+		Content             string
+	}
+	want := []msg{
+		{
+			ThreadID:  "16a8c2568d1e2c4e",
+			MessageID: "one@example.com",
+			Labels:    []string{"Inbox", "Café", "Unread"},
+			Content:   "Message-ID: <one@example.com>\nSubject: one\n\nFrom the start\r\n>From quoted\r\n\n\nend\r\n",
+		},
+		{
+			ThreadID: "16a8c2568d1e2c4e",
+			Labels:   []string{"Chat"},
+			Chat:     true,
+			Content:  "Subject: two\n\nchat",
+		},
+	}
+
+	r := NewReader(strings.NewReader("junk before the first message\n" + mbox))
+	var got []msg
+	for {
+		m, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error: %v", err)
+		}
+		b, err := io.ReadAll(m.Content)
+		if err != nil {
+			t.Fatalf("reading content error: %v", err)
+		}
+		got = append(got, msg{m.ThreadID, m.MessageID, m.Labels, m.IsChat(), string(b)})
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("messages diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReaderSkipsContent(t *testing.T) {
+	r := NewReader(strings.NewReader(mbox))
+	n := 0
+	for {
+		if _, err := r.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next() error: %v", err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("read %d messages, want 2", n)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	refs := []Ref{
+		{ThreadID: "t1", MessageID: "a"},
+		{ThreadID: "t2", MessageID: "b"},
+		{ThreadID: "t2", MessageID: "c"},
+		{ThreadID: "t2", MessageID: "c"},
+		{ThreadID: "t3", MessageID: "d"},
+		{MessageID: "e"},
+	}
+	threads := map[string][]string{
+		"t1": {"m1"},
+		"t2": {"m2", "m3", "m4"},
+	}
+	mids := map[string]string{"m2": "c", "m3": "b", "m4": "x"}
+	var looked []string
+	got, err := Match(refs, threads, func(id string) (string, error) {
+		looked = append(looked, id)
+		return mids[id], nil
+	})
+	if err != nil {
+		t.Fatalf("Match() error: %v", err)
+	}
+	if want := []string{"m1", "m3", "m2", "", "", ""}; !cmp.Equal(got, want) {
+		t.Errorf("Match() = %q, want %q", got, want)
+	}
+	// Threads holding a single message need no lookup.
+	if want := []string{"m2", "m3", "m4"}; !cmp.Equal(looked, want) {
+		t.Errorf("Match() looked up %q, want %q", looked, want)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package threads compares GMail's grouping of messages into threads
+// with notmuch's.  GMail groups messages into conversations by its own
+// rules, while notmuch follows the References and In-Reply-To headers,
+// so the two can disagree.
+package threads
+
+import (
+	"sort"
+
+	"github.com/matta/gotmuch/internal/notmuch"
+)
+
+// Kinds of Disagreement.
+const (
+	// A GMail thread whose messages are in several notmuch
+	// threads.
+	Split = "split"
+
+	// A notmuch thread holding messages from several GMail
+	// threads.
+	Merged = "merged"
+)
+
+// Disagreement describes a thread grouped differently by GMail and
+// notmuch.
+type Disagreement struct {
+	// Split or Merged.
+	Kind string
+
+	// For Split, the GMail thread ID.  For Merged, the Message-ID
+	// of the first message in the notmuch thread.
+	Thread string
+
+	// The thread's messages, grouped by the other system's
+	// threads, keyed by GMail thread ID or notmuch first
+	// Message-ID.
+	Parts map[string][]string
+}
+
+// Diff compares GMail's threads, given as a map from message ID to
+// thread ID, with notmuch's.  Messages known to only one of the two
+// are ignored.  Disagreements are sorted by kind and thread.
+func Diff(gmail map[string]string, nm []notmuch.Thread) []Disagreement {
+	// The notmuch thread of each message.
+	nmThread := make(map[string]string)
+	// The messages of each GMail thread, restricted to those
+	// notmuch knows about.
+	gmThreads := make(map[string][]string)
+	for _, t := range nm {
+		for _, id := range t.PermIDs {
+			if gt, ok := gmail[id]; ok {
+				nmThread[id] = t.MessageID
+				gmThreads[gt] = append(gmThreads[gt], id)
+			}
+		}
+	}
+
+	var result []Disagreement
+	for gt, ids := range gmThreads {
+		parts := group(ids, nmThread)
+		if len(parts) > 1 {
+			result = append(result, Disagreement{Kind: Split, Thread: gt, Parts: parts})
+		}
+	}
+	for _, t := range nm {
+		parts := group(t.PermIDs, gmail)
+		if len(parts) > 1 {
+			result = append(result, Disagreement{Kind: Merged, Thread: t.MessageID, Parts: parts})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Kind != b.Kind {
+			return a.Kind > b.Kind // Split first.
+		}
+		return a.Thread < b.Thread
+	})
+	return result
+}
+
+// group returns ids grouped by their value in key, sorted within each
+// group.  IDs without a key are left out.
+func group(ids []string, key map[string]string) map[string][]string {
+	parts := make(map[string][]string)
+	for _, id := range ids {
+		if k, ok := key[id]; ok {
+			parts[k] = append(parts[k], id)
+		}
+	}
+	for _, p := range parts {
+		sort.Strings(p)
+	}
+	return parts
+}
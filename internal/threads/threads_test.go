@@ -0,0 +1,55 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threads
+
+import (
+	"testing"
+
+	"github.com/matta/gotmuch/internal/notmuch"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiff(t *testing.T) {
+	gmail := map[string]string{
+		"m1": "t1", "m2": "t1", "m3": "t1", // split by notmuch
+		"m4": "t4", "m5": "t5", // merged by notmuch
+		"m6": "t6", "m7": "t6", // agreed
+		"m8": "t8", // unknown to notmuch
+	}
+	nm := []notmuch.Thread{
+		{MessageID: "a@x", PermIDs: []string{"m2", "m1"}},
+		{MessageID: "b@x", PermIDs: []string{"m3"}},
+		{MessageID: "c@x", PermIDs: []string{"m4", "m5", "m9"}},
+		{MessageID: "d@x", PermIDs: []string{"m6", "m7"}},
+	}
+	got := Diff(gmail, nm)
+	want := []Disagreement{
+		{Kind: Split, Thread: "t1", Parts: map[string][]string{
+			"a@x": {"m1", "m2"},
+			"b@x": {"m3"},
+		}},
+		{Kind: Merged, Thread: "c@x", Parts: map[string][]string{
+			"t4": {"m4"},
+			"t5": {"m5"},
+		}},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("Diff() diff (-got +want):\n%s", cmp.Diff(got, want))
+	}
+	if got := Diff(nil, nm); len(got) != 0 {
+		t.Errorf("Diff(nil, ...) = %v, want none", got)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracehttp
+
+// This file implements recording HTTP exchanges to a cassette file and
+// replaying them later, so that problems seen with a real mailbox can
+// be reproduced offline.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Interaction is one recorded HTTP exchange.
+type Interaction struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	RequestBody string      `json:"request_body,omitempty"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        string      `json:"body"`
+}
+
+// Cassette holds a sequence of recorded interactions.
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Recorder is an http.RoundTripper that records each exchange, with
+// credentials redacted, while delegating the real work to another
+// http.RoundTripper.
+type Recorder struct {
+	delegate http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder returns a Recorder delegating to d.
+func NewRecorder(d http.RoundTripper) *Recorder {
+	return &Recorder{delegate: d}
+}
+
+// RoundTrip records the request and response while delegating the
+// round trip to the delegate.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.delegate.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	respBody, err := readBody(&resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	header := redactHeader(resp.Header)
+	// Recomputed on replay.
+	header.Del("Content-Length")
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, &Interaction{
+		Method:      req.Method,
+		URL:         redactURL(req),
+		RequestBody: string(redactBody(reqBody)),
+		Status:      resp.StatusCode,
+		Header:      header,
+		Body:        string(redactBody(respBody)),
+	})
+	r.mu.Unlock()
+	return resp, nil
+}
+
+// Save writes the recorded interactions to the cassette file at path.
+func (r *Recorder) Save(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, err := json.MarshalIndent(&r.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// Replayer is an http.RoundTripper that serves responses from a
+// cassette instead of the network.  Each request is answered by the
+// first unused interaction with the same method and URL, ignoring any
+// credentials in the URL.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions []*Interaction
+	used         []bool
+}
+
+// NewReplayer returns a Replayer serving the cassette file at path.
+func NewReplayer(path string) (*Replayer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parsing cassette %s: %v", path, err)
+	}
+	return &Replayer{
+		interactions: c.Interactions,
+		used:         make([]bool, len(c.Interactions)),
+	}, nil
+}
+
+// matchURL returns u without the query parameters that carry
+// credentials, with the remaining parameters in a canonical order.
+func matchURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	q := parsed.Query()
+	q.Del("access_token")
+	q.Del("key")
+	parsed.RawQuery = q.Encode()
+	return parsed.String()
+}
+
+// RoundTrip answers req from the cassette.
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	want := matchURL(req.URL.String())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, in := range r.interactions {
+		if r.used[i] || in.Method != req.Method || matchURL(in.URL) != want {
+			continue
+		}
+		r.used[i] = true
+		header := in.Header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+			StatusCode:    in.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(strings.NewReader(in.Body)),
+			ContentLength: int64(len(in.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("tracehttp: no recorded response for %s %s", req.Method, want)
+}
+
+// Unused returns the number of interactions not yet replayed.
+func (r *Replayer) Unused() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, used := range r.used {
+		if !used {
+			n++
+		}
+	}
+	return n
+}
@@ -15,40 +15,216 @@
 package tracehttp
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net/http"
-	"net/http/httputil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// TraceTransport is an http.RoundTripper that prints the request and
-// response to stdout while delegating the real work to another
-// http.RoundTripper.
+// Options control what a tracing transport records.
+type Options struct {
+	// Out receives the trace.
+	Out io.Writer
+
+	// If Bodies is set the headers and bodies of each request and
+	// response are written.  Otherwise only a summary line per
+	// request is written.
+	Bodies bool
+
+	// If MaxBody is positive, bodies are truncated to that many
+	// bytes.
+	MaxBody int
+}
+
+// TraceTransport is an http.RoundTripper that writes a trace of each
+// request and response to an io.Writer while delegating the real work
+// to another http.RoundTripper.  Credentials are redacted from the
+// trace.
 type traceTransport struct {
 	delegate http.RoundTripper
+	opts     Options
+
+	mu  sync.Mutex // serializes writes to opts.Out
+	seq atomic.Int64
+}
+
+var (
+	// Headers whose values are never traced.
+	redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+	// Token fields in JSON and form encoded bodies, as used by
+	// the OAuth2 token endpoint.
+	jsonTokenRE = regexp.MustCompile(`("(?:access_token|refresh_token|id_token|client_secret)"\s*:\s*")[^"]*(")`)
+	formTokenRE = regexp.MustCompile(`((?:^|&)(?:access_token|refresh_token|client_secret|code|assertion)=)[^&]*`)
+)
+
+const redacted = "REDACTED"
+
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range redactedHeaders {
+		if _, ok := h[k]; ok {
+			h.Set(k, redacted)
+		}
+	}
+	return h
+}
+
+func redactBody(b []byte) []byte {
+	b = jsonTokenRE.ReplaceAll(b, []byte("${1}"+redacted+"${2}"))
+	return formTokenRE.ReplaceAll(b, []byte("${1}"+redacted))
+}
+
+// readBody reads all of *body and replaces it with an equivalent
+// reader, so the body may be both traced and used.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	b, err := io.ReadAll(*body)
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(b))
+	return b, err
 }
 
-// RoundTrip prints a dump of the request and response while delegating the
+func (t *traceTransport) writeHeader(w *strings.Builder, h http.Header) {
+	h = redactHeader(h)
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(w, "%s: %s\n", k, v)
+		}
+	}
+	w.WriteString("\n")
+}
+
+func (t *traceTransport) writeBody(w *strings.Builder, b []byte) {
+	b = redactBody(b)
+	if t.opts.MaxBody > 0 && len(b) > t.opts.MaxBody {
+		fmt.Fprintf(w, "%s\n[truncated %d of %d bytes]\n", b[:t.opts.MaxBody], len(b)-t.opts.MaxBody, len(b))
+		return
+	}
+	if len(b) > 0 {
+		w.Write(b)
+		w.WriteString("\n")
+	}
+}
+
+func (t *traceTransport) write(s string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	io.WriteString(t.opts.Out, s)
+}
+
+// RoundTrip traces the request and response while delegating the
 // round trip to the delegate.
-func (t *traceTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	dump, dumpErr := httputil.DumpRequest(req, true)
-	if dumpErr == nil {
-		fmt.Println(string(dump))
-	}
-	resp, err = t.delegate.RoundTrip(req)
-	if err == nil {
-		dump, dumpErr = httputil.DumpResponse(resp, true)
-		if dumpErr == nil {
-			fmt.Println(string(dump))
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	seq := t.seq.Add(1)
+	start := time.Now()
+	var reqBytes int64
+	if t.opts.Bodies {
+		body, err := readBody(&req.Body)
+		if err != nil {
+			return nil, err
+		}
+		reqBytes = int64(len(body))
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "#%d >>> %s %s %s\n", seq, req.Method, redactURL(req), req.Proto)
+		t.writeHeader(&sb, req.Header)
+		t.writeBody(&sb, body)
+		t.write(sb.String())
+	} else if req.ContentLength > 0 {
+		reqBytes = req.ContentLength
+	}
+
+	resp, err := t.delegate.RoundTrip(req)
+	if err != nil {
+		t.write(fmt.Sprintf("#%d %s %s error %v after %v\n",
+			seq, req.Method, redactURL(req), err, time.Since(start).Round(time.Millisecond)))
+		return resp, err
+	}
+
+	if t.opts.Bodies {
+		body, err := readBody(&resp.Body)
+		if err != nil {
+			return nil, err
 		}
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "#%d <<< %s %s\n", seq, resp.Proto, resp.Status)
+		t.writeHeader(&sb, resp.Header)
+		t.writeBody(&sb, body)
+		t.write(sb.String())
+	}
+
+	// Write the summary when the body has been consumed, so the
+	// response size is known.
+	resp.Body = &summaryBody{
+		ReadCloser: resp.Body,
+		done: func(n int64) {
+			t.write(fmt.Sprintf("#%d %s %s %d %v req=%dB resp=%dB\n",
+				seq, req.Method, redactURL(req), resp.StatusCode,
+				time.Since(start).Round(time.Millisecond), reqBytes, n))
+		},
 	}
-	return resp, err
+	return resp, nil
+}
+
+// redactURL returns the request URL with credentials in the query
+// redacted.
+func redactURL(req *http.Request) string {
+	u := *req.URL
+	q := u.Query()
+	changed := false
+	for _, k := range []string{"access_token", "key"} {
+		if q.Has(k) {
+			q.Set(k, redacted)
+			changed = true
+		}
+	}
+	if changed {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// summaryBody counts the bytes read from a response body and calls
+// done with the count when the body is closed.
+type summaryBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (b *summaryBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *summaryBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n) })
+	return err
 }
 
-func Wrap(d http.RoundTripper) http.RoundTripper {
-	return &traceTransport{d}
+// Wrap returns an http.RoundTripper that traces requests made through
+// d according to opts.
+func Wrap(d http.RoundTripper, opts Options) http.RoundTripper {
+	return &traceTransport{delegate: d, opts: opts}
 }
 
 // Inject a TraceTransport into http.DefaultTransport
-func WrapDefaultTransport() {
-	http.DefaultTransport = Wrap(http.DefaultTransport)
+func WrapDefaultTransport(opts Options) {
+	http.DefaultTransport = Wrap(http.DefaultTransport, opts)
 }
@@ -0,0 +1,175 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracehttp
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{
+			`{"access_token": "ya29.secret", "expires_in": 3599}`,
+			`{"access_token": "REDACTED", "expires_in": 3599}`,
+		},
+		{
+			`{"refresh_token":"1//secret","id_token":"eyJ"}`,
+			`{"refresh_token":"REDACTED","id_token":"REDACTED"}`,
+		},
+		{
+			`client_id=id&client_secret=s3cret&grant_type=refresh_token&refresh_token=1%2F%2Fsecret`,
+			`client_id=id&client_secret=REDACTED&grant_type=refresh_token&refresh_token=REDACTED`,
+		},
+		{
+			`{"raw": "not a token"}`,
+			`{"raw": "not a token"}`,
+		},
+	}
+	for _, tc := range cases {
+		if got := string(redactBody([]byte(tc.in))); got != tc.want {
+			t.Errorf("redactBody(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func roundTrip(t *testing.T, opts Options, body string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		io.WriteString(w, `{"access_token": "ya29.secret", "raw": "0123456789"}`)
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	opts.Out = &out
+	client := &http.Client{Transport: Wrap(http.DefaultTransport, opts)}
+	req, err := http.NewRequest("POST", srv.URL+"/token?key=secret", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do() error: %v", err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("reading response error: %v", err)
+	}
+	if !strings.Contains(string(got), "ya29.secret") {
+		t.Errorf("response body was altered: %q", got)
+	}
+	return out.String()
+}
+
+func TestSummary(t *testing.T) {
+	trace := roundTrip(t, Options{}, "refresh_token=secret")
+	if strings.Contains(trace, "secret") {
+		t.Errorf("trace contains a secret:\n%s", trace)
+	}
+	for _, want := range []string{"#1 POST http://", "/token?key=REDACTED 200 ", " req=20B resp=52B\n"} {
+		if !strings.Contains(trace, want) {
+			t.Errorf("trace does not contain %q:\n%s", want, trace)
+		}
+	}
+	if n := strings.Count(trace, "\n"); n != 1 {
+		t.Errorf("trace has %d lines, want 1:\n%s", n, trace)
+	}
+}
+
+func TestBodies(t *testing.T) {
+	trace := roundTrip(t, Options{Bodies: true, MaxBody: 40}, "refresh_token=secret")
+	if strings.Contains(trace, "secret") {
+		t.Errorf("trace contains a secret:\n%s", trace)
+	}
+	for _, want := range []string{
+		"Authorization: REDACTED\n",
+		"Set-Cookie: REDACTED\n",
+		"refresh_token=REDACTED\n",
+		`{"access_token": "REDACTED", "raw": "012` + "\n[truncated 9 of 49 bytes]\n",
+	} {
+		if !strings.Contains(trace, want) {
+			t.Errorf("trace does not contain %q:\n%s", want, trace)
+		}
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		io.WriteString(w, `{"path": "`+r.URL.Path+`", "access_token": "secret"}`)
+	}))
+	defer srv.Close()
+
+	rec := NewRecorder(http.DefaultTransport)
+	get := func(client *http.Client, path string) (int, string) {
+		t.Helper()
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("client.Get(%q) error: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading response error: %v", err)
+		}
+		return resp.StatusCode, string(b)
+	}
+	client := &http.Client{Transport: rec}
+	get(client, "/a?access_token=secret")
+	get(client, "/b")
+
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+	if err := rec.Save(cassette); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	b, err := os.ReadFile(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("cassette contains a secret:\n%s", b)
+	}
+
+	rep, err := NewReplayer(cassette)
+	if err != nil {
+		t.Fatalf("NewReplayer() error: %v", err)
+	}
+	srv.Close() // Replay must not use the network.
+	client = &http.Client{Transport: rep}
+	if code, body := get(client, "/b"); code != 200 || !strings.Contains(body, `"/b"`) {
+		t.Errorf("replayed /b = %d %q", code, body)
+	}
+	if code, body := get(client, "/a?access_token=other"); code != 200 || !strings.Contains(body, `"/a"`) {
+		t.Errorf("replayed /a = %d %q", code, body)
+	}
+	if n := rep.Unused(); n != 0 {
+		t.Errorf("Unused() = %d, want 0", n)
+	}
+	if _, err := client.Get(srv.URL + "/b"); err == nil {
+		t.Errorf("replaying /b a second time succeeded, want an error")
+	}
+}
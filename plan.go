@@ -0,0 +1,53 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/matta/gotmuch/internal/sync"
+)
+
+// printPlan prints a dry run's plan in the given format, text or json.
+// The text format has one line per change, then a summary.  Label
+// changes of refreshed messages are listed as +label and -label.
+func printPlan(w io.Writer, plan *sync.Plan, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+	for _, id := range plan.Add {
+		fmt.Fprintf(w, "add %s\n", id)
+	}
+	for _, r := range plan.Refresh {
+		fmt.Fprintf(w, "refresh %s:", r.PermID)
+		for _, l := range r.Added {
+			fmt.Fprintf(w, " +%s", l)
+		}
+		for _, l := range r.Removed {
+			fmt.Fprintf(w, " -%s", l)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, r := range plan.Remove {
+		fmt.Fprintf(w, "remove %s: %s\n", r.PermID, r.Reason)
+	}
+	_, err := fmt.Fprintf(w, "%d to add, %d to refresh, %d to remove.\n",
+		len(plan.Add), len(plan.Refresh), len(plan.Remove))
+	return err
+}
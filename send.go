@@ -0,0 +1,64 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/matta/gotmuch/internal/gmail"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/sync"
+
+	"github.com/pkg/errors"
+)
+
+// runSend works as sendmail does for mail clients: it reads a message
+// on stdin and sends it, printing nothing unless it fails.
+func runSend(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	// The sendmail flags mail clients pass.  GMail always takes the
+	// recipients from the headers, as -t does, and the sender from
+	// the account, so these change nothing.
+	fs.Bool("t", false, "read recipients from the message headers (always done)")
+	fs.Bool("i", false, "ignored")
+	fs.Bool("oi", false, "ignored")
+	fs.Bool("oem", false, "ignored")
+	fs.String("f", "", "ignored; GMail sends from the account's address")
+	fs.String("F", "", "ignored")
+	fs.Parse(args)
+
+	nm, err := notmuch.New()
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize notmuch")
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := openGmail(gmail.SendScope)
+	if err != nil {
+		return err
+	}
+
+	if _, err := sync.Send(ctx, s, db, nm, os.Stdin, fs.Args()); err != nil {
+		return errors.Wrap(err, "send failed")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matta/gotmuch/internal/persist"
+	"github.com/matta/gotmuch/internal/progress"
+	"github.com/matta/gotmuch/internal/sync"
+)
+
+func runStats(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	limit := fs.Int("n", 20, "show the most recent `count` runs")
+	fs.Parse(args)
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	runs, err := sync.RecentRuns(ctx, db, *limit)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Println("No sync runs recorded.")
+		return nil
+	}
+	printRuns(os.Stdout, runs)
+	fmt.Println()
+	printTrends(os.Stdout, runs)
+	return nil
+}
+
+// printRuns prints one line per run, newest first.
+func printRuns(w io.Writer, runs []*persist.SyncRun) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "RUN\tSTARTED\tSTATUS\tLISTED\tFETCHED\tBYTES\tLABELS\tDELETED\tRETRIES\t429s\tLIST\tDOWNLOAD\tTOTAL\t")
+	for _, r := range runs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t\n",
+			r.ID, r.Start.Format("2006-01-02 15:04"), r.Status,
+			r.Listed, r.Fetched, progress.FormatBytes(r.BytesDownloaded),
+			r.LabelsChanged, r.Deleted, r.Retries, r.Throttled,
+			formatDuration(r.ListDuration),
+			formatDuration(r.DownloadDuration),
+			formatDuration(r.Duration()))
+	}
+	tw.Flush()
+	for _, r := range runs {
+		if r.Error != "" {
+			fmt.Fprintf(w, "run %d: %s\n", r.ID, r.Error)
+		}
+	}
+}
+
+// printTrends summarizes the successful runs, comparing the most recent
+// one against the average of the others.
+func printTrends(w io.Writer, runs []*persist.SyncRun) {
+	var ok []*persist.SyncRun
+	failed := 0
+	for _, r := range runs {
+		switch r.Status {
+		case persist.RunOK:
+			ok = append(ok, r)
+		case persist.RunFailed:
+			failed++
+		}
+	}
+	fmt.Fprintf(w, "%d runs: %d ok, %d failed\n", len(runs), len(ok), failed)
+	if len(ok) == 0 {
+		return
+	}
+
+	var fetched, bytes, retries int64
+	var total, download time.Duration
+	for _, r := range ok {
+		fetched += r.Fetched
+		bytes += r.BytesDownloaded
+		retries += r.Retries
+		total += r.Duration()
+		download += r.DownloadDuration
+	}
+	n := int64(len(ok))
+	fmt.Fprintf(w, "average per ok run: fetched %d, downloaded %s, retries %d, took %s\n",
+		fetched/n, progress.FormatBytes(bytes/n), retries/n, formatDuration(total/time.Duration(n)))
+	if download > 0 {
+		fmt.Fprintf(w, "download rate: %.1f messages/s, %s/s\n",
+			float64(fetched)/download.Seconds(),
+			progress.FormatBytes(int64(float64(bytes)/download.Seconds())))
+	}
+
+	if len(ok) > 1 {
+		last := ok[0]
+		avg := (total - last.Duration()) / time.Duration(n-1)
+		fmt.Fprintf(w, "latest ok run (%d) took %s, against an average of %s for the previous %d\n",
+			last.ID, formatDuration(last.Duration()), formatDuration(avg), n-1)
+	}
+	if last := runs[0]; last.Status == persist.RunOK {
+		fmt.Fprintf(w, "last sync succeeded %s ago\n",
+			formatDuration(time.Since(last.End)))
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Hour:
+		return d.Round(time.Minute).String()
+	case d >= time.Second:
+		return d.Round(time.Second).String()
+	default:
+		return d.Round(time.Millisecond).String()
+	}
+}
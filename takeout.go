@@ -0,0 +1,61 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/sync"
+
+	"github.com/pkg/errors"
+)
+
+func runImportTakeout(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import-takeout", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New(`import-takeout: want "import-takeout <file.mbox>"`)
+	}
+
+	nm, err := notmuch.New()
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize notmuch")
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := openGmail()
+	if err != nil {
+		return err
+	}
+
+	rep, err := sync.ImportTakeout(ctx, s, db, nm, fs.Arg(0))
+	if rep != nil {
+		fmt.Fprintf(os.Stdout, "%d imported, %d already stored, %d chats skipped, %d not found in GMail.\n",
+			rep.Imported, rep.Stored, rep.Chats, rep.Unmatched)
+	}
+	if err != nil {
+		return errors.Wrap(err, "import failed")
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/sync"
+	"github.com/matta/gotmuch/internal/threads"
+
+	"github.com/pkg/errors"
+)
+
+func runThreads(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("threads", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 || fs.Arg(0) != "diff" {
+		return errors.New(`threads: want "threads diff [query]"`)
+	}
+	query := strings.Join(fs.Args()[1:], " ")
+
+	nm, err := notmuch.New()
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize notmuch")
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	diffs, err := sync.ThreadsDiff(ctx, db, nm, query)
+	if err != nil {
+		return err
+	}
+	printThreadsDiff(os.Stdout, diffs)
+	return nil
+}
+
+// printThreadsDiff prints each disagreement followed by its parts.
+// notmuch threads are printed as queries that find them.
+func printThreadsDiff(w io.Writer, diffs []threads.Disagreement) {
+	nmThread := func(id string) string {
+		return "thread:{id:" + id + "}"
+	}
+	for _, d := range diffs {
+		keys := make([]string, 0, len(d.Parts))
+		for k := range d.Parts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		switch d.Kind {
+		case threads.Split:
+			fmt.Fprintf(w, "GMail thread %s is split into %d notmuch threads:\n", d.Thread, len(keys))
+			for _, k := range keys {
+				fmt.Fprintf(w, "  %s: %s\n", nmThread(k), strings.Join(d.Parts[k], " "))
+			}
+		case threads.Merged:
+			fmt.Fprintf(w, "notmuch thread %s merges %d GMail threads:\n", nmThread(d.Thread), len(keys))
+			for _, k := range keys {
+				fmt.Fprintf(w, "  %s: %s\n", k, strings.Join(d.Parts[k], " "))
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d disagreements.\n", len(diffs))
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/matta/gotmuch/internal/gmail"
+	"github.com/matta/gotmuch/internal/notmuch"
+	"github.com/matta/gotmuch/internal/sync"
+
+	"github.com/pkg/errors"
+)
+
+func runUpload(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	fs.Parse(args)
+	query := strings.Join(fs.Args(), " ")
+	if query == "" {
+		return errors.New(`upload: want "upload <notmuch query>"`)
+	}
+
+	nm, err := notmuch.New()
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize notmuch")
+	}
+
+	db, err := openDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := openGmail(gmail.ReadonlyScope, gmail.InsertScope)
+	if err != nil {
+		return err
+	}
+
+	rep, err := sync.Upload(ctx, s, db, nm, query)
+	if rep != nil {
+		fmt.Fprintf(os.Stdout, "%d messages uploaded.\n", rep.Uploaded)
+		if rep.Recorded > 0 {
+			fmt.Fprintf(os.Stdout, "%d messages already uploaded were left alone; run \"notmuch new\" to index them.\n",
+				rep.Recorded)
+		}
+		if len(rep.IgnoredTags) > 0 {
+			fmt.Fprintf(os.Stdout, "Tags naming no GMail label were left out: %s\n",
+				strings.Join(rep.IgnoredTags, " "))
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "upload failed")
+	}
+	return nil
+}